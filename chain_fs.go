@@ -1,82 +1,219 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
 // ChainFS implements ServerFS and manages a chain of filesystems
 type ChainFS struct {
 	filesystems []ServerFS
-	mutex       sync.RWMutex
+	lockService LockService // nil to lock in the first filesystem that supports it
+	paths       pathLocks   // Serializes operations per path
+	fences      pathLocks   // Held shared by fenced writes under a remote lock service
+	versions    versionTable
+	writeback   *writeback // nil in write-through mode
+	promotion   promoter
+	promoting   sync.Map       // Files being promoted in the background
+	background  sync.WaitGroup // Promotions running in the background
+	copySeq     atomic.Uint64  // Numbers the hidden copies of promotions
 }
 
-// NewChainFS creates a new ChainFS with the given filesystems
-func NewChainFS(filesystems []ServerFS) *ChainFS {
+// NewChainFS creates a new ChainFS with the given filesystems. Locks are
+// managed by lockService, or by the first filesystem that supports locking
+// when it is nil.
+func NewChainFS(filesystems []ServerFS, lockService LockService) *ChainFS {
 	return &ChainFS{
 		filesystems: filesystems,
+		lockService: lockService,
 	}
 }
 
-// findFirstLockableFS returns the first filesystem that supports locking
-func (c *ChainFS) findFirstLockableFS() (ServerFS, error) {
+// findLockService returns the lock service of the chain: the configured one,
+// or else the first filesystem that supports locking
+func (c *ChainFS) findLockService() (LockService, error) {
+	if c.lockService != nil {
+		return c.lockService, nil
+	}
 	for _, fs := range c.filesystems {
 		if fs.GetFeatures().CanLock {
 			return fs, nil
 		}
 	}
-	return nil, fmt.Errorf("no filesystem in the chain supports locking")
+	return nil, fmt.Errorf("no filesystem in the chain supports locking: %w", ErrLockingNotSupported)
 }
 
-// Lock implements file locking using the first filesystem that supports it
-func (c *ChainFS) Lock(path string, lockType LockType, processID int) error {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
+// Lock implements file locking using the chain's lock service
+func (c *ChainFS) Lock(ctx context.Context, path string, lockType LockType, owner LockOwner, opts LockOptions) (uint64, error) {
+	unlock := c.paths.RLock(path)
+	locks, err := c.findLockService()
+	if err == nil {
+		_, err = c.firstHolder(path)
+	}
+	unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	// The path is not locked while waiting, or the holder's unlock could never get through
+	token, err := locks.Lock(ctx, path, lockType, owner, opts)
+	if err == nil {
+		// Writes fenced by the previous holder's token finish before the new
+		// holder learns its own
+		c.fences.Lock(path)()
+	}
+	return token, err
+}
+
+// Fence checks a fencing token with the chain's lock service. A lock table
+// in the chain checks it atomically with its grants; a remote one is asked
+// for its locks, and the chain holds off passing on grants itself.
+func (c *ChainFS) Fence(path string, owner LockOwner, token uint64) (func(), error) {
+	locks, err := c.findLockService()
+	if err != nil {
+		return nil, err
+	}
+	if fs, ok := locks.(ServerFS); ok {
+		return fs.Fence(path, owner, token)
+	}
+
+	unlock := c.fences.RLock(path)
+	holders, err := locks.ListLocks(path)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	for _, lock := range holders {
+		if lock.Path == lockPath(path) && !lock.Range && lock.Owner == owner && lock.Token == token {
+			return unlock, nil
+		}
+	}
+	unlock()
+	return nil, fmt.Errorf("%s no longer holds the lock with token %d: %w", owner, token, ErrStaleFence)
+}
 
-	fs, err := c.findFirstLockableFS()
+// Unlock removes a lock using the chain's lock service
+func (c *ChainFS) Unlock(path string, owner LockOwner) error {
+	locks, err := c.findLockService()
 	if err != nil {
 		return err
 	}
 
-	return fs.Lock(path, lockType, processID)
+	if err := locks.Unlock(path, owner); err != nil {
+		return err
+	}
+	// Closing a file ends its writes
+	c.hashWrites(path)
+	return nil
 }
 
-// Unlock removes a lock using the first filesystem that supports locking
-func (c *ChainFS) Unlock(path string, processID int) error {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
+// Renew extends a lock lease using the chain's lock service
+func (c *ChainFS) Renew(path string, owner LockOwner) error {
+	locks, err := c.findLockService()
+	if err != nil {
+		return err
+	}
+
+	return locks.Renew(path, owner)
+}
 
-	fs, err := c.findFirstLockableFS()
+// LockRange takes a byte-range lock using the chain's lock service
+func (c *ChainFS) LockRange(ctx context.Context, path string, lock RangeLock, opts LockOptions) error {
+	unlock := c.paths.RLock(path)
+	locks, err := c.findLockService()
+	if err == nil {
+		_, err = c.firstHolder(path)
+	}
+	unlock()
 	if err != nil {
 		return err
 	}
 
-	return fs.Unlock(path, processID)
+	// The path is not locked while waiting, or the holder's unlock could never get through
+	return locks.LockRange(ctx, path, lock, opts)
 }
 
-// IsLocked checks if a file is locked using the first filesystem that supports locking
-func (c *ChainFS) IsLocked(path string) (bool, LockType, error) {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
+// UnlockRange releases byte-range locks using the chain's lock service
+func (c *ChainFS) UnlockRange(path string, lock RangeLock) error {
+	locks, err := c.findLockService()
+	if err != nil {
+		return err
+	}
+
+	return locks.UnlockRange(path, lock)
+}
+
+// QueryRange looks for a conflicting byte-range lock using the chain's lock service
+func (c *ChainFS) QueryRange(path string, lock RangeLock) (RangeLock, bool, error) {
+	locks, err := c.findLockService()
+	if err != nil {
+		return RangeLock{}, false, err
+	}
+
+	return locks.QueryRange(path, lock)
+}
+
+// ListLocks lists lock holders using the chain's lock service
+func (c *ChainFS) ListLocks(prefix string) ([]LockInfo, error) {
+	locks, err := c.findLockService()
+	if err != nil {
+		return nil, err
+	}
+
+	return locks.ListLocks(prefix)
+}
+
+// ForceUnlock breaks the locks on a file using the chain's lock service
+func (c *ChainFS) ForceUnlock(path string) error {
+	locks, err := c.findLockService()
+	if err != nil {
+		return err
+	}
+
+	return locks.ForceUnlock(path)
+}
+
+// LockDebug reports lock contention using the chain's lock service
+func (c *ChainFS) LockDebug() (LockDebugInfo, error) {
+	locks, err := c.findLockService()
+	if err != nil {
+		return LockDebugInfo{}, err
+	}
+
+	return locks.LockDebug()
+}
 
-	fs, err := c.findFirstLockableFS()
+// IsLocked checks if a file is locked using the chain's lock service
+func (c *ChainFS) IsLocked(path string) (LockStatus, error) {
+	locks, err := c.findLockService()
 	if err != nil {
-		return false, 0, err
+		return LockStatus{}, err
 	}
 
-	return fs.IsLocked(path)
+	return locks.IsLocked(path)
 }
 
 // Info implements the chain of responsibility for getting file info
 func (c *ChainFS) Info(path string) (FileInfo, error) {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
+	unlock := c.paths.RLock(path)
+	defer unlock()
 
 	var lastErr error
-	for _, fs := range c.filesystems {
-		info, err := fs.Info(path)
+	for i := range c.filesystems {
+		info, err := c.layerInfo(i, path)
 		if err == nil {
+			if !info.IsDir && !c.fresh(path, i) {
+				// The source has changed, report it rather than the stale copy
+				continue
+			}
 			return info, nil
 		}
 		lastErr = err
@@ -84,34 +221,93 @@ func (c *ChainFS) Info(path string) (FileInfo, error) {
 	return FileInfo{}, lastErr
 }
 
-// List implements the chain of responsibility for listing files
+// List merges the listings of path in every layer, like a union mount. An
+// entry in an earlier layer overrides one of the same name in a later layer,
+// and whiteouts hide the entries of later layers.
 func (c *ChainFS) List(path string) ([]FileInfo, error) {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
+	unlock := c.paths.RLock(path)
+	defer unlock()
+
+	return c.list(path)
+}
 
+// list is List for callers that already lock path
+func (c *ChainFS) list(path string) ([]FileInfo, error) {
+	if isWhiteout(path) {
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+	}
+
+	var merged []FileInfo
+	seen := make(map[string]bool)
+	found := false
 	var lastErr error
-	for _, fs := range c.filesystems {
+	for i, fs := range c.filesystems {
 		files, err := fs.List(path)
-		if err == nil {
-			return files, nil
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if c.hidden(path, i) {
+			// The directory is whited out here and in every later layer
+			break
+		}
+		found = true
+
+		var whiteouts []string
+		for _, file := range files {
+			if isPromotionCopy(file.Name) {
+				continue
+			}
+			if strings.HasPrefix(file.Name, whiteoutPrefix) {
+				whiteouts = append(whiteouts, strings.TrimPrefix(file.Name, whiteoutPrefix))
+				continue
+			}
+			if !seen[file.Name] {
+				seen[file.Name] = true
+				merged = append(merged, file)
+			}
+		}
+		for _, name := range whiteouts {
+			seen[name] = true
 		}
-		lastErr = err
 	}
-	return nil, lastErr
+	if !found {
+		return nil, lastErr
+	}
+
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Name < merged[j].Name
+	})
+	return merged, nil
 }
 
 // Read implements the chain of responsibility for reading files
 func (c *ChainFS) Read(path string) ([]byte, error) {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
+	content, layer, err := c.read(path)
+	if err == nil {
+		// File found, propagate it back through the chain
+		c.promote(path, content, layer)
+	}
+	return content, err
+}
+
+// read reads path from the first layer that has a fresh copy of it and
+// returns the content along with that layer
+func (c *ChainFS) read(path string) ([]byte, int, error) {
+	unlock := c.paths.RLock(path)
+	defer unlock()
 
 	// Check if file is locked
-	if locked, lockType, err := c.IsLocked(path); err == nil && locked {
-		if lockType == WriteLock || lockType == ExclusiveLock {
-			return nil, fmt.Errorf("file is locked for writing")
+	if status, err := c.IsLocked(path); err == nil && status.Locked {
+		if status.LockType == WriteLock || status.LockType == ExclusiveLock {
+			return nil, 0, fmt.Errorf("file is locked for writing")
 		}
 	}
 
+	if isWhiteout(path) {
+		return nil, 0, &os.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+	}
+
 	var lastErr error
 	var content []byte
 
@@ -119,100 +315,888 @@ func (c *ChainFS) Read(path string) ([]byte, error) {
 	for i, fs := range c.filesystems {
 		content, lastErr = fs.Read(path)
 		if lastErr == nil {
-			// File found, propagate it back through the chain
-			c.propagateContent(path, content, i)
-			return content, nil
+			if c.hidden(path, i) {
+				return nil, 0, &os.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+			}
+			if !c.fresh(path, i) {
+				// Drop the stale copy and fetch the file again from further down the chain
+				c.dropStale(path, i)
+				lastErr = &os.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+				continue
+			}
+			return content, i, nil
 		}
 	}
 
-	return nil, lastErr
+	return nil, 0, lastErr
+}
+
+// ReadAt reads a byte range from the first filesystem in the chain that has the file
+func (c *ChainFS) ReadAt(path string, buf []byte, offset int64, owner LockOwner) (int, error) {
+	n, layer, err := c.readAt(path, buf, offset, owner)
+	if (err == nil || err == io.EOF) && offset == 0 && layer > 0 {
+		// Populate the earlier filesystems on the first read of a file so
+		// later ranges are served from the cache. The read only waits for
+		// its own range, the rest of the file is copied in the background.
+		c.promoteInBackground(path, layer)
+	}
+	return n, err
+}
+
+// readAt reads a byte range from the first layer that has path and returns
+// the number of bytes read along with that layer
+func (c *ChainFS) readAt(path string, buf []byte, offset int64, owner LockOwner) (int, int, error) {
+	unlock := c.paths.RLock(path)
+	defer unlock()
+
+	// Check if file is locked by someone else
+	if status, err := c.IsLocked(path); err == nil && status.Locked {
+		if _, holds := c.holdsLock(path, owner, status); !holds && (status.LockType == WriteLock || status.LockType == ExclusiveLock) {
+			return 0, 0, fmt.Errorf("file is locked for writing")
+		}
+	}
+
+	if isWhiteout(path) {
+		return 0, 0, &os.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+	}
+
+	var lastErr error
+	for i, fs := range c.filesystems {
+		n, err := fs.ReadAt(path, buf, offset, owner)
+		if err == nil || err == io.EOF {
+			if c.hidden(path, i) {
+				return 0, 0, &os.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+			}
+			// Copies are checked when a read starts at the beginning of the file
+			if offset == 0 && !c.fresh(path, i) {
+				c.dropStale(path, i)
+				lastErr = &os.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+				continue
+			}
+			return n, i, err
+		}
+		lastErr = err
+	}
+
+	return 0, 0, lastErr
+}
+
+// promote writes the content of path, which a read found in foundIndex, into
+// the writable layers before it. It runs once the read let go of the path and
+// takes the path exclusively, so no other read sees a copy that is only half
+// written.
+func (c *ChainFS) promote(path string, content []byte, foundIndex int) {
+	if foundIndex == 0 {
+		return
+	}
+
+	unlock := c.paths.Lock(path)
+	defer unlock()
+
+	// The path may have changed while it was not locked; a write puts the
+	// file into the earlier layers itself
+	for _, fs := range c.filesystems[:foundIndex] {
+		if _, err := fs.Info(path); err == nil {
+			return
+		}
+	}
+	c.propagateContent(path, content, foundIndex)
 }
 
-// propagateContent writes the content to all filesystems before the found index
+// propagateContent writes the content of path, as read from the layer it was
+// found in, to the writable filesystems before it, as the promotion policy
+// allows and as promoteOwner. The caller must hold the path exclusively.
 func (c *ChainFS) propagateContent(path string, content []byte, foundIndex int) {
+	writable := false
+	for _, fs := range c.filesystems[:foundIndex] {
+		writable = writable || fs.GetFeatures().CanUpdate
+	}
+	if !writable {
+		return
+	}
+
+	// Only regular files are copied; links and special files stay where they are
+	source := c.filesystems[foundIndex]
+	info, err := source.Info(path)
+	if err != nil || !info.Mode.IsRegular() || !c.promotion.decide(path, info.Size) {
+		return
+	}
+
 	for i := foundIndex - 1; i >= 0; i-- {
 		fs := c.filesystems[i]
-		if fs.GetFeatures().CanUpdate {
-			// Attempt to cache the content, ignore errors
-			_ = fs.Write(path, content, 0644)
+		if !fs.GetFeatures().CanUpdate {
+			continue
+		}
+
+		// The copy keeps the mode and mtime of the original
+		err := fs.Write(path, content, info.Mode.Perm(), promoteOwner)
+		if err == nil {
+			err = fs.SetAttr(path, AttrUpdate{Mtime: &info.ModTime})
 		}
+		c.promotion.promoted(path, info.Size, i, err)
+		if err != nil {
+			// Leave no partial copy behind to be served
+			_ = fs.Delete(path)
+			continue
+		}
+		c.copyXattrs(path, source, fs)
+		c.recordVersion(path, i)
 	}
 }
 
-// Write implements the chain of responsibility for writing files
-func (c *ChainFS) Write(path string, content []byte, mode os.FileMode) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+// promoteInBackground copies path from the layer a ranged read found it in
+// to the writable layers before it, as the promotion policy allows and as
+// promoteOwner. The copy is made under a hidden name without locking path,
+// so reads and writes of the file go on meanwhile, and only moved into place
+// with path locked. It is thrown away when the file changed while it was
+// copied.
+func (c *ChainFS) promoteInBackground(path string, foundIndex int) {
+	key := lockPath(path)
+	if _, running := c.promoting.LoadOrStore(key, true); running {
+		return
+	}
 
-	// Check if file is locked
-	if locked, lockType, err := c.IsLocked(path); err == nil && locked {
-		// Allow write if the process has a write or exclusive lock
-		if os.Getpid() == c.getProcessIDForLock(path) && (lockType == WriteLock || lockType == ExclusiveLock) {
-			// Process has appropriate lock, allow write
-		} else if lockType == ReadLock {
-			return fmt.Errorf("file is locked for reading")
-		} else {
-			return fmt.Errorf("file is locked by another process")
+	c.background.Add(1)
+	go func() {
+		defer c.background.Done()
+		defer c.promoting.Delete(key)
+
+		writable := false
+		for _, fs := range c.filesystems[:foundIndex] {
+			if _, err := fs.Info(path); err == nil {
+				// Written to or promoted since the read
+				return
+			}
+			writable = writable || fs.GetFeatures().CanUpdate
+		}
+		if !writable {
+			return
+		}
+
+		// Only regular files are copied; links and special files stay where they are
+		source := c.filesystems[foundIndex]
+		info, err := source.Info(path)
+		if err != nil || !info.Mode.IsRegular() || !c.promotion.decide(path, info.Size) {
+			return
+		}
+
+		for i := foundIndex - 1; i >= 0; i-- {
+			fs := c.filesystems[i]
+			if !fs.GetFeatures().CanUpdate {
+				continue
+			}
+
+			// The copy keeps the mode and mtime of the original
+			copyPath := promotionCopyPath(path, c.copySeq.Add(1))
+			err := copyContentTo(path, source, fs, copyPath, info.Size, info.Mode.Perm(), promoteOwner)
+			if err == nil {
+				err = fs.SetAttr(copyPath, AttrUpdate{Mtime: &info.ModTime})
+			}
+			installed := false
+			if err == nil {
+				installed, err = c.installCopy(path, copyPath, foundIndex, i, info)
+			}
+			if err == nil && !installed {
+				_ = fs.Delete(copyPath)
+				return
+			}
+			c.promotion.promoted(path, info.Size, i, err)
+			if err != nil {
+				_ = fs.Delete(copyPath)
+			}
+		}
+	}()
+}
+
+// installCopy moves a promotion's copy of path into place in layer, unless
+// path changed in the source layer since info was taken or layer got a copy
+// of its own meanwhile. It reports whether the copy was moved.
+func (c *ChainFS) installCopy(path, copyPath string, source, layer int, info FileInfo) (bool, error) {
+	unlock := c.paths.Lock(path)
+	defer unlock()
+
+	current, err := c.layerInfo(source, path)
+	if err != nil || current.Size != info.Size || !current.ModTime.Equal(info.ModTime) {
+		return false, nil
+	}
+	fs := c.filesystems[layer]
+	if _, err := fs.Info(path); err == nil {
+		return false, nil
+	}
+
+	if err := fs.Rename(copyPath, path); err != nil {
+		return false, err
+	}
+	c.copyXattrs(path, c.filesystems[source], fs)
+	c.recordVersion(path, layer)
+	return true, nil
+}
+
+// copyChunkSize bounds how much of a file copyContent holds in memory
+const copyChunkSize = 1 << 20
+
+// copyContent copies the size bytes of path from src to dst, creating or
+// truncating it there with mode, one chunk at a time. A file that turns out
+// shorter than size is an error, as the copy would be incomplete.
+func copyContent(path string, src, dst ServerFS, size int64, mode os.FileMode, owner LockOwner) error {
+	return copyContentTo(path, src, dst, path, size, mode, owner)
+}
+
+// copyContentTo is copyContent for a copy named dstPath in dst
+func copyContentTo(path string, src, dst ServerFS, dstPath string, size int64, mode os.FileMode, owner LockOwner) error {
+	if err := dst.Write(dstPath, nil, mode, owner); err != nil {
+		return err
+	}
+
+	buf := make([]byte, min(size, copyChunkSize))
+	for offset := int64(0); offset < size; {
+		n, err := src.ReadAt(path, buf[:min(size-offset, int64(len(buf)))], offset, owner)
+		if n > 0 {
+			if _, err := dst.WriteAt(dstPath, buf[:n], offset, owner); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+		if (err == io.EOF || n == 0) && offset < size {
+			return fmt.Errorf("%s is shorter than %d bytes: %w", path, size, io.ErrUnexpectedEOF)
 		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyXattrs copies the extended attributes of path from src to dst, ignoring errors
+func (c *ChainFS) copyXattrs(path string, src, dst ServerFS) {
+	names, err := src.ListXattr(path)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if value, err := src.GetXattr(path, name); err == nil {
+			_ = dst.SetXattr(path, name, value, 0)
+		}
+	}
+}
+
+// Write implements the chain of responsibility for writing files
+func (c *ChainFS) Write(path string, content []byte, mode os.FileMode, owner LockOwner) error {
+	unlock := c.paths.Lock(path)
+	defer unlock()
+
+	if err := checkName("open", path); err != nil {
+		return err
+	}
+	if err := c.checkWriteLock(path, owner); err != nil {
+		return err
+	}
+
+	if c.writeback != nil {
+		return c.writeBack(path, func(fs ServerFS) error {
+			return fs.Write(path, content, mode, owner)
+		})
 	}
 
 	// Write to all filesystems that support updates
 	var lastErr error
 	for _, fs := range c.filesystems {
 		if fs.GetFeatures().CanUpdate {
-			if err := fs.Write(path, content, mode); err != nil {
+			if err := fs.Write(path, content, mode, owner); err != nil {
 				lastErr = err
 			}
 		}
 	}
+	if lastErr == nil {
+		c.recordVersions(path)
+	}
 	return lastErr
 }
 
-// getProcessIDForLock helper function to get the process ID of the lock owner
-func (c *ChainFS) getProcessIDForLock(path string) int {
-	fs, err := c.findFirstLockableFS()
+// WriteAt writes a byte range to every filesystem that supports updates and
+// already holds the file. If none of them has it yet, it is created in all of them.
+func (c *ChainFS) WriteAt(path string, data []byte, offset int64, owner LockOwner) (int, error) {
+	unlock := c.paths.Lock(path)
+	defer unlock()
+
+	if err := checkName("open", path); err != nil {
+		return 0, err
+	}
+	if err := c.checkWriteLock(path, owner); err != nil {
+		return 0, err
+	}
+	c.dropStaleCopies(path)
+
+	if c.writeback != nil {
+		if err := c.copyUp(path, owner); err != nil {
+			return 0, err
+		}
+		var n int
+		err := c.writeBack(path, func(fs ServerFS) (err error) {
+			n, err = fs.WriteAt(path, data, offset, owner)
+			return err
+		})
+		return n, err
+	}
+
+	var targets []ServerFS
+	for i, fs := range c.filesystems {
+		if fs.GetFeatures().CanUpdate {
+			if _, err := c.layerInfo(i, path); err == nil {
+				targets = append(targets, fs)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		for _, fs := range c.filesystems {
+			if fs.GetFeatures().CanUpdate {
+				targets = append(targets, fs)
+			}
+		}
+	}
+
+	var written int
+	var lastErr error
+	for _, fs := range targets {
+		n, err := fs.WriteAt(path, data, offset, owner)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		written = n
+	}
+	if lastErr == nil {
+		c.recordWrite(path)
+	}
+	return written, lastErr
+}
+
+// Truncate resizes the file in every filesystem that supports updates and holds it
+func (c *ChainFS) Truncate(path string, size int64, owner LockOwner) error {
+	unlock := c.paths.Lock(path)
+	defer unlock()
+
+	if err := c.checkWriteLock(path, owner); err != nil {
+		return err
+	}
+	c.dropStaleCopies(path)
+
+	if c.writeback != nil {
+		if err := c.copyUp(path, owner); err != nil {
+			return err
+		}
+		return c.writeBack(path, func(fs ServerFS) error {
+			return fs.Truncate(path, size, owner)
+		})
+	}
+
+	err := c.forEachWritableHolder(path, func(fs ServerFS) error {
+		return fs.Truncate(path, size, owner)
+	})
+	if err == nil {
+		c.recordVersions(path)
+	}
+	return err
+}
+
+// SetAttr applies the metadata change in every filesystem that supports updates and holds the file
+func (c *ChainFS) SetAttr(path string, update AttrUpdate) error {
+	unlock := c.paths.Lock(path)
+	defer unlock()
+
+	c.dropStaleCopies(path)
+	if err := c.flushPending(path); err != nil {
+		return err
+	}
+
+	err := c.forEachWritableHolder(path, func(fs ServerFS) error {
+		return fs.SetAttr(path, update)
+	})
+	if err == nil {
+		c.recordVersions(path)
+	}
+	return err
+}
+
+// checkWriteLock verifies that an existing lock on path allows owner to write
+func (c *ChainFS) checkWriteLock(path string, owner LockOwner) error {
+	if status, err := c.IsLocked(path); err == nil && status.Locked {
+		// Allow write if the owner has a write or exclusive lock
+		if lockType, holds := c.holdsLock(path, owner, status); holds && (lockType == WriteLock || lockType == ExclusiveLock) {
+			// Owner has appropriate lock, allow write
+		} else if status.LockType == ReadLock {
+			return fmt.Errorf("file is locked for reading")
+		} else {
+			return fmt.Errorf("file is locked by another owner")
+		}
+	}
+	return nil
+}
+
+// holdsLock reports whether owner holds the lock status describes: its own
+// lock on path, or a directory lock its process holds above path
+func (c *ChainFS) holdsLock(path string, owner LockOwner, status LockStatus) (LockType, bool) {
+	locks, err := c.findLockService()
 	if err != nil {
-		return -1
+		return 0, false
 	}
 
-	// Since we can't directly get the process ID from the interface,
-	// we'll need to check if the filesystem implements a way to get it
-	if localFS, ok := fs.(*LocalFS); ok {
-		localFS.lockMutex.RLock()
-		defer localFS.lockMutex.RUnlock()
-		if lock, exists := localFS.locks[path]; exists {
-			return lock.ProcessID
+	path = lockPath(path)
+	lockedPath := path
+	if status.Path != "" {
+		lockedPath = status.Path
+	}
+
+	holders, err := locks.ListLocks(lockedPath)
+	if err != nil {
+		return 0, false
+	}
+	for _, lock := range holders {
+		if lock.Path != lockedPath || lock.Range {
+			continue
+		}
+		if lock.Owner == owner || (lockedPath != path && lock.Recursive && lock.Owner.sameProcess(owner)) {
+			return lock.LockType, true
 		}
 	}
-	return -1
+	return 0, false
 }
 
 // Delete implements the chain of responsibility for deleting files
 func (c *ChainFS) Delete(path string) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	unlock := c.paths.Lock(path)
+	defer unlock()
 
 	// Check if file is locked
-	if locked, _, err := c.IsLocked(path); err == nil && locked {
-		return fmt.Errorf("file is locked")
+	if status, err := c.IsLocked(path); err == nil && status.Locked {
+		return ErrFileLocked
+	}
+
+	if c.writeback != nil {
+		c.writeback.waitCopy(path)
 	}
 
+	found := false
+	var lastErr error
+	for i, fs := range c.filesystems {
+		if _, err := c.layerInfo(i, path); err != nil {
+			continue
+		}
+		found = true
+		if !fs.GetFeatures().CanDelete {
+			continue
+		}
+		if err := fs.Delete(path); err != nil {
+			lastErr = err
+		}
+	}
+	if !found {
+		return os.ErrNotExist
+	}
+	c.versions.forget(path)
+	if c.writeback != nil && lastErr == nil {
+		c.writeback.forget(path)
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+	return c.hideRemains("unlink", path)
+}
+
+// Mkdir creates the directory in every filesystem that supports updates
+func (c *ChainFS) Mkdir(path string, mode os.FileMode) error {
+	unlock := c.paths.Lock(path)
+	defer unlock()
+
+	if err := checkName("mkdir", path); err != nil {
+		return err
+	}
+	for i := range c.filesystems {
+		if _, err := c.layerInfo(i, path); err == nil {
+			return &os.PathError{Op: "mkdir", Path: path, Err: syscall.EEXIST}
+		}
+	}
+
+	created := false
 	var lastErr error
 	for _, fs := range c.filesystems {
+		if !fs.GetFeatures().CanUpdate {
+			continue
+		}
+		if err := fs.Mkdir(path, mode); err != nil {
+			lastErr = err
+			continue
+		}
+		created = true
+	}
+	if !created {
+		if lastErr == nil {
+			lastErr = errors.New("no filesystem in the chain supports updates")
+		}
+		return lastErr
+	}
+	return nil
+}
+
+// Rmdir removes the directory from every filesystem that supports deletion.
+// Nothing is removed unless the merged listing of the directory is empty.
+func (c *ChainFS) Rmdir(path string) error {
+	unlock := c.paths.LockTree()
+	defer unlock()
+
+	var holders []ServerFS
+	for i, fs := range c.filesystems {
+		info, err := c.layerInfo(i, path)
+		if err != nil {
+			continue
+		}
+		if !info.IsDir {
+			return &os.PathError{Op: "rmdir", Path: path, Err: syscall.ENOTDIR}
+		}
+		holders = append(holders, fs)
+	}
+	if len(holders) == 0 {
+		return os.ErrNotExist
+	}
+
+	entries, err := c.list(path)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return &os.PathError{Op: "rmdir", Path: path, Err: syscall.ENOTEMPTY}
+	}
+
+	var lastErr error
+	for _, fs := range holders {
 		if fs.GetFeatures().CanDelete {
-			if err := fs.Delete(path); err != nil {
+			removeWhiteouts(fs, path)
+			if err := fs.Rmdir(path); err != nil {
 				lastErr = err
 			}
 		}
 	}
+	c.versions.forget(path)
+	if lastErr != nil {
+		return lastErr
+	}
+	return c.hideRemains("rmdir", path)
+}
+
+// Rename moves oldPath to newPath in every filesystem that holds it. The
+// authoritative layer is renamed first: the deepest one holding oldPath, or
+// the cache for a file not yet written back. Only once it succeeded are the
+// other layers brought in line, so a failure leaves the chain untouched.
+func (c *ChainFS) Rename(oldPath, newPath string) error {
+	unlock := c.paths.LockTree()
+	defer unlock()
+
+	if err := checkName("rename", newPath); err != nil {
+		return err
+	}
+	// Neither the file nor the one it replaces may move out from under a
+	// lock, including a lock on a directory above them
+	for _, path := range []string{oldPath, newPath} {
+		if status, err := c.IsLocked(path); err == nil && status.Locked {
+			return ErrFileLocked
+		}
+	}
+
+	authority := -1
+	var source FileInfo
+	for i, fs := range c.filesystems {
+		info, err := c.layerInfo(i, oldPath)
+		if err != nil {
+			continue
+		}
+		if !fs.GetFeatures().CanUpdate {
+			return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: syscall.EROFS}
+		}
+		if authority < 0 {
+			source = info
+		}
+		authority = i
+	}
+	if authority < 0 {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: syscall.ENOENT}
+	}
+	if c.writeback != nil && c.writeback.isDirty(oldPath) {
+		// The later layers only hold an older copy of the file
+		authority = 0
+	}
+	if err := c.checkRenameTarget(oldPath, newPath, source); err != nil {
+		return err
+	}
+	if c.writeback != nil {
+		c.writeback.waitCopy(oldPath)
+		c.writeback.waitCopy(newPath)
+	}
+
+	if err := c.filesystems[authority].Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	for i, fs := range c.filesystems {
+		if i == authority || !fs.GetFeatures().CanUpdate {
+			continue
+		}
+
+		if _, err := c.layerInfo(i, oldPath); err != nil {
+			// This layer never had the source, drop its stale copy of the target
+			if info, err := fs.Info(newPath); err == nil && fs.GetFeatures().CanDelete {
+				if info.IsDir {
+					_ = fs.Rmdir(newPath)
+				} else {
+					_ = fs.Delete(newPath)
+				}
+			}
+			continue
+		}
+
+		if err := fs.Rename(oldPath, newPath); err != nil {
+			// A copy that cannot follow the rename must not keep serving the old name
+			if fs.GetFeatures().CanDelete {
+				_ = fs.Delete(oldPath)
+			}
+		}
+	}
+
+	c.versions.forget(oldPath)
+	c.versions.forget(newPath)
+	c.clearWhiteouts(newPath)
+	if c.writeback != nil {
+		return c.writeback.rename(oldPath, newPath)
+	}
+	return nil
+}
+
+// checkRenameTarget refuses to rename source over a newPath of the chain
+// that rename(2) could not replace: a directory with a file, a file with a
+// directory, or a directory that is not empty. Checking the merged view up
+// front keeps layers that hold only one of the two from disagreeing.
+func (c *ChainFS) checkRenameTarget(oldPath, newPath string, source FileInfo) error {
+	if lockPath(oldPath) == lockPath(newPath) {
+		return nil
+	}
+	for i := range c.filesystems {
+		target, err := c.layerInfo(i, newPath)
+		if err != nil {
+			continue
+		}
+
+		var errno syscall.Errno
+		switch {
+		case target.IsDir && !source.IsDir:
+			errno = syscall.EISDIR
+		case !target.IsDir && source.IsDir:
+			errno = syscall.ENOTDIR
+		case target.IsDir:
+			entries, err := c.list(newPath)
+			if err != nil {
+				return err
+			}
+			if len(entries) > 0 {
+				errno = syscall.ENOTEMPTY
+			}
+		}
+		if errno != 0 {
+			return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: errno}
+		}
+		return nil
+	}
+	return nil
+}
+
+// Symlink creates the link in every filesystem that supports updates
+func (c *ChainFS) Symlink(target, path string) error {
+	unlock := c.paths.Lock(path)
+	defer unlock()
+
+	if err := checkName("symlink", path); err != nil {
+		return err
+	}
+	for i := range c.filesystems {
+		if _, err := c.layerInfo(i, path); err == nil {
+			return &os.LinkError{Op: "symlink", Old: target, New: path, Err: syscall.EEXIST}
+		}
+	}
+
+	created := false
+	var lastErr error
+	for _, fs := range c.filesystems {
+		if !fs.GetFeatures().CanUpdate {
+			continue
+		}
+		if err := fs.Symlink(target, path); err != nil {
+			lastErr = err
+			continue
+		}
+		created = true
+	}
+	if !created {
+		if lastErr == nil {
+			lastErr = errors.New("no filesystem in the chain supports updates")
+		}
+		return lastErr
+	}
+	return nil
+}
+
+// Readlink implements the chain of responsibility for reading link targets
+func (c *ChainFS) Readlink(path string) (string, error) {
+	unlock := c.paths.RLock(path)
+	defer unlock()
+
+	var lastErr error
+	for i, fs := range c.filesystems {
+		target, err := fs.Readlink(path)
+		if err == nil {
+			if c.hidden(path, i) {
+				return "", &os.PathError{Op: "readlink", Path: path, Err: syscall.ENOENT}
+			}
+			return target, nil
+		}
+		lastErr = err
+	}
+	return "", lastErr
+}
+
+// Link creates the hard link in every filesystem that supports updates and holds oldPath
+func (c *ChainFS) Link(oldPath, newPath string) error {
+	unlock := c.paths.Lock(oldPath, newPath)
+	defer unlock()
+
+	if err := checkName("link", newPath); err != nil {
+		return err
+	}
+	if err := c.flushPending(oldPath); err != nil {
+		return err
+	}
+
+	var holders []ServerFS
+	for i, fs := range c.filesystems {
+		if _, err := c.layerInfo(i, newPath); err == nil {
+			return &os.LinkError{Op: "link", Old: oldPath, New: newPath, Err: syscall.EEXIST}
+		}
+		if _, err := c.layerInfo(i, oldPath); err != nil {
+			continue
+		}
+		if !fs.GetFeatures().CanUpdate {
+			return &os.LinkError{Op: "link", Old: oldPath, New: newPath, Err: syscall.EROFS}
+		}
+		holders = append(holders, fs)
+	}
+
+	linked := false
+	var lastErr error
+	for _, fs := range holders {
+		if err := fs.Link(oldPath, newPath); err != nil {
+			lastErr = err
+			continue
+		}
+		linked = true
+	}
+	if linked {
+		c.clearWhiteouts(newPath)
+	}
+	if !linked {
+		if lastErr == nil {
+			lastErr = &os.LinkError{Op: "link", Old: oldPath, New: newPath, Err: syscall.ENOENT}
+		}
+		return lastErr
+	}
+	return lastErr
+}
+
+// firstHolder returns the first filesystem in the chain that has path
+func (c *ChainFS) firstHolder(path string) (ServerFS, error) {
+	var lastErr error
+	for i, fs := range c.filesystems {
+		_, err := c.layerInfo(i, path)
+		if err == nil {
+			return fs, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// GetXattr reads the attribute from the first filesystem that has the file
+func (c *ChainFS) GetXattr(path, name string) ([]byte, error) {
+	unlock := c.paths.RLock(path)
+	defer unlock()
+
+	fs, err := c.firstHolder(path)
+	if err != nil {
+		return nil, err
+	}
+	return fs.GetXattr(path, name)
+}
+
+// ListXattr lists the attributes of the first filesystem that has the file
+func (c *ChainFS) ListXattr(path string) ([]string, error) {
+	unlock := c.paths.RLock(path)
+	defer unlock()
+
+	fs, err := c.firstHolder(path)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ListXattr(path)
+}
+
+// SetXattr sets the attribute in every filesystem that supports updates and has the file
+func (c *ChainFS) SetXattr(path, name string, value []byte, flags int) error {
+	unlock := c.paths.Lock(path)
+	defer unlock()
+
+	if err := c.flushPending(path); err != nil {
+		return err
+	}
+
+	return c.forEachWritableHolder(path, func(fs ServerFS) error {
+		return fs.SetXattr(path, name, value, flags)
+	})
+}
+
+// RemoveXattr removes the attribute from every filesystem that supports updates and has the file
+func (c *ChainFS) RemoveXattr(path, name string) error {
+	unlock := c.paths.Lock(path)
+	defer unlock()
+
+	if err := c.flushPending(path); err != nil {
+		return err
+	}
+
+	return c.forEachWritableHolder(path, func(fs ServerFS) error {
+		return fs.RemoveXattr(path, name)
+	})
+}
+
+// forEachWritableHolder applies op to every filesystem that supports updates
+// and has path, returning ENOENT if none of them has it
+func (c *ChainFS) forEachWritableHolder(path string, op func(fs ServerFS) error) error {
+	found := false
+	var lastErr error
+	for i, fs := range c.filesystems {
+		if !fs.GetFeatures().CanUpdate {
+			continue
+		}
+		if _, err := c.layerInfo(i, path); err != nil {
+			continue
+		}
+		found = true
+		if err := op(fs); err != nil {
+			lastErr = err
+		}
+	}
+	if !found {
+		return os.ErrNotExist
+	}
 	return lastErr
 }
 
 // GetFeatures returns combined features of all filesystems
 func (c *ChainFS) GetFeatures() FileSystemFeatures {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-
 	features := FileSystemFeatures{}
 	for _, fs := range c.filesystems {
 		fsFeatures := fs.GetFeatures()
@@ -223,6 +1207,28 @@ func (c *ChainFS) GetFeatures() FileSystemFeatures {
 	return features
 }
 
+// Invalidate drops the copies the caches of the chain hold of path and of
+// the files below it, so that they are fetched again on their next read
+func (c *ChainFS) Invalidate(path string) error {
+	unlock := c.paths.LockTree()
+	defer unlock()
+
+	var lastErr error
+	for _, fs := range c.filesystems[:len(c.filesystems)-1] {
+		if err := fs.Invalidate(path); err != nil {
+			lastErr = err
+		}
+	}
+	c.versions.forget(path)
+	return lastErr
+}
+
+// GetCoherency reports that the chain itself trusts its copies; its caches
+// have their own policies
+func (c *ChainFS) GetCoherency() CoherencyPolicy {
+	return CoherencyPolicy{Mode: CoherencyNotify}
+}
+
 // GetRole always returns "chain" as this is a chain of filesystems
 func (c *ChainFS) GetRole() FileSystemRole {
 	return "chain"
@@ -230,9 +1236,6 @@ func (c *ChainFS) GetRole() FileSystemRole {
 
 // GetUsage returns the total usage across all filesystems
 func (c *ChainFS) GetUsage() (int64, error) {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-
 	var total int64
 	for _, fs := range c.filesystems {
 		usage, err := fs.GetUsage()
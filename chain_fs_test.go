@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestChain returns a write-through chain of a cache in front of a main
+// store, each in its own temporary directory, along with the cache
+func newTestChain(t *testing.T) (*ChainFS, *LocalFS) {
+	t.Helper()
+
+	cache, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleCache,
+		MaxSize:  1 << 30,
+		Features: FileSystemFeatures{CanUpdate: true, CanDelete: true},
+		RootPath: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	main, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleMain,
+		Features: FileSystemFeatures{CanUpdate: true, CanDelete: true},
+		RootPath: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChainFS([]ServerFS{cache, main}, nil)
+	t.Cleanup(chain.background.Wait)
+	return chain, cache
+}
+
+// TestConcurrentOperationsOnOverlappingPaths is meant for go test -race; on a
+// single core -cpu 4 makes the operations interleave within each other
+func TestConcurrentOperationsOnOverlappingPaths(t *testing.T) {
+	const size = 64 << 10
+	const duration = time.Second
+
+	chain, cache := newTestChain(t)
+	// Renames and deletes shuffle the first paths around; the last one stays
+	// put, so it is there to be read and promoted most of the time
+	paths := []string{"/d/a", "/d/b", "/d/c", "/d/hot"}
+	moving := paths[:3]
+
+	// Every write replaces a whole file with one repeated byte, so a read
+	// that sees anything else saw a file half written
+	check := func(op, path string, content []byte) {
+		if len(content) != size {
+			t.Errorf("%s(%s) returned %d bytes, want %d", op, path, len(content), size)
+			return
+		}
+		if content[0] == 0 || !bytes.Equal(content, bytes.Repeat(content[:1], size)) {
+			t.Errorf("%s(%s) returned a file that is not one write", op, path)
+		}
+	}
+
+	// Every operation runs over and over until the time is up
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	run := func(op func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				op(i)
+			}
+		}()
+	}
+
+	for w := 0; w < 2; w++ {
+		w := w
+		run(func(i int) {
+			path := paths[(i+w)%len(paths)]
+			data := bytes.Repeat([]byte{byte('a' + (i+w)%26)}, size)
+			chain.WriteAt(path, data, 0, LockOwner{})
+		})
+	}
+	for r := 0; r < 4; r++ {
+		r := r
+		run(func(i int) {
+			path := paths[(i+r)%len(paths)]
+			if content, err := chain.Read(path); err == nil {
+				check("Read", path, content)
+			}
+		})
+		run(func(i int) {
+			path := paths[(i+r)%len(paths)]
+			buf := make([]byte, size+1)
+			if n, err := chain.ReadAt(path, buf, 0, LockOwner{}); err == nil || err == io.EOF {
+				check("ReadAt", path, buf[:n])
+			}
+		})
+	}
+	run(func(i int) {
+		// Evicting the cached copy makes the next read promote the file again
+		runtime.Gosched()
+		cache.Delete(paths[i%len(paths)])
+	})
+	// Renames and directory removals hold up every other operation, and
+	// files that are deleted all the time are rarely there to be read, so
+	// these take turns with the rest
+	run(func(i int) {
+		time.Sleep(10 * time.Millisecond)
+		chain.Rename(moving[i%len(moving)], moving[(i+1)%len(moving)])
+	})
+	run(func(i int) {
+		time.Sleep(20 * time.Millisecond)
+		chain.Delete(moving[i%len(moving)])
+	})
+	run(func(i int) {
+		time.Sleep(10 * time.Millisecond)
+		chain.Rmdir("/d")
+		chain.Mkdir(fmt.Sprintf("/d/sub%d", i%2), 0755)
+		chain.Rmdir(fmt.Sprintf("/d/sub%d", (i+1)%2))
+	})
+	time.Sleep(duration)
+	close(stop)
+	wg.Wait()
+}
+
+func TestReadAtPromotesLargeFilesWhole(t *testing.T) {
+	chain, cache := newTestChain(t)
+	main := chain.filesystems[1]
+
+	// A size that is not a multiple of the chunk size
+	content := make([]byte, 3*copyChunkSize+12345)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	if err := main.Write("/big", content, 0640, LockOwner{}); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := main.SetAttr("/big", AttrUpdate{Mtime: &mtime}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	if _, err := chain.ReadAt("/big", buf, 0, LockOwner{}); err != nil {
+		t.Fatal(err)
+	}
+	chain.background.Wait()
+
+	copied, err := cache.Read("/big")
+	if err != nil {
+		t.Fatalf("file was not promoted: %v", err)
+	}
+	if !bytes.Equal(copied, content) {
+		t.Errorf("promoted copy has %d bytes and differs from the %d of the original", len(copied), len(content))
+	}
+	info, err := cache.Info("/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode.Perm() != 0640 || !info.ModTime.Equal(mtime) {
+		t.Errorf("promoted copy has mode %v and mtime %v, want 0640 and %v", info.Mode.Perm(), info.ModTime, mtime)
+	}
+}
+
+// hashCountingFS is a local filesystem that counts how often it is hashed
+type hashCountingFS struct {
+	*LocalFS
+	hashes atomic.Int64
+}
+
+func (h *hashCountingFS) Hash(path string) (string, error) {
+	h.hashes.Add(1)
+	return h.LocalFS.Hash(path)
+}
+
+func TestChunkedWritesAreHashedOnClose(t *testing.T) {
+	cache, err := NewLocalFS(FileSystemConfig{
+		Role:      RoleCache,
+		MaxSize:   1 << 30,
+		Features:  FileSystemFeatures{CanUpdate: true, CanDelete: true},
+		RootPath:  t.TempDir(),
+		Coherency: CoherencyPolicy{Mode: CoherencyHash},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleMain,
+		Features: FileSystemFeatures{CanUpdate: true, CanDelete: true, CanLock: true},
+		RootPath: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := &hashCountingFS{LocalFS: local}
+	chain := NewChainFS([]ServerFS{cache, main}, nil)
+
+	if err := chain.Write("/f", nil, 0644, LockOwner{}); err != nil {
+		t.Fatal(err)
+	}
+	main.hashes.Store(0)
+
+	owner := LockOwner{ClientID: "c", Pid: 1, HandleID: 1}
+	if _, err := chain.Lock(context.Background(), "/f", WriteLock, owner, LockOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	chunk := bytes.Repeat([]byte("x"), 4096)
+	for i := 0; i < 64; i++ {
+		if _, err := chain.WriteAt("/f", chunk, int64(i*len(chunk)), owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the first chunk checks the copy written before against the source
+	if n := main.hashes.Load(); n != 1 {
+		t.Errorf("source hashed %d times while it was written, want 1", n)
+	}
+
+	if err := chain.Unlock("/f", owner); err != nil {
+		t.Fatal(err)
+	}
+	if n := main.hashes.Load(); n != 2 {
+		t.Errorf("source hashed %d times after close, want 2", n)
+	}
+	if version, ok := chain.versions.get(0, "/f"); !ok || version.Unhashed || version.Hash == "" {
+		t.Errorf("cached copy has version %+v after close, want a hash", version)
+	}
+
+	// The hashed copy is served without being fetched again
+	if content, err := chain.Read("/f"); err != nil || len(content) != 64*len(chunk) {
+		t.Errorf("Read = %d bytes, %v", len(content), err)
+	}
+	if _, err := cache.Info("/f"); err != nil {
+		t.Errorf("cached copy was dropped: %v", err)
+	}
+}
+
+// promotionBlockingFS is a local filesystem whose reads for promotions wait
+// until release is closed, reporting on reading when one starts waiting
+type promotionBlockingFS struct {
+	*LocalFS
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (p *promotionBlockingFS) ReadAt(path string, buf []byte, offset int64, owner LockOwner) (int, error) {
+	if owner == promoteOwner {
+		select {
+		case p.reading <- struct{}{}:
+		default:
+		}
+		<-p.release
+	}
+	return p.LocalFS.ReadAt(path, buf, offset, owner)
+}
+
+func TestReadAtPromotesInTheBackground(t *testing.T) {
+	chain, cache := newTestChain(t)
+	main := &promotionBlockingFS{LocalFS: chain.filesystems[1].(*LocalFS), reading: make(chan struct{}, 1), release: make(chan struct{})}
+	chain.filesystems[1] = main
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	if err := main.Write("/f", content, 0644, LockOwner{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ranged reads are answered while the promotion waits for the source
+	done := make(chan error)
+	go func() {
+		for _, offset := range []int64{0, 5000, 0} {
+			buf := make([]byte, 10)
+			if _, err := chain.ReadAt("/f", buf, offset, LockOwner{}); err != nil {
+				done <- err
+				return
+			}
+			if string(buf) != "0123456789" {
+				done <- fmt.Errorf("read %q at %d", buf, offset)
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		close(main.release)
+		t.Fatal("reads waited for the promotion")
+	}
+
+	// The copy being made is neither listed nor served
+	if files, err := chain.List("/"); err != nil || len(files) != 1 || files[0].Name != "f" || files[0].Size != int64(len(content)) {
+		t.Errorf("List = %+v, %v, want only the whole file", files, err)
+	}
+	if _, err := cache.Info("/f"); err == nil {
+		t.Error("cache serves the file before it is copied")
+	}
+
+	close(main.release)
+	chain.background.Wait()
+	if copied, err := cache.Read("/f"); err != nil || !bytes.Equal(copied, content) {
+		t.Errorf("cache has %d bytes, %v after the promotion, want the file", len(copied), err)
+	}
+	if files, err := cache.List("/"); err != nil || len(files) != 1 {
+		t.Errorf("cache lists %+v, %v, want only the promoted file", files, err)
+	}
+}
+
+func TestPromotionDropsCopiesOfChangedFiles(t *testing.T) {
+	chain, cache := newTestChain(t)
+	main := &promotionBlockingFS{LocalFS: chain.filesystems[1].(*LocalFS), reading: make(chan struct{}, 1), release: make(chan struct{})}
+	chain.filesystems[1] = main
+	if err := main.Write("/f", []byte("old"), 0644, LockOwner{}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 3)
+	if _, err := chain.ReadAt("/f", buf, 0, LockOwner{}); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	// The file changes once the promotion started copying it
+	<-main.reading
+	if err := main.Write("/f", []byte("newer"), 0644, LockOwner{}); err != nil {
+		t.Fatal(err)
+	}
+	close(main.release)
+	chain.background.Wait()
+
+	if _, err := cache.Info("/f"); err == nil {
+		t.Error("promoted a copy of a file that changed while it was copied")
+	}
+	if files, err := cache.List("/"); err != nil || len(files) != 0 {
+		t.Errorf("cache lists %+v, %v, want the dropped copy gone", files, err)
+	}
+	if content, err := chain.Read("/f"); err != nil || string(content) != "newer" {
+		t.Errorf("Read = %q, %v, want %q", content, err, "newer")
+	}
+}
+
+func TestRenameRefusesLockedSources(t *testing.T) {
+	// The main store takes the locks
+	chain, _, _ := newWritebackChain(t)
+	for _, path := range []string{"/f", "/d/g"} {
+		if err := chain.Write(path, []byte("x"), 0644, LockOwner{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	other := LockOwner{ClientID: "other", Pid: 2, HandleID: 1}
+
+	// A file locked by someone else
+	if _, err := chain.Lock(ctx, "/f", WriteLock, other, LockOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.Rename("/f", "/moved"); err != ErrFileLocked {
+		t.Errorf("Rename of a locked file = %v, want %v", err, ErrFileLocked)
+	}
+	if err := chain.Unlock("/f", other); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file in a directory locked recursively
+	if _, err := chain.Lock(ctx, "/d", WriteLock, other, LockOptions{Recursive: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.Rename("/d/g", "/moved"); err != ErrFileLocked {
+		t.Errorf("Rename out of a locked directory = %v, want %v", err, ErrFileLocked)
+	}
+	if err := chain.Unlock("/d", other); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/f", "/d/g"} {
+		if _, err := chain.Info(path); err != nil {
+			t.Errorf("%s is gone after the refused rename: %v", path, err)
+		}
+	}
+	if err := chain.Rename("/f", "/moved"); err != nil {
+		t.Errorf("Rename once unlocked: %v", err)
+	}
+}
+
+func TestWhiteoutHidesReadOnlyLowerFile(t *testing.T) {
+	cache, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleCache,
+		MaxSize:  1 << 30,
+		Features: FileSystemFeatures{CanUpdate: true, CanDelete: true},
+		RootPath: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lowerRoot := t.TempDir()
+	if err := os.Mkdir(filepath.Join(lowerRoot, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(lowerRoot, "d", name), []byte("lower "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lower, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleMain,
+		RootPath: lowerRoot,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChainFS([]ServerFS{cache, lower}, nil)
+	t.Cleanup(chain.background.Wait)
+
+	names := func() []string {
+		t.Helper()
+		files, err := chain.List("/d")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, file := range files {
+			names = append(names, file.Name)
+		}
+		return names
+	}
+
+	// Deleting the read-only file leaves a whiteout in the cache
+	if err := chain.Delete("/d/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(lowerRoot, "d", "a")); err != nil {
+		t.Fatalf("the read-only layer lost its file: %v", err)
+	}
+	if _, err := chain.Info("/d/a"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Info of the deleted file = %v, want it not to exist", err)
+	}
+	if _, err := chain.Read("/d/a"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Read of the deleted file = %v, want it not to exist", err)
+	}
+	if got := names(); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("listing after the delete = %v, want [b]", got)
+	}
+	if err := chain.Write("/d/.wh.b", nil, 0644, LockOwner{}); err == nil {
+		t.Error("a whiteout name could be created through the chain")
+	}
+
+	// Re-creating it shows the new file in place of the hidden one
+	if err := chain.Write("/d/a", []byte("upper a"), 0644, LockOwner{}); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := chain.Read("/d/a"); err != nil || string(content) != "upper a" {
+		t.Errorf("Read after re-creating = %q, %v, want %q", content, err, "upper a")
+	}
+	if got := names(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("listing after re-creating = %v, want [a b]", got)
+	}
+
+	// Deleting it again hides the read-only copy once more
+	if err := chain.Delete("/d/a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("listing after deleting again = %v, want [b]", got)
+	}
+}
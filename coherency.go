@@ -0,0 +1,429 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CoherencyMode selects how a cache checks that its copy of a file still
+// matches the authoritative (last) layer of the chain
+type CoherencyMode string
+
+const (
+	CoherencyNotify CoherencyMode = "notify" // Copies are valid until /invalidate drops them
+	CoherencyTTL    CoherencyMode = "ttl"    // Copies older than the TTL are fetched again
+	CoherencyMtime  CoherencyMode = "mtime"  // Copies are compared by the source's mtime and size
+	CoherencyHash   CoherencyMode = "hash"   // Copies are compared by the source's content hash
+)
+
+// CoherencyPolicy is the coherency mode of a cache. With the mtime and hash
+// modes a positive TTL skips the comparison for that long after a copy was
+// last found valid.
+type CoherencyPolicy struct {
+	Mode CoherencyMode
+	TTL  time.Duration
+}
+
+// validates reports whether copies have to be checked against their source
+func (p CoherencyPolicy) validates() bool {
+	return p.Mode != CoherencyNotify && p.Mode != ""
+}
+
+// ContentHasher is implemented by filesystems that report a content hash,
+// or an ETag, of a file more cheaply than the file can be read
+type ContentHasher interface {
+	Hash(path string) (string, error)
+}
+
+// maxCachedVersions bounds the number of copies whose source version is
+// remembered; the copy checked or written least recently is forgotten, and
+// so fetched again on its next read
+const maxCachedVersions = 65536
+
+// sourceVersion is the version of the source a cached copy was taken from
+type sourceVersion struct {
+	ModTime  time.Time
+	Size     int64
+	Hash     string    // Only set in hash mode
+	Unhashed bool      // Hash mode, but written through the chain and not hashed yet
+	Checked  time.Time // When the copy was fetched or last found valid
+}
+
+// versionKey identifies the copy of path in one layer of the chain
+type versionKey struct {
+	layer int
+	path  string
+}
+
+// versionTable remembers which source version every cached copy holds
+type versionTable struct {
+	mutex    sync.Mutex
+	versions *lruMap[versionKey, sourceVersion] // nil until the first version is put
+}
+
+func (t *versionTable) get(layer int, path string) (sourceVersion, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.versions == nil {
+		return sourceVersion{}, false
+	}
+	return t.versions.get(versionKey{layer, lockPath(path)})
+}
+
+func (t *versionTable) put(layer int, path string, version sourceVersion) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.versions == nil {
+		t.versions = newLRUMap[versionKey, sourceVersion](maxCachedVersions)
+	}
+	t.versions.put(versionKey{layer, lockPath(path)}, version)
+}
+
+// forget drops the versions of the copies of path and everything below it
+func (t *versionTable) forget(path string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.versions == nil {
+		return
+	}
+	path = lockPath(path)
+	t.versions.removeFunc(func(key versionKey) bool {
+		return hasPathPrefix(key.path, path)
+	})
+}
+
+// validating returns the coherency policy of a layer that checks its copies,
+// or false for layers that are not caches or trust their copies
+func (c *ChainFS) validating(layer int) (CoherencyPolicy, bool) {
+	fs := c.filesystems[layer]
+	if fs.GetRole() != RoleCache || layer == len(c.filesystems)-1 {
+		return CoherencyPolicy{}, false
+	}
+	policy := fs.GetCoherency()
+	return policy, policy.validates()
+}
+
+// sourceVersion returns the current version of path in the authoritative
+// layer. gone is set when the source no longer has the file; copies of files
+// the source never had, because it takes no writes or a whiteout hides its
+// copy, have nothing to be compared with and are reported as current.
+func (c *ChainFS) sourceVersion(path string, policy CoherencyPolicy) (version sourceVersion, gone bool, err error) {
+	last := len(c.filesystems) - 1
+	source := c.filesystems[last]
+
+	info, err := source.Info(path)
+	if os.IsNotExist(err) {
+		return sourceVersion{}, source.GetFeatures().CanUpdate, nil
+	}
+	if err != nil {
+		return sourceVersion{}, false, err
+	}
+	if c.hidden(path, last) {
+		return sourceVersion{}, false, nil
+	}
+
+	version = sourceVersion{ModTime: info.ModTime, Size: info.Size, Checked: time.Now()}
+	if policy.Mode == CoherencyHash && !info.IsDir {
+		if version.Hash, err = contentHash(source, path); err != nil {
+			return sourceVersion{}, false, err
+		}
+	}
+	return version, false, nil
+}
+
+// contentHash returns the hash of path in fs, streaming the file through
+// the hash unless fs can report it directly
+func contentHash(fs ServerFS, path string) (string, error) {
+	if hasher, ok := fs.(ContentHasher); ok {
+		return hasher.Hash(path)
+	}
+
+	h := sha256.New()
+	file := io.NewSectionReader(fileReaderAt{fs, path}, 0, math.MaxInt64)
+	if _, err := io.CopyBuffer(h, file, make([]byte, copyChunkSize)); err != nil {
+		return "", fmt.Errorf("error hashing %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileReaderAt reads a file of a filesystem as an io.ReaderAt
+type fileReaderAt struct {
+	fs   ServerFS
+	path string
+}
+
+func (r fileReaderAt) ReadAt(buf []byte, offset int64) (int, error) {
+	return r.fs.ReadAt(r.path, buf, offset, LockOwner{})
+}
+
+// fresh reports whether the copy of path in a layer may still be served.
+// When the source cannot be reached the copy is served as it is.
+func (c *ChainFS) fresh(path string, layer int) bool {
+	policy, ok := c.validating(layer)
+	if !ok {
+		return true
+	}
+	if layer == 0 && c.writeback != nil && c.writeback.isDirty(path) {
+		// The copy is newer than the source until it is flushed
+		return true
+	}
+
+	cached, known := c.versions.get(layer, path)
+	if known && policy.TTL > 0 && time.Since(cached.Checked) < policy.TTL {
+		return true
+	}
+	if !known && policy.Mode != CoherencyTTL {
+		return c.adoptCopy(path, layer, policy)
+	}
+
+	check := policy
+	if known && cached.Unhashed {
+		// The chain wrote the copy along with the source; mtime and size show
+		// whether anyone else changed the source since
+		check.Mode = CoherencyMtime
+	}
+	current, gone, err := c.sourceVersion(path, check)
+	if err != nil {
+		return true
+	}
+	if gone {
+		return false
+	}
+	if current.ModTime.IsZero() {
+		// The copy is the only one, there is nothing to fetch again
+		return true
+	}
+	if !known {
+		// Without a version there is no telling how old the copy is
+		return false
+	}
+
+	if check.Mode == CoherencyHash {
+		if current.Hash != cached.Hash {
+			return false
+		}
+	} else if !current.ModTime.Equal(cached.ModTime) || current.Size != cached.Size {
+		return false
+	}
+
+	cached.Checked = current.Checked
+	c.versions.put(layer, path, cached)
+	return true
+}
+
+// adoptCopy decides on a copy of path in a layer whose source version is not
+// known, as after a restart or once it was forgotten to make room for others.
+// Promoted copies keep the mtime and size of the source, so in mtime mode a
+// copy that has the source's is taken to hold that version rather than
+// fetched again; in hash mode the copy is hashed and compared instead.
+func (c *ChainFS) adoptCopy(path string, layer int, policy CoherencyPolicy) bool {
+	current, gone, err := c.sourceVersion(path, policy)
+	if err != nil {
+		return true
+	}
+	if gone {
+		return false
+	}
+	if current.ModTime.IsZero() {
+		// The copy is the only one, there is nothing to fetch again
+		return true
+	}
+
+	cache := c.filesystems[layer]
+	if policy.Mode == CoherencyHash {
+		if hash, err := contentHash(cache, path); err != nil || hash != current.Hash {
+			return false
+		}
+	} else if info, err := cache.Info(path); err != nil || !info.ModTime.Equal(current.ModTime) || info.Size != current.Size {
+		return false
+	}
+	c.versions.put(layer, path, current)
+	return true
+}
+
+// recordVersion remembers the source version the copy of path in a layer
+// now holds, after the copy was fetched or written through the chain
+func (c *ChainFS) recordVersion(path string, layer int) {
+	policy, ok := c.validating(layer)
+	if !ok {
+		return
+	}
+
+	version, gone, err := c.sourceVersion(path, policy)
+	if err != nil || gone {
+		c.versions.forget(path)
+		return
+	}
+	if version.Checked.IsZero() {
+		version.Checked = time.Now()
+	}
+	c.versions.put(layer, path, version)
+}
+
+// recordVersions calls recordVersion for every layer that has path
+func (c *ChainFS) recordVersions(path string) {
+	for i, fs := range c.filesystems {
+		if _, ok := c.validating(i); !ok {
+			continue
+		}
+		if _, err := fs.Info(path); err == nil {
+			c.recordVersion(path, i)
+		}
+	}
+}
+
+// recordWrite remembers the version of the source after a write through the
+// chain patched path. Hash mode records only mtime and size here, so a file
+// written in many chunks is not hashed after every one; hashWrites takes the
+// hash once the writer closes the file.
+func (c *ChainFS) recordWrite(path string) {
+	var version sourceVersion
+	var looked bool
+	for i, fs := range c.filesystems {
+		policy, ok := c.validating(i)
+		if !ok {
+			continue
+		}
+		if _, err := fs.Info(path); err != nil {
+			continue
+		}
+		if policy.Mode != CoherencyHash {
+			c.recordVersion(path, i)
+			continue
+		}
+
+		if !looked {
+			var gone bool
+			var err error
+			version, gone, err = c.sourceVersion(path, CoherencyPolicy{Mode: CoherencyMtime})
+			if err != nil || gone {
+				c.versions.forget(path)
+				return
+			}
+			version.Unhashed = true
+			looked = true
+		}
+		c.versions.put(i, path, version)
+	}
+}
+
+// hashWrites takes the hash of the source of path for the copies recordWrite
+// left without one, once the file's writer closed it. A source that changed
+// meanwhile leaves the copies stale instead.
+func (c *ChainFS) hashWrites(path string) {
+	unlock := c.paths.Lock(path)
+	defer unlock()
+
+	for i := range c.filesystems {
+		policy, ok := c.validating(i)
+		if !ok {
+			continue
+		}
+		cached, known := c.versions.get(i, path)
+		if !known || !cached.Unhashed {
+			continue
+		}
+
+		current, gone, err := c.sourceVersion(path, policy)
+		if err != nil || gone || !current.ModTime.Equal(cached.ModTime) || current.Size != cached.Size {
+			c.versions.forget(path)
+			return
+		}
+		c.versions.put(i, path, current)
+	}
+}
+
+// dropStaleCopies drops the copies of path that no longer match the source,
+// before a change that only patches the file makes them look current
+func (c *ChainFS) dropStaleCopies(path string) {
+	for i, fs := range c.filesystems {
+		if _, ok := c.validating(i); !ok {
+			continue
+		}
+		if _, err := fs.Info(path); err == nil && !c.fresh(path, i) {
+			c.dropStale(path, i)
+		}
+	}
+}
+
+// dropStale removes the stale copy of path from a layer so it is fetched
+// again from further down the chain
+func (c *ChainFS) dropStale(path string, layer int) {
+	if err := c.filesystems[layer].Invalidate(path); err != nil {
+		log.Printf("Error dropping stale copy of %s: %v", path, err)
+	}
+	c.versions.forget(path)
+}
+
+// Invalidate drops the cached copies of path and of the files below it.
+// Pinned files, whose changes are not flushed yet, are kept.
+func (l *LocalFS) Invalidate(path string) error {
+	if l.config.Role != RoleCache {
+		return nil
+	}
+
+	defer l.removeCacheEntries(path)
+
+	fullPath, err := l.realPath("open", path)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(fullPath, func(name string, entry os.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() || isWhiteout(name) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, name)
+		if err != nil {
+			return err
+		}
+		if l.isJournal(rel) || l.isPinned(rel) {
+			return nil
+		}
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// Hash returns the SHA-256 of the file's content
+func (l *LocalFS) Hash(path string) (string, error) {
+	fullPath, err := l.realPath("open", path)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("error hashing %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// GetCoherency returns how the filesystem, when it is a cache, checks its copies
+func (l *LocalFS) GetCoherency() CoherencyPolicy {
+	return l.config.Coherency
+}
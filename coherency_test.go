@@ -0,0 +1,101 @@
+package main
+
+import "testing"
+
+// unhashedFS hides the content hash of a filesystem, so it has to be read
+// to be hashed
+type unhashedFS struct {
+	ServerFS
+}
+
+func TestCopiesOfUnknownVersionAreKeptWhenTheyMatch(t *testing.T) {
+	for _, mode := range []CoherencyMode{CoherencyMtime, CoherencyHash} {
+		t.Run(string(mode), func(t *testing.T) {
+			cacheRoot, mainRoot := t.TempDir(), t.TempDir()
+			// newChain starts the server again over the same directories,
+			// knowing nothing about the cached copies
+			newChain := func() (*ChainFS, *LocalFS, *LocalFS) {
+				cache, err := NewLocalFS(FileSystemConfig{
+					Role:      RoleCache,
+					MaxSize:   1 << 30,
+					Features:  FileSystemFeatures{CanUpdate: true, CanDelete: true},
+					RootPath:  cacheRoot,
+					Coherency: CoherencyPolicy{Mode: mode},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				main, err := NewLocalFS(FileSystemConfig{
+					Role:     RoleMain,
+					Features: FileSystemFeatures{CanUpdate: true, CanDelete: true},
+					RootPath: mainRoot,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				chain := NewChainFS([]ServerFS{cache, main}, nil)
+				t.Cleanup(chain.background.Wait)
+				return chain, cache, main
+			}
+
+			chain, _, main := newChain()
+			if err := main.Write("/f", []byte("first"), 0644, LockOwner{}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := chain.Read("/f"); err != nil {
+				t.Fatal(err)
+			}
+
+			// A copy that still matches the source is served from the cache
+			chain, cache, main := newChain()
+			if content, err := chain.Read("/f"); err != nil || string(content) != "first" {
+				t.Fatalf("Read = %q, %v", content, err)
+			}
+			if stats := chain.PromotionStats(); stats.Promoted != 0 {
+				t.Errorf("a matching copy was fetched again")
+			}
+
+			// One that no longer does is fetched again
+			chain, cache, main = newChain()
+			if err := main.Write("/f", []byte("second"), 0644, LockOwner{}); err != nil {
+				t.Fatal(err)
+			}
+			if content, err := chain.Read("/f"); err != nil || string(content) != "second" {
+				t.Fatalf("Read = %q, %v after the source changed", content, err)
+			}
+			if content, err := cache.Read("/f"); err != nil || string(content) != "second" {
+				t.Errorf("cache has %q, %v, want the new content", content, err)
+			}
+		})
+	}
+}
+
+func TestContentHashStreamsFilesWithoutAHash(t *testing.T) {
+	local, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleMain,
+		Features: FileSystemFeatures{CanUpdate: true},
+		RootPath: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 2*copyChunkSize+3)
+	for i := range content {
+		content[i] = byte(i % 241)
+	}
+	if err := local.Write("/f", content, 0644, LockOwner{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := local.Hash("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := contentHash(unhashedFS{local}, "/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("streamed hash %s, want %s", got, want)
+	}
+}
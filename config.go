@@ -3,25 +3,101 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type FSConfig struct {
-	Type      string `yaml:"type"`       // "local", "s3", etc
-	Role      string `yaml:"role"`       // "main", "cache"
-	Path      string `yaml:"path"`       // Local path or bucket path
-	MaxSize   int64  `yaml:"max_size"`   // For cache filesystems
-	CanUpdate bool   `yaml:"can_update"` // Whether writes are allowed
-	CanDelete bool   `yaml:"can_delete"` // Whether deletes are allowed
-	CanLock   bool   `yaml:"can_lock"`   // Whether file locking is supported
+	Type         string        `yaml:"type"`          // "local", "s3", etc
+	Role         string        `yaml:"role"`          // "main", "cache"
+	Path         string        `yaml:"path"`          // Local path or bucket path
+	MaxSize      int64         `yaml:"max_size"`      // For cache filesystems
+	CanUpdate    bool          `yaml:"can_update"`    // Whether writes are allowed
+	CanDelete    bool          `yaml:"can_delete"`    // Whether deletes are allowed
+	CanLock      bool          `yaml:"can_lock"`      // Whether file locking is supported
+	LinkPolicy   string        `yaml:"link_policy"`   // "allow", "deny" or "hide" for links leaving the root
+	PersistLocks bool          `yaml:"persist_locks"` // Keep locks in a journal under path across restarts
+	Coherency    string        `yaml:"coherency"`     // "notify", "ttl", "mtime" or "hash", for cache filesystems
+	CoherencyTTL time.Duration `yaml:"coherency_ttl"` // Refetch age for "ttl", time between checks for "mtime" and "hash"
 }
 
+// PromotionConfig sets which files reads copy into the earlier filesystems
+type PromotionConfig struct {
+	MinAccesses int      `yaml:"min_accesses"` // Reads of a file before it is copied, defaults to the first read
+	MaxSize     int64    `yaml:"max_size"`     // Larger files are never copied, 0 for no limit
+	Include     []string `yaml:"include"`      // Globs of the files to copy, all files when empty
+	Exclude     []string `yaml:"exclude"`      // Globs of the files never to copy
+	SkipScans   bool     `yaml:"skip_scans"`   // Don't copy files read once by a scan of their directory
+	ScanFiles   int      `yaml:"scan_files"`   // Files read once from a directory that make a scan, defaults to 32
+}
+
+// policy returns the promotion policy the config describes
+func (c PromotionConfig) policy() PromotionPolicy {
+	return PromotionPolicy{
+		MinAccesses: c.MinAccesses,
+		MaxSize:     c.MaxSize,
+		Include:     c.Include,
+		Exclude:     c.Exclude,
+		SkipScans:   c.SkipScans,
+		ScanFiles:   c.ScanFiles,
+	}
+}
+
+// OwnershipMode selects which uid/gid the mount reports for files
+type OwnershipMode string
+
+const (
+	OwnershipMountUser   OwnershipMode = "mount_user"  // Everything is owned by the mounting user
+	OwnershipPassthrough OwnershipMode = "passthrough" // Report the backend's uid/gid unchanged
+	OwnershipFixed       OwnershipMode = "fixed"       // Report the configured uid/gid
+)
+
+type OwnershipConfig struct {
+	Mode OwnershipMode `yaml:"mode"` // Defaults to "mount_user"
+	Uid  uint32        `yaml:"uid"`  // Only used with "fixed"
+	Gid  uint32        `yaml:"gid"`  // Only used with "fixed"
+}
+
+// ClusterConfig lets several servers that share a main store coordinate
+// their locks. One node is the lock coordinator; the others forward every
+// lock request to it.
+type ClusterConfig struct {
+	NodeID      string            `yaml:"node_id"`     // This server's name in peers, defaults to the hostname
+	Coordinator string            `yaml:"coordinator"` // Name of the node that manages the locks
+	Peers       map[string]string `yaml:"peers"`       // Base URL of every node, by name
+}
+
+// enabled reports whether the server is part of a cluster
+func (c ClusterConfig) enabled() bool {
+	return c.Coordinator != ""
+}
+
+// isCoordinator reports whether this server manages the cluster's locks
+func (c ClusterConfig) isCoordinator() bool {
+	return c.NodeID == c.Coordinator
+}
+
+// defaultLockTTL is how long a lock survives without a heartbeat from its owner
+const defaultLockTTL = 60 * time.Second
+
 type Config struct {
-	Mount       string     `yaml:"mount"`       // FUSE mount point
-	ServerAddr  string     `yaml:"server_addr"` // Server address (host:port)
-	FileSystems []FSConfig `yaml:"filesystems"` // List of filesystems in order
-	HasLocking  bool       `yaml:"-"`           // Computed field indicating if chain supports locking
+	Mount       string          `yaml:"mount"`       // FUSE mount point
+	ServerAddr  string          `yaml:"server_addr"` // Server address (host:port)
+	Ownership   OwnershipConfig `yaml:"ownership"`   // uid/gid mapping for the mount
+	ClientID    string          `yaml:"client_id"`   // Identifies this mount as a lock owner
+	LockTTL     time.Duration   `yaml:"lock_ttl"`    // Lease length of file locks
+	AdminToken  string          `yaml:"admin_token"` // Bearer token for the lock admin API, disabled when empty
+	Cluster     ClusterConfig   `yaml:"cluster"`     // Lock coordination between servers
+	FileSystems []FSConfig      `yaml:"filesystems"` // List of filesystems in order
+	HasLocking  bool            `yaml:"-"`           // Computed field indicating if chain supports locking
+
+	WriteMode        WriteMode `yaml:"write_mode"`        // "writethrough" (default) or "writeback"
+	WritebackJournal string    `yaml:"writeback_journal"` // Unflushed files in write-back mode, defaults to a file in the first filesystem
+
+	Promotion PromotionConfig `yaml:"promotion"` // Which files reads copy into the earlier filesystems
+	Debug     bool            `yaml:"debug"`     // Log the decisions of the chain
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -45,21 +121,92 @@ func LoadConfig(path string) (*Config, error) {
 	if config.ServerAddr == "" {
 		config.ServerAddr = ":8080" // Default server address
 	}
+	if config.LockTTL < 0 {
+		return nil, fmt.Errorf("lock_ttl must not be negative")
+	}
+	if config.LockTTL == 0 {
+		config.LockTTL = defaultLockTTL
+	}
+	if config.ClientID == "" {
+		config.ClientID = defaultClientID()
+	}
+	switch config.Ownership.Mode {
+	case "":
+		config.Ownership.Mode = OwnershipMountUser
+	case OwnershipMountUser, OwnershipPassthrough, OwnershipFixed:
+	default:
+		return nil, fmt.Errorf("invalid ownership mode: %s", config.Ownership.Mode)
+	}
+
+	switch config.WriteMode {
+	case "":
+		config.WriteMode = WriteThrough
+	case WriteThrough:
+	case WriteBack:
+		if config.WritebackJournal == "" {
+			config.WritebackJournal = filepath.Join(config.FileSystems[0].Path, writebackJournalName)
+		}
+	default:
+		return nil, fmt.Errorf("invalid write mode: %s", config.WriteMode)
+	}
 
-	// Validate that the first filesystem supports locking if any filesystem does
-	for i, fs := range config.FileSystems {
+	// The first filesystem that supports locking manages the chain's locks
+	for _, fs := range config.FileSystems {
 		if fs.CanLock {
 			config.HasLocking = true
-			if i > 0 {
-				return nil, fmt.Errorf("only the first filesystem in the chain can support locking")
-			}
 			break
 		}
 	}
 
+	if err := validateCluster(&config); err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
 
+// validateCluster checks the cluster section and fills in its defaults
+func validateCluster(config *Config) error {
+	cluster := &config.Cluster
+	if !cluster.enabled() {
+		return nil
+	}
+
+	if cluster.NodeID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("cluster.node_id is required: %v", err)
+		}
+		cluster.NodeID = hostname
+	}
+	if _, ok := cluster.Peers[cluster.NodeID]; !ok {
+		return fmt.Errorf("cluster node %q is not listed in cluster.peers", cluster.NodeID)
+	}
+	if _, ok := cluster.Peers[cluster.Coordinator]; !ok {
+		return fmt.Errorf("cluster coordinator %q is not listed in cluster.peers", cluster.Coordinator)
+	}
+
+	if cluster.isCoordinator() {
+		if !config.HasLocking {
+			return fmt.Errorf("the cluster coordinator needs a filesystem with can_lock")
+		}
+		return nil
+	}
+
+	// Other nodes lock through the coordinator, whatever their filesystems support
+	config.HasLocking = true
+	return nil
+}
+
+// createLockService returns the lock service the chain should use: the
+// coordinator's for a cluster member, or nil to lock in the chain itself
+func createLockService(config *Config) LockService {
+	if !config.Cluster.enabled() || config.Cluster.isCoordinator() {
+		return nil
+	}
+	return NewRemoteLockService(config.Cluster.Peers[config.Cluster.Coordinator], config.AdminToken)
+}
+
 func createFileSystems(config *Config) ([]ServerFS, error) {
 	var filesystems []ServerFS
 
@@ -78,10 +225,17 @@ func createFileSystems(config *Config) ([]ServerFS, error) {
 		switch fsConfig.Type {
 		case "local":
 			fs, err := NewLocalFS(FileSystemConfig{
-				Role:     fsRole,
-				MaxSize:  fsConfig.MaxSize,
-				Features: features,
-				RootPath: fsConfig.Path,
+				Role:         fsRole,
+				MaxSize:      fsConfig.MaxSize,
+				Features:     features,
+				RootPath:     fsConfig.Path,
+				LinkPolicy:   LinkPolicy(fsConfig.LinkPolicy),
+				LockTTL:      config.LockTTL,
+				PersistLocks: fsConfig.PersistLocks,
+				Coherency: CoherencyPolicy{
+					Mode: CoherencyMode(fsConfig.Coherency),
+					TTL:  fsConfig.CoherencyTTL,
+				},
 			})
 			if err != nil {
 				return nil, fmt.Errorf("error creating local filesystem: %v", err)
@@ -95,3 +249,12 @@ func createFileSystems(config *Config) ([]ServerFS, error) {
 
 	return filesystems, nil
 }
+
+// defaultClientID names this mount after the host and daemon process
+func defaultClientID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
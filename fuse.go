@@ -5,9 +5,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -17,17 +24,346 @@ import (
 )
 
 type FileInfo struct {
-	Name    string
-	Size    int64
-	Mode    os.FileMode
-	ModTime time.Time
-	IsDir   bool
-	Content []byte // Only for files
+	Name       string
+	Size       int64
+	Mode       os.FileMode
+	ModTime    time.Time
+	Atime      time.Time
+	Ctime      time.Time
+	Uid        uint32
+	Gid        uint32
+	Inode      uint64
+	Nlink      uint32
+	IsDir      bool
+	LinkTarget string // Only for symlinks
+	Content    []byte // Only for files
+}
+
+// AttrUpdate describes a metadata change; nil fields are left untouched
+type AttrUpdate struct {
+	Mode  *os.FileMode
+	Uid   *uint32
+	Gid   *uint32
+	Atime *time.Time
+	Mtime *time.Time
+}
+
+// errnoForStatus maps an HTTP error status from the file server to an errno
+func errnoForStatus(status int) error {
+	switch status {
+	case http.StatusNotFound:
+		return syscall.ENOENT
+	case http.StatusConflict, http.StatusForbidden:
+		return syscall.EACCES
+	case http.StatusNotImplemented:
+		return syscall.ENOSYS
+	default:
+		return syscall.EIO
+	}
+}
+
+// errnoFromResponse returns the errno reported by the server, falling back to the status code
+func errnoFromResponse(resp *http.Response) error {
+	if errno, err := strconv.Atoi(resp.Header.Get(errnoHeader)); err == nil && errno > 0 {
+		return syscall.Errno(errno)
+	}
+	return errnoForStatus(resp.StatusCode)
 }
 
 type FS struct {
-	client  *http.Client
-	baseURL string
+	client    *http.Client
+	baseURL   string
+	ownership OwnershipConfig
+	clientID  string        // Identifies this mount to the server's lock table
+	handleIDs atomic.Uint64 // Source of per-open handle IDs
+
+	mutex sync.Mutex
+	nodes map[pathNode]struct{} // Nodes known to the kernel, so renames can update their paths
+}
+
+// pathNode is a node whose server path changes when it or a parent is renamed
+type pathNode interface {
+	getPath() string
+	setPath(path string)
+}
+
+// track remembers a node handed to the kernel until it is forgotten
+func (fs *FS) track(n pathNode) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.nodes == nil {
+		fs.nodes = make(map[pathNode]struct{})
+	}
+	fs.nodes[n] = struct{}{}
+}
+
+func (fs *FS) untrack(n pathNode) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	delete(fs.nodes, n)
+}
+
+// openFiles returns the known file nodes
+func (fs *FS) openFiles() []*File {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	var files []*File
+	for n := range fs.nodes {
+		if f, ok := n.(*File); ok {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// heartbeat renews the lock leases of every open handle until done is closed
+func (fs *FS) heartbeat(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			fs.renewLeases()
+		}
+	}
+}
+
+// renewLeases extends the server-side lease of each open handle's lock
+func (fs *FS) renewLeases() {
+	for _, f := range fs.openFiles() {
+		for _, h := range f.openHandles() {
+			err := fs.post(context.Background(), fmt.Sprintf("%s/renew?path=%s&%s",
+				fs.baseURL, url.QueryEscape(f.getPath()), ownerQuery(h.owner)))
+			if err != nil && err != syscall.ENOSYS {
+				log.Printf("Error renewing lock on %s for %s: %v", f.getPath(), h.owner, err)
+			}
+		}
+	}
+}
+
+// renamePaths moves every known node at or below oldPath to newPath
+func (fs *FS) renamePaths(oldPath, newPath string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	for n := range fs.nodes {
+		path := n.getPath()
+		if path == oldPath {
+			n.setPath(newPath)
+		} else if strings.HasPrefix(path, oldPath+"/") {
+			n.setPath(newPath + strings.TrimPrefix(path, oldPath))
+		}
+	}
+}
+
+// owner maps the backend owner of a file to the ids reported to the kernel
+func (fs *FS) owner(info FileInfo) (uint32, uint32) {
+	switch fs.ownership.Mode {
+	case OwnershipPassthrough:
+		return info.Uid, info.Gid
+	case OwnershipFixed:
+		return fs.ownership.Uid, fs.ownership.Gid
+	default:
+		return uint32(os.Getuid()), uint32(os.Getgid())
+	}
+}
+
+// fillAttr copies backend metadata into a FUSE attribute
+func (fs *FS) fillAttr(info FileInfo, attr *fuse.Attr) {
+	attr.Inode = info.Inode
+	attr.Mode = info.Mode
+	attr.Size = uint64(info.Size)
+	attr.Nlink = info.Nlink
+	attr.Mtime = info.ModTime
+	attr.Atime = info.Atime
+	attr.Ctime = info.Ctime
+	attr.Uid, attr.Gid = fs.owner(info)
+}
+
+// info fetches the metadata of path from the server
+func (fs *FS) info(ctx context.Context, path string) (FileInfo, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("%s/info?path=%s", fs.baseURL, url.QueryEscape(path)), nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	httpResp, err := fs.client.Do(httpReq)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return FileInfo{}, errnoFromResponse(httpResp)
+	}
+
+	var info FileInfo
+	if err := json.NewDecoder(httpResp.Body).Decode(&info); err != nil {
+		return FileInfo{}, err
+	}
+	return info, nil
+}
+
+// setattr applies the mode, owner and timestamp parts of a setattr request on the server
+func (fs *FS) setattr(ctx context.Context, path string, req *fuse.SetattrRequest) error {
+	var update AttrUpdate
+	changed := false
+
+	if req.Valid.Mode() {
+		mode := req.Mode
+		update.Mode = &mode
+		changed = true
+	}
+	if req.Valid.Uid() {
+		uid := req.Uid
+		update.Uid = &uid
+		changed = true
+	}
+	if req.Valid.Gid() {
+		gid := req.Gid
+		update.Gid = &gid
+		changed = true
+	}
+	if req.Valid.AtimeNow() {
+		now := time.Now()
+		update.Atime = &now
+		changed = true
+	} else if req.Valid.Atime() {
+		atime := req.Atime
+		update.Atime = &atime
+		changed = true
+	}
+	if req.Valid.MtimeNow() {
+		now := time.Now()
+		update.Mtime = &now
+		changed = true
+	} else if req.Valid.Mtime() {
+		mtime := req.Mtime
+		update.Mtime = &mtime
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		fmt.Sprintf("%s/setattr?path=%s", fs.baseURL, url.QueryEscape(path)), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := fs.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return errnoFromResponse(httpResp)
+	}
+	return nil
+}
+
+// post sends a POST request without a body and converts a failure into an errno
+func (fs *FS) post(ctx context.Context, url string) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+
+	httpResp, err := fs.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return errnoFromResponse(httpResp)
+	}
+	return nil
+}
+
+// getxattr fetches an extended attribute of path from the server
+func (fs *FS) getxattr(ctx context.Context, path string, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("%s/getxattr?path=%s&name=%s", fs.baseURL, url.QueryEscape(path), url.QueryEscape(req.Name)), nil)
+	if err != nil {
+		return err
+	}
+
+	httpResp, err := fs.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return errnoFromResponse(httpResp)
+	}
+
+	resp.Xattr, err = io.ReadAll(httpResp.Body)
+	return err
+}
+
+func (fs *FS) setxattr(ctx context.Context, path string, req *fuse.SetxattrRequest) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		fmt.Sprintf("%s/setxattr?path=%s&name=%s&flags=%d", fs.baseURL, url.QueryEscape(path), url.QueryEscape(req.Name), req.Flags),
+		bytes.NewReader(req.Xattr))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/octet-stream")
+
+	httpResp, err := fs.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return errnoFromResponse(httpResp)
+	}
+	return nil
+}
+
+func (fs *FS) listxattr(ctx context.Context, path string, resp *fuse.ListxattrResponse) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("%s/listxattr?path=%s", fs.baseURL, url.QueryEscape(path)), nil)
+	if err != nil {
+		return err
+	}
+
+	httpResp, err := fs.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return errnoFromResponse(httpResp)
+	}
+
+	var names []string
+	if err := json.NewDecoder(httpResp.Body).Decode(&names); err != nil {
+		return err
+	}
+	resp.Append(names...)
+	return nil
+}
+
+func (fs *FS) removexattr(ctx context.Context, path string, req *fuse.RemovexattrRequest) error {
+	return fs.post(ctx, fmt.Sprintf("%s/removexattr?path=%s&name=%s", fs.baseURL, url.QueryEscape(path), url.QueryEscape(req.Name)))
 }
 
 func (fs *FS) Root() (fs.Node, error) {
@@ -38,44 +374,86 @@ func (fs *FS) Root() (fs.Node, error) {
 }
 
 type Dir struct {
-	fs   *FS
-	path string
+	fs    *FS
+	path  string
+	mutex sync.Mutex
 }
 
-func (d *Dir) Attr(ctx context.Context, attr *fuse.Attr) error {
-	attr.Mode = os.ModeDir | 0o775
-	attr.Uid = uint32(os.Getuid()) // Set owner to current user
-	attr.Gid = uint32(os.Getgid()) // Set group to current user's group
-	attr.Mtime = time.Now()
-	return nil
+func (d *Dir) getPath() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.path
 }
 
-func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	path := filepath.Join(d.path, name)
+func (d *Dir) setPath(path string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.path = path
+}
+
+func (d *Dir) Forget() {
+	d.fs.untrack(d)
+}
 
-	resp, err := d.fs.client.Get(fmt.Sprintf("%s/info?path=%s", d.fs.baseURL, path))
+func (d *Dir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	info, err := d.fs.info(ctx, d.getPath())
 	if err != nil {
-		return nil, syscall.ENOENT
+		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, syscall.ENOENT
+	d.fs.fillAttr(info, attr)
+	return nil
+}
+
+func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if err := d.fs.setattr(ctx, d.getPath(), req); err != nil {
+		return err
 	}
 
-	var info FileInfo
-	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
-		return nil, err
+	return d.Attr(ctx, &resp.Attr)
+}
+
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return d.fs.getxattr(ctx, d.getPath(), req, resp)
+}
+
+func (d *Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	return d.fs.setxattr(ctx, d.getPath(), req)
+}
+
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return d.fs.listxattr(ctx, d.getPath(), resp)
+}
+
+func (d *Dir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	return d.fs.removexattr(ctx, d.getPath(), req)
+}
+
+func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	path := filepath.Join(d.getPath(), name)
+
+	info, err := d.fs.info(ctx, path)
+	if err != nil {
+		return nil, syscall.ENOENT
 	}
 
 	if info.IsDir {
-		return &Dir{fs: d.fs, path: path}, nil
+		dir := &Dir{fs: d.fs, path: path}
+		d.fs.track(dir)
+		return dir, nil
+	}
+	if info.Mode&os.ModeSymlink != 0 {
+		link := &Symlink{fs: d.fs, path: path, info: info}
+		d.fs.track(link)
+		return link, nil
 	}
-	return &File{fs: d.fs, path: path, info: info}, nil
+	f := &File{fs: d.fs, path: path, info: info}
+	d.fs.track(f)
+	return f, nil
 }
 
 func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	resp, err := d.fs.client.Get(fmt.Sprintf("%s/list?path=%s", d.fs.baseURL, d.path))
+	resp, err := d.fs.client.Get(fmt.Sprintf("%s/list?path=%s", d.fs.baseURL, url.QueryEscape(d.getPath())))
 	if err != nil {
 		return nil, err
 	}
@@ -91,6 +469,8 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 		var dtype fuse.DirentType
 		if f.IsDir {
 			dtype = fuse.DT_Dir
+		} else if f.Mode&os.ModeSymlink != 0 {
+			dtype = fuse.DT_Link
 		} else {
 			dtype = fuse.DT_File
 		}
@@ -102,23 +482,219 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	return dirDirs, nil
 }
 
+func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	path := filepath.Join(d.getPath(), req.Name)
+	mode := req.Mode &^ req.Umask
+
+	if err := d.fs.post(ctx, fmt.Sprintf("%s/mkdir?path=%s&mode=%o", d.fs.baseURL, url.QueryEscape(path), mode.Perm())); err != nil {
+		return nil, err
+	}
+
+	dir := &Dir{fs: d.fs, path: path}
+	d.fs.track(dir)
+	return dir, nil
+}
+
+func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	path := filepath.Join(d.getPath(), req.Name)
+
+	// rmdir and unlink map to separate endpoints so ENOTDIR and EISDIR come back correctly
+	endpoint := "delete"
+	if req.Dir {
+		endpoint = "rmdir"
+	}
+
+	return d.fs.post(ctx, fmt.Sprintf("%s/%s?path=%s", d.fs.baseURL, endpoint, url.QueryEscape(path)))
+}
+
+func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	target, ok := newDir.(*Dir)
+	if !ok {
+		return syscall.EINVAL
+	}
+
+	oldPath := filepath.Join(d.getPath(), req.OldName)
+	newPath := filepath.Join(target.getPath(), req.NewName)
+
+	if err := d.fs.post(ctx, fmt.Sprintf("%s/rename?old=%s&new=%s",
+		d.fs.baseURL, url.QueryEscape(oldPath), url.QueryEscape(newPath))); err != nil {
+		return err
+	}
+
+	// The kernel keeps using the same nodes after a rename, including open files
+	d.fs.renamePaths(oldPath, newPath)
+	return nil
+}
+
+func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	path := filepath.Join(d.getPath(), req.NewName)
+
+	if err := d.fs.post(ctx, fmt.Sprintf("%s/symlink?path=%s&target=%s",
+		d.fs.baseURL, url.QueryEscape(path), url.QueryEscape(req.Target))); err != nil {
+		return nil, err
+	}
+
+	link := &Symlink{
+		fs:   d.fs,
+		path: path,
+		info: FileInfo{
+			Name:       req.NewName,
+			Size:       int64(len(req.Target)),
+			Mode:       os.ModeSymlink | 0o777,
+			ModTime:    time.Now(),
+			LinkTarget: req.Target,
+		},
+	}
+	d.fs.track(link)
+	return link, nil
+}
+
+func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.Node, error) {
+	source, ok := old.(*File)
+	if !ok {
+		return nil, syscall.EPERM
+	}
+
+	path := filepath.Join(d.getPath(), req.NewName)
+
+	if err := d.fs.post(ctx, fmt.Sprintf("%s/link?old=%s&new=%s",
+		d.fs.baseURL, url.QueryEscape(source.getPath()), url.QueryEscape(path))); err != nil {
+		return nil, err
+	}
+
+	source.mutex.Lock()
+	info := source.info
+	source.mutex.Unlock()
+
+	info.Name = req.NewName
+	f := &File{fs: d.fs, path: path, info: info}
+	d.fs.track(f)
+	return f, nil
+}
+
+// Symlink is a symbolic link node
+type Symlink struct {
+	fs    *FS
+	path  string
+	info  FileInfo
+	mutex sync.Mutex
+}
+
+func (l *Symlink) getPath() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.path
+}
+
+func (l *Symlink) setPath(path string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.path = path
+}
+
+func (l *Symlink) Forget() {
+	l.fs.untrack(l)
+}
+
+func (l *Symlink) Attr(ctx context.Context, attr *fuse.Attr) error {
+	l.fs.fillAttr(l.info, attr)
+	attr.Size = uint64(len(l.info.LinkTarget))
+	return nil
+}
+
+func (l *Symlink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("%s/readlink?path=%s", l.fs.baseURL, url.QueryEscape(l.getPath())), nil)
+	if err != nil {
+		return "", err
+	}
+
+	httpResp, err := l.fs.client.Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return "", errnoFromResponse(httpResp)
+	}
+
+	target, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(target), nil
+}
+
 type File struct {
 	fs   *FS
 	path string
 	info FileInfo
+
+	mutex       sync.Mutex
+	handles     map[*FileHandle]struct{} // Open handles, used to flush on fsync
+	rangeOwners map[rangeOwner]struct{}  // Lock owners that may hold byte-range locks
+}
+
+func (f *File) getPath() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.path
+}
+
+func (f *File) setPath(path string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.path = path
+}
+
+func (f *File) Forget() {
+	f.fs.untrack(f)
 }
 
 func (f *File) Attr(ctx context.Context, attr *fuse.Attr) error {
-	attr.Mode = f.info.Mode
-	attr.Size = uint64(f.info.Size)
-	attr.Mtime = f.info.ModTime
-	attr.Uid = uint32(os.Getuid())
-	attr.Gid = uint32(os.Getgid())
+	if info, err := f.fs.info(ctx, f.getPath()); err == nil {
+		f.refreshInfo(info)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.fs.fillAttr(f.info, attr)
 	return nil
 }
 
+// refreshInfo stores fresh server metadata, keeping a larger size from
+// writes that are still buffered in open handles
+func (f *File) refreshInfo(info FileInfo) {
+	for _, h := range f.openHandles() {
+		if size := h.buffer.Size(); size > info.Size {
+			info.Size = size
+		}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.info = info
+}
+
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	return f.fs.getxattr(ctx, f.getPath(), req, resp)
+}
+
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	return f.fs.setxattr(ctx, f.getPath(), req)
+}
+
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	return f.fs.listxattr(ctx, f.getPath(), resp)
+}
+
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	return f.fs.removexattr(ctx, f.getPath(), req)
+}
+
 func (f *File) ReadAll(ctx context.Context) ([]byte, error) {
-	resp, err := f.fs.client.Get(fmt.Sprintf("%s/read?path=%s", f.fs.baseURL, f.path))
+	resp, err := f.fs.client.Get(fmt.Sprintf("%s/read?path=%s", f.fs.baseURL, url.QueryEscape(f.getPath())))
 	if err != nil {
 		return nil, err
 	}
@@ -134,49 +710,252 @@ func (f *File) ReadAll(ctx context.Context) ([]byte, error) {
 
 func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
 	// Check the flags to determine the type of access
-	flags := req.Flags
+	lockType := lockTypeForFlags(req.Flags)
+	owner := f.fs.newOwner(req.Header.Pid)
 
-	var lockType LockType
-	if flags.IsReadOnly() {
-		lockType = ReadLock
-	} else if flags.IsWriteOnly() {
-		lockType = WriteLock
-	} else if flags.IsReadWrite() {
-		lockType = ExclusiveLock
+	// Like flock, an open waits for the lock unless it asked not to block
+	wait := req.Flags&fuse.OpenNonblock == 0
+	fence, err := f.lock(ctx, lockType, owner, wait)
+	if err != nil {
+		return nil, err
 	}
 
-	// Try to acquire the lock
-	httpResp, err := f.fs.client.Post(fmt.Sprintf("%s/lock?path=%s&type=%d&pid=%d",
-		f.fs.baseURL,
-		f.path,
-		lockType,
-		os.Getpid()),
-		"application/json",
-		nil)
+	return f.newHandle(lockType, owner, fence), nil
+}
+
+// lockTypeForFlags picks the lock an open with the given flags needs
+func lockTypeForFlags(flags fuse.OpenFlags) LockType {
+	switch {
+	case flags.IsWriteOnly():
+		return WriteLock
+	case flags.IsReadWrite():
+		return ExclusiveLock
+	default:
+		return ReadLock
+	}
+}
+
+// newOwner identifies a new open by the process pid on this mount
+func (fs *FS) newOwner(pid uint32) LockOwner {
+	return LockOwner{
+		ClientID: fs.clientID,
+		Pid:      int(pid),
+		HandleID: fs.handleIDs.Add(1),
+	}
+}
+
+// ownerQuery encodes owner as the client, pid and handle query parameters,
+// leaving out a pid or handle that is not set
+func ownerQuery(owner LockOwner) string {
+	query := url.Values{"client": {owner.ClientID}}
+	if owner.Pid != 0 {
+		query.Set("pid", strconv.Itoa(owner.Pid))
+	}
+	if owner.HandleID != 0 {
+		query.Set("handle", strconv.FormatUint(owner.HandleID, 10))
+	}
+	return query.Encode()
+}
+
+// lockPollTimeout is how long a single long-poll for a lock lasts; it has to
+// stay below the HTTP client timeout
+const lockPollTimeout = 20 * time.Second
+
+// lock acquires a lock of lockType on the file for owner, waiting for it
+// like flock when wait is set, and returns its fencing token
+func (f *File) lock(ctx context.Context, lockType LockType, owner LockOwner, wait bool) (uint64, error) {
+	fence, err := f.fs.pollLock(ctx, fmt.Sprintf("%s/lock?path=%s&type=%d&%s",
+		f.fs.baseURL, url.QueryEscape(f.getPath()), lockType, ownerQuery(owner)), wait)
+	if err == syscall.ENOSYS {
+		// The chain has no lockable filesystem, so opens are not serialised
+		return 0, nil
+	}
+	if _, ok := err.(syscall.Errno); ok && err != syscall.EINTR && err != syscall.EDEADLK {
+		return 0, syscall.EACCES
+	}
+	return fence, err
+}
+
+// pollLock posts a lock request. A conflict fails with EAGAIN unless wait is
+// set, in which case the server is long-polled until the lock is granted or
+// ctx is cancelled, which happens when the kernel interrupts the request.
+// It returns the fencing token of a granted whole-file lock.
+func (fs *FS) pollLock(ctx context.Context, lockURL string, wait bool) (uint64, error) {
+	if wait {
+		lockURL += "&wait=" + lockPollTimeout.String()
+	}
+
+	for {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, lockURL, nil)
+		if err != nil {
+			return 0, err
+		}
+
+		httpResp, err := fs.client.Do(httpReq)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, syscall.EINTR
+			}
+			return 0, err
+		}
+
+		// Byte-range locks have no fencing token, their response body is empty
+		var grant LockGrant
+		if httpResp.StatusCode == http.StatusOK {
+			json.NewDecoder(httpResp.Body).Decode(&grant)
+		}
+		httpResp.Body.Close()
+
+		switch {
+		case httpResp.StatusCode == http.StatusOK:
+			return grant.Token, nil
+		case httpResp.StatusCode == http.StatusConflict && httpResp.Header.Get(errnoHeader) != "":
+			// Not a plain conflict but, e.g., EDEADLK: waiting longer would not help
+			return 0, errnoFromResponse(httpResp)
+		case httpResp.StatusCode == http.StatusConflict && wait:
+			// The poll timed out with the lock still taken, ask again
+			continue
+		case httpResp.StatusCode == http.StatusConflict:
+			return 0, syscall.EAGAIN
+		}
+		return 0, errnoFromResponse(httpResp)
+	}
+}
+
+// ownerForPid returns the lock owner of an open handle of pid, or a
+// handle-less owner for pid if it has the file open nowhere
+func (f *File) ownerForPid(pid uint32) LockOwner {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for h := range f.handles {
+		if h.owner.Pid == int(pid) {
+			return h.owner
+		}
+	}
+	return LockOwner{ClientID: f.fs.clientID, Pid: int(pid)}
+}
+
+// newHandle creates a file handle and registers it with the file
+func (f *File) newHandle(lockType LockType, owner LockOwner, fence uint64) *FileHandle {
+	h := &FileHandle{
+		file:     f,
+		lockType: lockType,
+		owner:    owner,
+		fence:    fence,
+		buffer:   NewWriteBuffer(),
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.handles == nil {
+		f.handles = make(map[*FileHandle]struct{})
+	}
+	f.handles[h] = struct{}{}
+	return h
+}
+
+// Fsync flushes the buffered writes of every open handle of the file
+func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	return f.flushHandles(ctx)
+}
+
+// flushHandles sends the buffered writes of every open handle to the server
+func (f *File) flushHandles(ctx context.Context) error {
+	for _, h := range f.openHandles() {
+		if err := h.flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openHandles returns a snapshot of the file's open handles
+func (f *File) openHandles() []*FileHandle {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	handles := make([]*FileHandle, 0, len(f.handles))
+	for h := range f.handles {
+		handles = append(handles, h)
+	}
+	return handles
+}
+
+// writeAt sends a byte range of path to the server on behalf of owner. A
+// non-zero fence makes the server refuse the write once owner lost its lock.
+func (f *File) writeAt(ctx context.Context, path string, offset int64, r io.Reader, owner LockOwner, fence uint64) error {
+	writeURL := fmt.Sprintf("%s/writeat?path=%s&offset=%d&%s",
+		f.fs.baseURL, url.QueryEscape(path), offset, ownerQuery(owner))
+	if fence != 0 {
+		writeURL += fmt.Sprintf("&fence=%d", fence)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, writeURL, r)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/octet-stream")
+
+	httpResp, err := f.fs.client.Do(httpReq)
+	if err != nil {
+		return err
 	}
 	defer httpResp.Body.Close()
 
 	if httpResp.StatusCode != http.StatusOK {
-		return nil, syscall.EACCES
+		return errnoFromResponse(httpResp)
 	}
-
-	handle := &FileHandle{file: f, lockType: lockType}
-	return handle, nil
+	return nil
 }
 
 type FileHandle struct {
 	file     *File
 	lockType LockType
+	owner    LockOwner    // The opener the server holds the lock for
+	fence    uint64       // Fencing token of the lock, 0 without one
+	buffer   *WriteBuffer // Writes not yet sent to the server
+}
+
+// flush sends buffered writes to the server
+func (h *FileHandle) flush(ctx context.Context) error {
+	path := h.file.getPath()
+	return h.buffer.Flush(func(offset int64, r io.Reader) error {
+		return h.file.writeAt(ctx, path, offset, r, h.owner, h.fence)
+	})
+}
+
+func (h *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	if err := h.flush(ctx); err != nil {
+		return err
+	}
+
+	// Closing any descriptor of a file drops the POSIX locks its process holds on it
+	return h.file.releaseRanges(ctx, req.LockOwner, req.Header.Pid, false)
 }
 
 func (h *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	// The kernel ignores release errors, so anything still unflushed is only logged
+	if err := h.flush(ctx); err != nil {
+		log.Printf("Error flushing %s on release: %v", h.file.getPath(), err)
+	}
+	h.buffer.Close()
+
+	// The last close of an open file drops its flock locks
+	if req.ReleaseFlags&fuse.ReleaseFlockUnlock != 0 {
+		if err := h.file.releaseRanges(ctx, req.LockOwner, req.Header.Pid, true); err != nil {
+			log.Printf("Error releasing flock locks on %s: %v", h.file.getPath(), err)
+		}
+	}
+
+	h.file.mutex.Lock()
+	delete(h.file.handles, h)
+	h.file.mutex.Unlock()
+
 	// Release the lock
-	httpResp, err := h.file.fs.client.Post(fmt.Sprintf("%s/unlock?path=%s&pid=%d",
+	httpResp, err := h.file.fs.client.Post(fmt.Sprintf("%s/unlock?path=%s&%s",
 		h.file.fs.baseURL,
-		h.file.path,
-		os.Getpid()),
+		url.QueryEscape(h.file.getPath()),
+		ownerQuery(h.owner)),
 		"application/json",
 		nil)
 	if err != nil {
@@ -191,84 +970,194 @@ func (h *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) erro
 	return nil
 }
 
-func (h *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	content, err := h.file.ReadAll(ctx)
+// rangeURL builds a byte-range lock request for lock, held by the kernel's
+// lock owner on behalf of pid
+func (f *File) rangeURL(endpoint string, owner fuse.LockOwner, pid uint32, lock fuse.FileLock, flags fuse.LockFlags) string {
+	end := int64(rangeEOF)
+	if lock.End < rangeEOF {
+		end = int64(lock.End)
+	}
+	lockType := ReadLock
+	if lock.Type == fuse.LockWrite {
+		lockType = WriteLock
+	}
+	flock := 0
+	if flags&fuse.LockFlock != 0 {
+		flock = 1
+	}
+
+	return fmt.Sprintf("%s/%s?path=%s&start=%d&end=%d&type=%d&flock=%d&%s",
+		f.fs.baseURL, endpoint, url.QueryEscape(f.getPath()), lock.Start, end, lockType, flock,
+		ownerQuery(LockOwner{ClientID: f.fs.clientID, Pid: int(pid), HandleID: uint64(owner)}))
+}
+
+// lockRange takes a byte-range lock on the server
+func (f *File) lockRange(ctx context.Context, req *fuse.LockRequest, wait bool) error {
+	_, err := f.fs.pollLock(ctx, f.rangeURL("lockrange", req.LockOwner, req.Header.Pid, req.Lock, req.LockFlags), wait)
 	if err != nil {
 		return err
 	}
 
-	if req.Offset > int64(len(content)) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.rangeOwners == nil {
+		f.rangeOwners = make(map[rangeOwner]struct{})
+	}
+	f.rangeOwners[rangeOwner{req.LockOwner, req.LockFlags&fuse.LockFlock != 0}] = struct{}{}
+	return nil
+}
+
+// rangeOwner is a kernel lock owner that took POSIX or, with flock set, flock locks
+type rangeOwner struct {
+	owner fuse.LockOwner
+	flock bool
+}
+
+// releaseRanges drops every POSIX or flock lock owner holds on the file, if it took any
+func (f *File) releaseRanges(ctx context.Context, owner fuse.LockOwner, pid uint32, flock bool) error {
+	f.mutex.Lock()
+	_, held := f.rangeOwners[rangeOwner{owner, flock}]
+	delete(f.rangeOwners, rangeOwner{owner, flock})
+	f.mutex.Unlock()
+	if !held {
 		return nil
 	}
 
-	end := req.Offset + int64(req.Size)
-	if end > int64(len(content)) {
-		end = int64(len(content))
+	var flags fuse.LockFlags
+	if flock {
+		flags = fuse.LockFlock
 	}
+	whole := fuse.FileLock{Start: 0, End: rangeEOF, Type: fuse.LockUnlock}
+	return f.fs.post(ctx, f.rangeURL("unlockrange", owner, pid, whole, flags))
+}
 
-	resp.Data = content[req.Offset:end]
-	return nil
+// Lock takes an fcntl or flock lock, failing with EAGAIN if it conflicts
+func (h *FileHandle) Lock(ctx context.Context, req *fuse.LockRequest) error {
+	return h.file.lockRange(ctx, req, false)
 }
 
-func (h *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	// First read the entire file
-	content, err := h.file.ReadAll(ctx)
-	if err != nil && !os.IsNotExist(err) {
+// LockWait takes an fcntl or flock lock, waiting for conflicting locks to be released
+func (h *FileHandle) LockWait(ctx context.Context, req *fuse.LockWaitRequest) error {
+	return h.file.lockRange(ctx, (*fuse.LockRequest)(req), true)
+}
+
+// Unlock releases an fcntl or flock lock
+func (h *FileHandle) Unlock(ctx context.Context, req *fuse.UnlockRequest) error {
+	return h.file.fs.post(ctx, h.file.rangeURL("unlockrange", req.LockOwner, req.Header.Pid, req.Lock, req.LockFlags))
+}
+
+// QueryLock reports a lock that would block the requested one, for F_GETLK
+func (h *FileHandle) QueryLock(ctx context.Context, req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		h.file.rangeURL("queryrange", req.LockOwner, req.Header.Pid, req.Lock, req.LockFlags), nil)
+	if err != nil {
 		return err
 	}
 
-	// If the offset is beyond the current file size, pad with zeros
-	if req.Offset > int64(len(content)) {
-		newContent := make([]byte, req.Offset)
-		copy(newContent, content)
-		content = newContent
+	httpResp, err := h.file.fs.client.Do(httpReq)
+	if err != nil {
+		return err
 	}
+	defer httpResp.Body.Close()
 
-	// Ensure the slice is large enough to hold the write
-	writeEnd := req.Offset + int64(len(req.Data))
-	if writeEnd > int64(len(content)) {
-		newContent := make([]byte, writeEnd)
-		copy(newContent, content)
-		content = newContent
+	if httpResp.StatusCode != http.StatusOK {
+		return errnoFromResponse(httpResp)
 	}
 
-	// Copy the new data at the correct offset
-	copy(content[req.Offset:], req.Data)
+	var status RangeLockStatus
+	if err := json.NewDecoder(httpResp.Body).Decode(&status); err != nil {
+		return err
+	}
+	if !status.Locked {
+		// resp.Lock comes prefilled as unlocked
+		return nil
+	}
 
-	// Create FileInfo for the write request
-	fileInfo := FileInfo{
-		Content: content,
-		Mode:    h.file.info.Mode,
+	resp.Lock = fuse.FileLock{
+		Start: uint64(status.Lock.Start),
+		End:   uint64(status.Lock.End),
+		Type:  fuse.LockRead,
+		PID:   int32(status.Lock.Pid),
+	}
+	if status.Lock.Type == WriteLock {
+		resp.Lock.Type = fuse.LockWrite
 	}
+	return nil
+}
 
-	// Convert to JSON
-	data, err := json.Marshal(fileInfo)
+func (h *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+
+	n, err := h.readRemote(ctx, buf, req.Offset)
 	if err != nil {
 		return err
 	}
 
-	// Send write request to server
-	httpResp, err := h.file.fs.client.Post(
-		fmt.Sprintf("%s/write?path=%s", h.file.fs.baseURL, h.file.path),
-		"application/json",
-		bytes.NewReader(data),
-	)
+	// Buffered writes take precedence over what the server has
+	covered, err := h.buffer.Overlay(buf, req.Offset)
 	if err != nil {
 		return err
 	}
+
+	resp.Data = buf[:max(n, covered)]
+	return nil
+}
+
+// readRemote fetches a byte range from the server into buf
+func (h *FileHandle) readRemote(ctx context.Context, buf []byte, offset int64) (int, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("%s/readat?path=%s&%s",
+			h.file.fs.baseURL, url.QueryEscape(h.file.getPath()), ownerQuery(h.owner)), nil)
+	if err != nil {
+		return 0, err
+	}
+	// Only fetch the bytes the kernel asked for
+	httpReq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(buf))-1))
+
+	httpResp, err := h.file.fs.client.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
 	defer httpResp.Body.Close()
 
-	if httpResp.StatusCode != http.StatusOK {
-		return syscall.EIO
+	switch httpResp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// Server sent the whole file, skip to the requested offset
+		if _, err := io.CopyN(io.Discard, httpResp.Body, offset); err != nil {
+			return 0, nil
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Offset is at or beyond the end of the file
+		return 0, nil
+	default:
+		return 0, errnoFromResponse(httpResp)
+	}
+
+	n, err := io.ReadFull(httpResp.Body, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return n, err
+	}
+	return n, nil
+}
+
+func (h *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	// Writes are buffered and sent to the server on flush, fsync or release
+	if err := h.buffer.Write(req.Data, req.Offset); err != nil {
+		return err
 	}
 
 	resp.Size = len(req.Data)
-	h.file.info.Size = writeEnd
+	h.file.mutex.Lock()
+	if writeEnd := req.Offset + int64(len(req.Data)); writeEnd > h.file.info.Size {
+		h.file.info.Size = writeEnd
+	}
+	h.file.mutex.Unlock()
 	return nil
 }
 
 func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
-	path := filepath.Join(d.path, req.Name)
+	path := filepath.Join(d.getPath(), req.Name)
 
 	// Create empty file through API
 	fileInfo := FileInfo{
@@ -281,8 +1170,10 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 		return nil, nil, err
 	}
 
+	owner := d.fs.newOwner(req.Header.Pid)
+
 	httpResp, err := d.fs.client.Post(
-		fmt.Sprintf("%s/write?path=%s", d.fs.baseURL, path),
+		fmt.Sprintf("%s/write?path=%s&%s", d.fs.baseURL, url.QueryEscape(path), ownerQuery(owner)),
 		"application/json",
 		bytes.NewReader(data),
 	)
@@ -305,21 +1196,16 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 			ModTime: time.Now(),
 		},
 	}
+	d.fs.track(f)
 
-	// Create the handle with appropriate lock type
-	var lockType LockType
-	if req.Flags.IsReadOnly() {
-		lockType = ReadLock
-	} else if req.Flags.IsWriteOnly() {
-		lockType = WriteLock
-	} else if req.Flags.IsReadWrite() {
-		lockType = ExclusiveLock
+	// Lock the new file for the creating process like any other open
+	lockType := lockTypeForFlags(req.Flags)
+	fence, err := f.lock(ctx, lockType, owner, req.Flags&fuse.OpenNonblock == 0)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	h := &FileHandle{
-		file:     f,
-		lockType: lockType,
-	}
+	h := f.newHandle(lockType, owner, fence)
 
 	// Set proper response flags for write access
 	resp.OpenResponse.Flags = fuse.OpenResponseFlags(req.Flags)
@@ -327,74 +1213,31 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 	return f, h, nil
 }
 
-func (f *File) SetAttr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
-	if req.Valid.Mode() {
-		// Create FileInfo with new mode
-		fileInfo := FileInfo{
-			Mode: req.Mode,
-		}
-
-		data, err := json.Marshal(fileInfo)
-		if err != nil {
-			return err
-		}
-
-		// Send mode update to server
-		httpResp, err := f.fs.client.Post(
-			fmt.Sprintf("%s/write?path=%s", f.fs.baseURL, f.path),
-			"application/json",
-			bytes.NewReader(data),
-		)
-		if err != nil {
-			return err
-		}
-		defer httpResp.Body.Close()
-
-		if httpResp.StatusCode != http.StatusOK {
-			return syscall.EIO
-		}
-
-		f.info.Mode = req.Mode
+// Setattr changes the mode, owner, timestamps or size of the file, for
+// chmod, chown, utimensat and truncate
+func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if err := f.fs.setattr(ctx, f.getPath(), req); err != nil {
+		return err
 	}
 
 	if req.Valid.Size() {
 		// Handle truncate - convert uint64 to int64
 		size := int64(req.Size) // explicit conversion
-		fileInfo := FileInfo{
-			Content: make([]byte, size),
-			Mode:    f.info.Mode,
-		}
 
-		data, err := json.Marshal(fileInfo)
-		if err != nil {
+		// Buffered writes must reach the server before the size changes
+		if err := f.flushHandles(ctx); err != nil {
 			return err
 		}
 
-		httpResp, err := f.fs.client.Post(
-			fmt.Sprintf("%s/write?path=%s", f.fs.baseURL, f.path),
-			"application/json",
-			bytes.NewReader(data),
-		)
-		if err != nil {
+		// An ftruncate by a process with the file open uses that open's lock
+		owner := f.ownerForPid(req.Header.Pid)
+		if err := f.fs.post(ctx, fmt.Sprintf("%s/truncate?path=%s&size=%d&%s",
+			f.fs.baseURL, url.QueryEscape(f.getPath()), size, ownerQuery(owner))); err != nil {
 			return err
 		}
-		defer httpResp.Body.Close()
-
-		if httpResp.StatusCode != http.StatusOK {
-			return syscall.EIO
-		}
 
-		f.info.Size = size
 	}
 
 	// Update response attributes
-	resp.Attr = fuse.Attr{
-		Mode:  f.info.Mode,
-		Size:  uint64(f.info.Size),
-		Mtime: f.info.ModTime,
-		Uid:   uint32(os.Getuid()),
-		Gid:   uint32(os.Getgid()),
-	}
-
-	return nil
+	return f.Attr(ctx, &resp.Attr)
 }
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/sys/unix"
+)
+
+// newTestMount serves a local filesystem rooted in a temporary directory and
+// returns the mount's view of it together with that directory
+func newTestMount(t *testing.T) (*FS, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	local, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleMain,
+		Features: FileSystemFeatures{CanUpdate: true, CanDelete: true, CanLock: true},
+		RootPath: root,
+		LockTTL:  defaultLockTTL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(newFileServerMux(local, ""))
+	t.Cleanup(server.Close)
+	return &FS{client: server.Client(), baseURL: server.URL, clientID: "test"}, root
+}
+
+// lookupFile returns the mount's node for the file name in the root directory
+func lookupFile(t *testing.T, mount *FS, name string) *File {
+	t.Helper()
+
+	root, err := mount.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := root.(*Dir).Lookup(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, ok := node.(*File)
+	if !ok {
+		t.Fatalf("%s is a %T, not a file", name, node)
+	}
+	return f
+}
+
+func TestFileSetattrTruncates(t *testing.T) {
+	mount, root := newTestMount(t)
+	if err := os.WriteFile(filepath.Join(root, "f"), []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The kernel only calls files that implement fs.NodeSetattrer
+	var node fs.NodeSetattrer = lookupFile(t, mount, "f")
+	req := &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 5}
+	var resp fuse.SetattrResponse
+	if err := node.Setattr(context.Background(), req, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(root, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello" {
+		t.Errorf("content after truncate = %q, want %q", content, "hello")
+	}
+	if resp.Attr.Size != 5 {
+		t.Errorf("reported size = %d, want 5", resp.Attr.Size)
+	}
+}
+
+func TestFileSetattrChangesModeAndMtime(t *testing.T) {
+	mount, root := newTestMount(t)
+	if err := os.WriteFile(filepath.Join(root, "f"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var node fs.NodeSetattrer = lookupFile(t, mount, "f")
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	req := &fuse.SetattrRequest{
+		Valid: fuse.SetattrMode | fuse.SetattrMtime,
+		Mode:  0600,
+		Mtime: mtime,
+	}
+	var resp fuse.SetattrResponse
+	if err := node.Setattr(context.Background(), req, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(root, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("mtime = %v, want %v", info.ModTime(), mtime)
+	}
+	if resp.Attr.Mode.Perm() != 0600 || !resp.Attr.Mtime.Equal(mtime) {
+		t.Errorf("reported mode %v and mtime %v, want 0600 and %v", resp.Attr.Mode, resp.Attr.Mtime, mtime)
+	}
+}
+
+func TestPathsWithSpecialCharacters(t *testing.T) {
+	mount, root := newTestMount(t)
+	name := "a&b=c#d%e+f g"
+	if err := os.WriteFile(filepath.Join(root, name), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	rootNode, err := mount.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := rootNode.(*Dir)
+	lookupFile(t, mount, name)
+
+	sub, err := dir.Mkdir(ctx, &fuse.MkdirRequest{Name: "c++", Mode: os.ModeDir | 0755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Rename(ctx, &fuse.RenameRequest{OldName: name, NewName: "x+y%z"}, sub); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(root, "c++", "x+y%z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "data" {
+		t.Errorf("content = %q, want %q", content, "data")
+	}
+}
+
+func TestOpenReadPromotesPastTheOpenLock(t *testing.T) {
+	// The cache takes the locks, like in the default configuration
+	cache, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleCache,
+		MaxSize:  1 << 30,
+		Features: FileSystemFeatures{CanUpdate: true, CanDelete: true, CanLock: true},
+		RootPath: t.TempDir(),
+		LockTTL:  defaultLockTTL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	main, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleMain,
+		Features: FileSystemFeatures{CanUpdate: true, CanDelete: true},
+		RootPath: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := main.Write("/f", []byte("hello"), 0644, LockOwner{}); err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChainFS([]ServerFS{cache, main}, nil)
+	t.Cleanup(chain.background.Wait)
+	server := httptest.NewServer(newFileServerMux(chain, ""))
+	t.Cleanup(server.Close)
+	mount := &FS{client: server.Client(), baseURL: server.URL, clientID: "test"}
+
+	// The open holds a read lock on the file while it is read
+	ctx := context.Background()
+	open := &fuse.OpenRequest{Header: fuse.Header{Pid: 42}, Flags: fuse.OpenReadOnly}
+	handle, err := lookupFile(t, mount, "f").Open(ctx, open, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp fuse.ReadResponse
+	if err := handle.(*FileHandle).Read(ctx, &fuse.ReadRequest{Offset: 0, Size: 5}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Data) != "hello" {
+		t.Fatalf("read %q, want %q", resp.Data, "hello")
+	}
+	chain.background.Wait()
+
+	if content, err := cache.Read("/f"); err != nil || string(content) != "hello" {
+		t.Errorf("cache has %q, %v, want the promoted file", content, err)
+	}
+	if stats := chain.PromotionStats(); stats.Failed != 0 {
+		t.Errorf("%d promotions failed", stats.Failed)
+	}
+	if err := handle.(*FileHandle).Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClosingAFileReleasesItsRangeLocks(t *testing.T) {
+	mount, root := newTestMount(t)
+	if err := os.WriteFile(filepath.Join(root, "f"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	open := &fuse.OpenRequest{Header: fuse.Header{Pid: 42}, Flags: fuse.OpenReadOnly}
+	node, err := lookupFile(t, mount, "f").Open(ctx, open, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := node.(*FileHandle)
+
+	lock := func(pid uint32, owner fuse.LockOwner, flags fuse.LockFlags) error {
+		return handle.Lock(ctx, &fuse.LockRequest{
+			Header:    fuse.Header{Pid: pid},
+			LockOwner: owner,
+			Lock:      fuse.FileLock{Start: 0, End: 9, Type: fuse.LockWrite},
+			LockFlags: flags,
+		})
+	}
+	if err := lock(42, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock(43, 2, 0); err != syscall.EAGAIN {
+		t.Fatalf("conflicting fcntl lock = %v, want EAGAIN", err)
+	}
+	if err := lock(42, 1, fuse.LockFlock); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing any descriptor drops the process's fcntl locks but not its flock
+	flush := &fuse.FlushRequest{Header: fuse.Header{Pid: 42}, LockOwner: 1}
+	if err := handle.Flush(ctx, flush); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock(43, 2, 0); err != nil {
+		t.Errorf("fcntl lock after the close: %v", err)
+	}
+	if err := lock(43, 2, fuse.LockFlock); err != syscall.EAGAIN {
+		t.Errorf("conflicting flock after the close = %v, want EAGAIN", err)
+	}
+
+	// The last close drops the flock
+	release := &fuse.ReleaseRequest{Header: fuse.Header{Pid: 42}, LockOwner: 1, ReleaseFlags: fuse.ReleaseFlockUnlock}
+	if err := handle.Release(ctx, release); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock(43, 2, fuse.LockFlock); err != nil {
+		t.Errorf("flock after the last close: %v", err)
+	}
+}
+
+func TestHeartbeatKeepsOpenFilesLocked(t *testing.T) {
+	const ttl = 150 * time.Millisecond
+	root := t.TempDir()
+	local, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleMain,
+		Features: FileSystemFeatures{CanUpdate: true, CanDelete: true, CanLock: true},
+		RootPath: root,
+		LockTTL:  ttl,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newFileServerMux(local, ""))
+	t.Cleanup(server.Close)
+	mount := &FS{client: server.Client(), baseURL: server.URL, clientID: "test"}
+	if err := os.WriteFile(filepath.Join(root, "f"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	open := &fuse.OpenRequest{Header: fuse.Header{Pid: 42}, Flags: fuse.OpenWriteOnly}
+	if _, err := lookupFile(t, mount, "f").Open(ctx, open, &fuse.OpenResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	other := LockOwner{ClientID: "other", Pid: 7, HandleID: 1}
+
+	done := make(chan struct{})
+	go mount.heartbeat(ttl/5, done)
+	time.Sleep(3 * ttl)
+	if _, err := local.Lock(ctx, "/f", WriteLock, other, LockOptions{}); !errors.Is(err, ErrAlreadyLocked) {
+		t.Fatalf("lock on a file kept open = %v, want %v", err, ErrAlreadyLocked)
+	}
+
+	// Once the heartbeats stop, as when the client dies, the lock is given up
+	close(done)
+	time.Sleep(3 * ttl)
+	if _, err := local.Lock(ctx, "/f", WriteLock, other, LockOptions{}); err != nil {
+		t.Errorf("lock after the heartbeats stopped: %v", err)
+	}
+}
+
+func TestXattrRoundTrips(t *testing.T) {
+	mount, root := newTestMount(t)
+	if err := os.WriteFile(filepath.Join(root, "f"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(filepath.Join(root, "f"), "user.probe", []byte("x"), 0); err != nil {
+		t.Skipf("no user xattrs in the temporary directory: %v", err)
+	}
+	if err := unix.Removexattr(filepath.Join(root, "f"), "user.probe"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	f := lookupFile(t, mount, "f")
+	get := func(size uint32) ([]byte, error) {
+		var resp fuse.GetxattrResponse
+		err := f.Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.a", Size: size}, &resp)
+		return resp.Xattr, err
+	}
+	set := func(value string, flags uint32) error {
+		return f.Setxattr(ctx, &fuse.SetxattrRequest{Name: "user.a", Xattr: []byte(value), Flags: flags})
+	}
+
+	if _, err := get(0); err != syscall.ENODATA {
+		t.Errorf("Getxattr of a missing attribute = %v, want ENODATA", err)
+	}
+	if err := set("value", unix.XATTR_REPLACE); err != syscall.ENODATA {
+		t.Errorf("replacing a missing attribute = %v, want ENODATA", err)
+	}
+
+	if err := set("value", unix.XATTR_CREATE); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := get(0); err != nil || string(value) != "value" {
+		t.Errorf("Getxattr = %q, %v, want %q", value, err, "value")
+	}
+	// The whole value comes back to a buffer too small for it, which the
+	// FUSE server answers with ERANGE
+	if value, err := get(2); err != nil || len(value) <= 2 {
+		t.Errorf("Getxattr into 2 bytes = %q, %v, want the whole value", value, err)
+	}
+	if err := set("other", unix.XATTR_CREATE); err != syscall.EEXIST {
+		t.Errorf("creating an existing attribute = %v, want EEXIST", err)
+	}
+	if err := set("other", unix.XATTR_REPLACE); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := get(0); err != nil || string(value) != "other" {
+		t.Errorf("Getxattr after replacing = %q, %v, want %q", value, err, "other")
+	}
+
+	var list fuse.ListxattrResponse
+	if err := f.Listxattr(ctx, &fuse.ListxattrRequest{}, &list); err != nil {
+		t.Fatal(err)
+	}
+	if string(list.Xattr) != "user.a\x00" {
+		t.Errorf("Listxattr = %q, want %q", list.Xattr, "user.a\x00")
+	}
+
+	remove := &fuse.RemovexattrRequest{Name: "user.a"}
+	if err := f.Removexattr(ctx, remove); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(0); err != syscall.ENODATA {
+		t.Errorf("Getxattr after removing = %v, want ENODATA", err)
+	}
+	if err := f.Removexattr(ctx, remove); err != syscall.ENODATA {
+		t.Errorf("removing a missing attribute = %v, want ENODATA", err)
+	}
+}
+
+func TestDirectoriesAndSymlinksThroughTheMount(t *testing.T) {
+	mount, root := newTestMount(t)
+	if err := os.WriteFile(filepath.Join(root, "f"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	node, err := mount.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootDir := node.(*Dir)
+
+	mkdir := &fuse.MkdirRequest{Name: "sub", Mode: os.ModeDir | 0777, Umask: 0027}
+	node, err = rootDir.Mkdir(ctx, mkdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := node.(*Dir)
+	if info, err := os.Stat(filepath.Join(root, "sub")); err != nil || !info.IsDir() || info.Mode().Perm() != 0750 {
+		t.Fatalf("mkdir made %v, %v, want a directory with mode 0750", info, err)
+	}
+	if _, err := rootDir.Mkdir(ctx, mkdir); err != syscall.EEXIST {
+		t.Errorf("mkdir of an existing directory = %v, want EEXIST", err)
+	}
+
+	if _, err := sub.Symlink(ctx, &fuse.SymlinkRequest{NewName: "link", Target: "../f"}); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(filepath.Join(root, "sub", "link")); err != nil || target != "../f" {
+		t.Errorf("symlink points to %q, %v, want %q", target, err, "../f")
+	}
+	node, err = sub.Lookup(ctx, "link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, ok := node.(*Symlink)
+	if !ok {
+		t.Fatalf("link is a %T, not a symlink", node)
+	}
+	if target, err := link.Readlink(ctx, &fuse.ReadlinkRequest{}); err != nil || target != "../f" {
+		t.Errorf("Readlink = %q, %v, want %q", target, err, "../f")
+	}
+	entries, err := sub.ReadDirAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "link" || entries[0].Type != fuse.DT_Link {
+		t.Errorf("sub lists %+v, want just the link", entries)
+	}
+
+	// rmdir and unlink refuse the wrong kind of entry
+	if err := rootDir.Remove(ctx, &fuse.RemoveRequest{Name: "sub", Dir: true}); err != syscall.ENOTEMPTY {
+		t.Errorf("rmdir of a directory with a link in it = %v, want ENOTEMPTY", err)
+	}
+	if err := rootDir.Remove(ctx, &fuse.RemoveRequest{Name: "sub"}); err != syscall.EISDIR {
+		t.Errorf("unlink of a directory = %v, want EISDIR", err)
+	}
+	if err := rootDir.Remove(ctx, &fuse.RemoveRequest{Name: "f", Dir: true}); err != syscall.ENOTDIR {
+		t.Errorf("rmdir of a file = %v, want ENOTDIR", err)
+	}
+
+	if err := sub.Remove(ctx, &fuse.RemoveRequest{Name: "link"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "f")); err != nil {
+		t.Errorf("removing the link removed its target: %v", err)
+	}
+	if err := rootDir.Remove(ctx, &fuse.RemoveRequest{Name: "sub", Dir: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "sub")); !os.IsNotExist(err) {
+		t.Errorf("sub still exists after rmdir: %v", err)
+	}
+	if err := rootDir.Remove(ctx, &fuse.RemoveRequest{Name: "sub", Dir: true}); err != syscall.ENOENT {
+		t.Errorf("rmdir of a missing directory = %v, want ENOENT", err)
+	}
+}
+
+func TestHandleWritesReachTheServerOnFsyncAndFlush(t *testing.T) {
+	mount, root := newTestMount(t)
+	path := filepath.Join(root, "f")
+	if err := os.WriteFile(path, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	f := lookupFile(t, mount, "f")
+	open := &fuse.OpenRequest{Header: fuse.Header{Pid: 42}, Flags: fuse.OpenReadWrite}
+	node, err := f.Open(ctx, open, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := node.(*FileHandle)
+	onDisk := func() string {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	write := func(data string, offset int64) {
+		t.Helper()
+		var resp fuse.WriteResponse
+		if err := handle.Write(ctx, &fuse.WriteRequest{Data: []byte(data), Offset: offset}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Size != len(data) {
+			t.Fatalf("wrote %d bytes, want %d", resp.Size, len(data))
+		}
+	}
+	write("ab", 2)
+	write("cd", 12)
+	if got := onDisk(); got != "0123456789" {
+		t.Errorf("the server has %q before any flush", got)
+	}
+
+	// The handle reads its own writes
+	var read fuse.ReadResponse
+	if err := handle.Read(ctx, &fuse.ReadRequest{Offset: 0, Size: 14}, &read); err != nil {
+		t.Fatal(err)
+	}
+	if string(read.Data) != "01ab456789\x00\x00cd" {
+		t.Errorf("read %q through the handle", read.Data)
+	}
+
+	// An appending write joins the range it continues
+	write("ef", 14)
+
+	if err := f.Fsync(ctx, &fuse.FsyncRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := onDisk(); got != "01ab456789\x00\x00cdef" {
+		t.Errorf("the server has %q after fsync", got)
+	}
+
+	write("ZZ", 0)
+	if err := handle.Flush(ctx, &fuse.FlushRequest{Header: fuse.Header{Pid: 42}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := onDisk(); got != "ZZab456789\x00\x00cdef" {
+		t.Errorf("the server has %q after close", got)
+	}
+	if err := handle.Release(ctx, &fuse.ReleaseRequest{Header: fuse.Header{Pid: 42}}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,7 +4,6 @@ go 1.23.2
 
 require (
 	bazil.org/fuse v0.0.0-20230120002735-62a210ff1fd5
+	golang.org/x/sys v0.4.0
 	gopkg.in/yaml.v3 v3.0.1
 )
-
-require golang.org/x/sys v0.4.0 // indirect
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// maxContentionStats bounds the number of paths contention is tracked for;
+// the path contended least recently is dropped to make room
+const maxContentionStats = 4096
+
+// LockContention is the contention seen on one path
+type LockContention struct {
+	Path       string
+	Holders    int           // Owners holding the lock now
+	Waiters    int           // Requests queued now
+	MaxWaiters int           // Longest queue seen
+	Contended  uint64        // Requests that found the lock taken
+	Timeouts   uint64        // Waits given up before the lock was granted
+	Deadlocks  uint64        // Waits refused because they would have deadlocked
+	TotalWait  time.Duration // Time spent queued by requests that finished waiting
+	MaxWait    time.Duration // Longest single wait
+	LastSeen   time.Time     // When the lock was last contended
+}
+
+// WaitForEdge is a queued request and the processes it waits for
+type WaitForEdge struct {
+	Waiter     LockOwner
+	Path       string
+	LockType   LockType
+	Since      time.Time
+	WaitingFor []LockOwner // Processes (client and pid) holding or queued ahead for a conflicting lock
+}
+
+// LockDebugInfo is the response body of the /debug/locks endpoint
+type LockDebugInfo struct {
+	Contention []LockContention // Most waited-on paths first
+	WaitFor    []WaitForEdge    // The current wait-for graph
+	Deadlocks  uint64           // Waits refused because they would have deadlocked
+}
+
+// process identifies the process behind owner, which is what waits for a
+// lock: one process holds and requests locks through many handles. An owner
+// without a pid is a process of its own.
+func (o LockOwner) process() LockOwner {
+	if o.Pid == 0 {
+		return o
+	}
+	return LockOwner{ClientID: o.ClientID, Pid: o.Pid}
+}
+
+// blockers returns the processes a request by owner for a lockType lock on
+// path has to wait for: holders of conflicting locks on path, on the
+// directories locked recursively above it or, for a recursive request, below
+// it, and the requests queued ahead of it. The caller must hold t.mutex.
+func (t *LockTable) blockers(path string, lockType LockType, owner LockOwner, recursive bool, ahead []*lockWaiter) []LockOwner {
+	seen := make(map[LockOwner]bool)
+	var blockers []LockOwner
+	add := func(holder LockOwner) {
+		if p := holder.process(); p != owner.process() && !seen[p] {
+			seen[p] = true
+			blockers = append(blockers, p)
+		}
+	}
+
+	if lock, exists := t.locks[path]; exists && !compatible(lock.LockType, lockType) {
+		for holder := range lock.Holders {
+			add(holder)
+		}
+	}
+	for _, dir := range ancestors(path) {
+		if lock, exists := t.locks[dir]; exists && !compatible(lock.LockType, lockType) {
+			for holder, lease := range lock.Holders {
+				if lease.Recursive {
+					add(holder)
+				}
+			}
+		}
+	}
+	if recursive {
+		for below := range t.intents[path] {
+			if lock := t.locks[below]; !compatible(lock.LockType, lockType) {
+				for holder := range lock.Holders {
+					add(holder)
+				}
+			}
+		}
+	}
+	for _, w := range ahead {
+		add(w.owner)
+	}
+	return blockers
+}
+
+// checkDeadlock follows the wait-for graph from the processes a new request
+// would wait for. If it leads back to the requesting process, waiting could
+// never end and the request fails with ErrDeadlock. The caller must hold
+// t.mutex.
+func (t *LockTable) checkDeadlock(path string, lockType LockType, owner LockOwner, recursive bool) error {
+	waiting := make(map[LockOwner][]*lockWaiter)
+	ahead := make(map[*lockWaiter][]*lockWaiter)
+	for _, queue := range t.waiters {
+		for i, w := range queue {
+			waiting[w.owner.process()] = append(waiting[w.owner.process()], w)
+			ahead[w] = queue[:i]
+		}
+	}
+
+	self := owner.process()
+	visited := make(map[LockOwner]bool)
+	stack := t.blockers(path, lockType, owner, recursive, t.waiters[path])
+	if len(stack) == 0 && len(t.waiters[path]) == 0 {
+		// Nothing but the requesting process's own locks is in the way
+		return fmt.Errorf("waiting for %s would deadlock: pid %d on %s would wait for itself: %w",
+			path, owner.Pid, owner.ClientID, ErrDeadlock)
+	}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if visited[p] {
+			continue
+		}
+		visited[p] = true
+
+		for _, w := range waiting[p] {
+			for _, blocker := range t.blockers(w.path, w.lockType, w.owner, w.recursive, ahead[w]) {
+				if blocker == self {
+					return fmt.Errorf("waiting for %s would deadlock: pid %d on %s is waiting for %s: %w",
+						path, p.Pid, p.ClientID, w.path, ErrDeadlock)
+				}
+				stack = append(stack, blocker)
+			}
+		}
+	}
+	return nil
+}
+
+// contention returns the statistics of path, creating them on first use.
+// The caller must hold t.mutex.
+func (t *LockTable) contention(path string, now time.Time) *LockContention {
+	if stats, exists := t.stats[path]; exists {
+		stats.LastSeen = now
+		return stats
+	}
+
+	if len(t.stats) >= maxContentionStats {
+		var oldest *LockContention
+		for _, stats := range t.stats {
+			if oldest == nil || stats.LastSeen.Before(oldest.LastSeen) {
+				oldest = stats
+			}
+		}
+		delete(t.stats, oldest.Path)
+	}
+
+	stats := &LockContention{Path: path, LastSeen: now}
+	t.stats[path] = stats
+	return stats
+}
+
+// recordWait adds a finished wait for path to its statistics. The caller
+// must hold t.mutex.
+func (t *LockTable) recordWait(path string, since, now time.Time) {
+	stats := t.contention(path, now)
+	wait := now.Sub(since)
+	stats.TotalWait += wait
+	stats.MaxWait = max(stats.MaxWait, wait)
+}
+
+// Debug returns the contention statistics and the current wait-for graph
+func (t *LockTable) Debug() LockDebugInfo {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	info := LockDebugInfo{Deadlocks: t.deadlocks}
+	for path, stats := range t.stats {
+		snapshot := *stats
+		snapshot.Waiters = len(t.waiters[path])
+		if lock, exists := t.locks[path]; exists {
+			snapshot.Holders = len(lock.Holders)
+		}
+		info.Contention = append(info.Contention, snapshot)
+	}
+	sort.Slice(info.Contention, func(i, j int) bool {
+		return info.Contention[i].TotalWait > info.Contention[j].TotalWait
+	})
+
+	for _, queue := range t.waiters {
+		for i, w := range queue {
+			info.WaitFor = append(info.WaitFor, WaitForEdge{
+				Waiter:     w.owner,
+				Path:       w.path,
+				LockType:   w.lockType,
+				Since:      w.since,
+				WaitingFor: t.blockers(w.path, w.lockType, w.owner, w.recursive, queue[:i]),
+			})
+		}
+	}
+	sort.Slice(info.WaitFor, func(i, j int) bool {
+		return info.WaitFor[i].Since.Before(info.WaitFor[j].Since)
+	})
+	return info
+}
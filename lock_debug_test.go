@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeadlockBetweenOwnersWithoutPid(t *testing.T) {
+	table := NewLockTable(0)
+	a := LockOwner{ClientID: "api", HandleID: 1}
+	b := LockOwner{ClientID: "api", HandleID: 2}
+
+	for owner, path := range map[LockOwner]string{a: "/x", b: "/y"} {
+		if _, err := table.Acquire(context.Background(), path, WriteLock, owner, LockOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go table.Acquire(ctx, "/y", WriteLock, a, LockOptions{Wait: true})
+	for table.Status("/y").Waiters == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), time.Second)
+	defer waitCancel()
+	if _, err := table.Acquire(waitCtx, "/x", WriteLock, b, LockOptions{Wait: true}); !errors.Is(err, ErrDeadlock) {
+		t.Errorf("closing the cycle: %v, want ErrDeadlock", err)
+	}
+}
+
+func TestWaitForOwnProcessIsADeadlock(t *testing.T) {
+	table := NewLockTable(0)
+	holder := LockOwner{ClientID: "c", Pid: 1, HandleID: 1}
+	table.locks["/f"] = &FileLock{
+		Path:     "/f",
+		LockType: ExclusiveLock,
+		Holders:  map[LockOwner]LockLease{holder: {LockType: ExclusiveLock}},
+	}
+
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	err := table.checkDeadlock("/f", ExclusiveLock, LockOwner{ClientID: "c", Pid: 1, HandleID: 2}, false)
+	if !errors.Is(err, ErrDeadlock) {
+		t.Errorf("waiting only for the own process: %v, want ErrDeadlock", err)
+	}
+}
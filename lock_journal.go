@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// lockJournalName is the file under a filesystem's root that persists its
+// locks. It is hidden from listings.
+const lockJournalName = ".go-sync-fs-locks.journal"
+
+// journalCompactAfter is the number of records appended before the journal is
+// rewritten to hold only the current locks
+const journalCompactAfter = 10000
+
+// Kinds of lock a journal record describes
+const (
+	journalFileLock  = "file"
+	journalRangeLock = "range"
+)
+
+// journalHolder is one holder of a whole-file lock
+type journalHolder struct {
+	Owner     LockOwner
+	Acquired  time.Time
+	Expires   time.Time
+	Token     uint64
+	Recursive bool `json:",omitempty"`
+}
+
+// journalRecord is the complete state of one kind of lock on a path after a
+// change. A record without holders or ranges means the path is unlocked.
+type journalRecord struct {
+	Kind     string
+	Path     string
+	LockType LockType        `json:",omitempty"`
+	Holders  []journalHolder `json:",omitempty"`
+	Ranges   []RangeLock     `json:",omitempty"`
+}
+
+func (r journalRecord) key() string {
+	return r.Kind + ":" + r.Path
+}
+
+func (r journalRecord) empty() bool {
+	return len(r.Holders) == 0 && len(r.Ranges) == 0
+}
+
+// expire drops the holders and ranges whose lease lapsed before now
+func (r journalRecord) expire(now time.Time) journalRecord {
+	var holders []journalHolder
+	for _, h := range r.Holders {
+		if h.Expires.IsZero() || !now.After(h.Expires) {
+			holders = append(holders, h)
+		}
+	}
+	var ranges []RangeLock
+	for _, l := range r.Ranges {
+		if l.Expires.IsZero() || !now.After(l.Expires) {
+			ranges = append(ranges, l)
+		}
+	}
+	r.Holders, r.Ranges = holders, ranges
+	return r
+}
+
+// lockJournal is an append-only JSON-lines log of lock changes. Replaying it
+// gives the locks that were held when the server stopped.
+//
+// Lock tables stage records while they hold their own mutex, which keeps the
+// records of a path in order, and sync them after letting go of it. Records
+// staged by concurrent requests share one write and fsync.
+type lockJournal struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	state   map[string]journalRecord // Latest non-empty record per kind and path
+	appends int                      // Records appended since the last compaction
+	pending []journalRecord          // Staged records not written yet, in order
+	staged  uint64                   // Number of records staged so far
+	synced  uint64                   // Number of staged records written and synced
+
+	writeMutex sync.Mutex // Held while pending records are written
+}
+
+// openLockJournal replays the journal at path, dropping leases that expired
+// while the server was down, and compacts it to the surviving locks
+func openLockJournal(path string) (*lockJournal, error) {
+	j := &lockJournal{
+		path:  path,
+		state: make(map[string]journalRecord),
+	}
+
+	if err := j.replay(time.Now()); err != nil {
+		return nil, err
+	}
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// replay loads the latest record of every lock from the journal file
+func (j *lockJournal) replay(now time.Time) error {
+	file, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var record journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A crash can leave a torn last line; everything before it is still good
+			log.Printf("Skipping unreadable lock journal record %s:%d: %v", j.path, line, err)
+			continue
+		}
+		j.apply(record)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for key, record := range j.state {
+		record = record.expire(now)
+		if record.empty() {
+			delete(j.state, key)
+			continue
+		}
+		j.state[key] = record
+	}
+	return nil
+}
+
+func (j *lockJournal) apply(record journalRecord) {
+	if record.empty() {
+		delete(j.state, record.key())
+	} else {
+		j.state[record.key()] = record
+	}
+}
+
+// records returns the current locks of the given kind
+func (j *lockJournal) records(kind string) []journalRecord {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	var records []journalRecord
+	for _, record := range j.state {
+		if record.Kind == kind {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// Stage queues the new state of a lock for the journal without writing it;
+// Sync does that
+func (j *lockJournal) Stage(record journalRecord) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.apply(record)
+	j.pending = append(j.pending, record)
+	j.staged++
+}
+
+// Sync writes and fsyncs every record staged so far, together with any staged
+// meanwhile by others. Failures are logged rather than returned: the locks
+// themselves are still held in memory.
+func (j *lockJournal) Sync() {
+	j.mutex.Lock()
+	target := j.staged
+	done := j.synced >= target
+	j.mutex.Unlock()
+	if done {
+		return
+	}
+
+	j.writeMutex.Lock()
+	defer j.writeMutex.Unlock()
+
+	j.mutex.Lock()
+	if j.synced >= target {
+		// Written by the request that held writeMutex before
+		j.mutex.Unlock()
+		return
+	}
+	records, staged := j.pending, j.staged
+	j.pending = nil
+	j.mutex.Unlock()
+
+	w := bufio.NewWriter(j.file)
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			log.Printf("Error encoding lock journal record for %s: %v", record.Path, err)
+			continue
+		}
+		w.Write(append(data, '\n'))
+	}
+	err := w.Flush()
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		log.Printf("Error writing lock journal %s: %v", j.path, err)
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.synced = staged
+	j.appends += len(records)
+	if j.appends >= journalCompactAfter {
+		if err := j.compact(); err != nil {
+			log.Printf("Error compacting lock journal %s: %v", j.path, err)
+		}
+	}
+}
+
+// compact atomically rewrites the journal to hold one record per current
+// lock and reopens it for appending. The caller must hold j.mutex and
+// j.writeMutex, or be the only user of j.
+func (j *lockJournal) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), lockJournalName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, record := range j.state {
+		data, err := json.Marshal(record)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(data, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		return fmt.Errorf("error replacing lock journal: %v", err)
+	}
+
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = file
+	j.appends = 0
+	return nil
+}
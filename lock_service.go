@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// LockService grants and tracks file and byte-range locks. Every ServerFS is
+// one for its own files; a RemoteLockService forwards to the lock coordinator
+// of a cluster so that servers sharing a main store agree on who holds what.
+type LockService interface {
+	// Lock returns the fencing token of owner's lease
+	Lock(ctx context.Context, path string, lockType LockType, owner LockOwner, opts LockOptions) (uint64, error)
+	Unlock(path string, owner LockOwner) error
+	Renew(path string, owner LockOwner) error
+	IsLocked(path string) (LockStatus, error)
+
+	// Byte-range (fcntl and flock) lock operations
+	LockRange(ctx context.Context, path string, lock RangeLock, opts LockOptions) error
+	UnlockRange(path string, lock RangeLock) error
+	QueryRange(path string, lock RangeLock) (RangeLock, bool, error)
+
+	// Lock administration
+	ListLocks(prefix string) ([]LockInfo, error)
+	ForceUnlock(path string) error
+	LockDebug() (LockDebugInfo, error)
+}
+
+// LockGrant is the response body of the /lock endpoint
+type LockGrant struct {
+	Token uint64 // Fencing token; pass it back as the fence parameter of writes
+}
+
+// remotePollTimeout bounds a single long-poll to the coordinator; it has to
+// stay below the HTTP client timeout
+const remotePollTimeout = 20 * time.Second
+
+// RemoteLockService is a LockService that forwards every call to the lock
+// coordinator's HTTP API
+type RemoteLockService struct {
+	client     *http.Client
+	baseURL    string
+	adminToken string // Sent with ForceUnlock
+}
+
+// NewRemoteLockService creates a lock service backed by the server at baseURL
+func NewRemoteLockService(baseURL, adminToken string) *RemoteLockService {
+	return &RemoteLockService{
+		client:     &http.Client{Timeout: 30 * time.Second},
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		adminToken: adminToken,
+	}
+}
+
+// Lock takes a lock on the coordinator, long-polling it while opts.Wait is
+// set until the lock is granted or ctx is done
+func (s *RemoteLockService) Lock(ctx context.Context, path string, lockType LockType, owner LockOwner, opts LockOptions) (uint64, error) {
+	lockURL := fmt.Sprintf("%s/lock?path=%s&type=%d&%s", s.baseURL, url.QueryEscape(path), lockType, ownerQuery(owner))
+	if opts.Recursive {
+		lockURL += "&recursive=1"
+	}
+
+	var grant LockGrant
+	err := s.poll(ctx, lockURL, opts, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&grant)
+	})
+	return grant.Token, err
+}
+
+func (s *RemoteLockService) Unlock(path string, owner LockOwner) error {
+	return s.post(context.Background(), fmt.Sprintf("%s/unlock?path=%s&%s", s.baseURL, url.QueryEscape(path), ownerQuery(owner)), "")
+}
+
+func (s *RemoteLockService) Renew(path string, owner LockOwner) error {
+	return s.post(context.Background(), fmt.Sprintf("%s/renew?path=%s&%s", s.baseURL, url.QueryEscape(path), ownerQuery(owner)), "")
+}
+
+func (s *RemoteLockService) IsLocked(path string) (LockStatus, error) {
+	var status LockStatus
+	err := s.get(fmt.Sprintf("%s/islocked?path=%s", s.baseURL, url.QueryEscape(path)), &status)
+	return status, err
+}
+
+// LockRange takes a byte-range lock on the coordinator, long-polling it while
+// opts.Wait is set
+func (s *RemoteLockService) LockRange(ctx context.Context, path string, lock RangeLock, opts LockOptions) error {
+	return s.poll(ctx, s.rangeURL("lockrange", path, lock), opts, nil)
+}
+
+func (s *RemoteLockService) UnlockRange(path string, lock RangeLock) error {
+	return s.post(context.Background(), s.rangeURL("unlockrange", path, lock), "")
+}
+
+func (s *RemoteLockService) QueryRange(path string, lock RangeLock) (RangeLock, bool, error) {
+	var status RangeLockStatus
+	if err := s.get(s.rangeURL("queryrange", path, lock), &status); err != nil {
+		return RangeLock{}, false, err
+	}
+	return status.Lock, status.Locked, nil
+}
+
+func (s *RemoteLockService) ListLocks(prefix string) ([]LockInfo, error) {
+	var locks []LockInfo
+	err := s.get(fmt.Sprintf("%s/locks?prefix=%s", s.baseURL, url.QueryEscape(prefix)), &locks)
+	return locks, err
+}
+
+func (s *RemoteLockService) ForceUnlock(path string) error {
+	return s.post(context.Background(), fmt.Sprintf("%s/forceunlock?path=%s", s.baseURL, url.QueryEscape(path)), s.adminToken)
+}
+
+func (s *RemoteLockService) LockDebug() (LockDebugInfo, error) {
+	var info LockDebugInfo
+	err := s.get(s.baseURL+"/debug/locks", &info)
+	return info, err
+}
+
+// rangeURL builds a byte-range lock request for lock on path
+func (s *RemoteLockService) rangeURL(endpoint, path string, lock RangeLock) string {
+	flock := 0
+	if lock.Flock {
+		flock = 1
+	}
+	owner := lock.Owner
+	owner.Pid = lock.Pid
+	return fmt.Sprintf("%s/%s?path=%s&start=%d&end=%d&type=%d&flock=%d&%s",
+		s.baseURL, endpoint, url.QueryEscape(path), lock.Start, lock.End, lock.Type, flock, ownerQuery(owner))
+}
+
+// poll posts a lock request, repeating it while the coordinator answers a
+// long-poll with a conflict and ctx is not done yet. decode, if set, reads the
+// body of a successful response.
+func (s *RemoteLockService) poll(ctx context.Context, lockURL string, opts LockOptions, decode func(io.Reader) error) error {
+	for {
+		pollURL := lockURL
+		if opts.Wait {
+			timeout := remotePollTimeout
+			if deadline, ok := ctx.Deadline(); ok {
+				timeout = min(timeout, time.Until(deadline))
+			}
+			if timeout <= 0 {
+				return fmt.Errorf("%w: gave up waiting: %v", ErrAlreadyLocked, context.DeadlineExceeded)
+			}
+			pollURL += "&wait=" + timeout.String()
+		}
+
+		resp, err := s.do(ctx, http.MethodPost, pollURL, "")
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("%w: gave up waiting: %v", ErrAlreadyLocked, ctx.Err())
+			}
+			return err
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			var err error
+			if decode != nil {
+				err = decode(resp.Body)
+			}
+			resp.Body.Close()
+			return err
+		}
+
+		err = remoteError(resp)
+		resp.Body.Close()
+		if !opts.Wait || !errors.Is(err, ErrAlreadyLocked) || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// post sends a POST request that has no response body
+func (s *RemoteLockService) post(ctx context.Context, requestURL, token string) error {
+	resp, err := s.do(ctx, http.MethodPost, requestURL, token)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return remoteError(resp)
+	}
+	return nil
+}
+
+// get decodes the JSON response to a GET request into v
+func (s *RemoteLockService) get(requestURL string, v interface{}) error {
+	resp, err := s.do(context.Background(), http.MethodGet, requestURL, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return remoteError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (s *RemoteLockService) do(ctx context.Context, method, requestURL, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("lock coordinator unreachable: %v", err)
+	}
+	return resp, nil
+}
+
+// remoteError turns a failed coordinator response back into the error the
+// coordinator's filesystem returned, so writeError maps it to the same status
+func remoteError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	msg := strings.TrimSpace(string(body))
+
+	if errno, err := strconv.Atoi(resp.Header.Get(errnoHeader)); err == nil && errno > 0 {
+		return &os.PathError{Op: "lock", Path: resp.Request.URL.Query().Get("path"), Err: syscall.Errno(errno)}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return &os.PathError{Op: "lock", Path: resp.Request.URL.Query().Get("path"), Err: syscall.ENOENT}
+	case http.StatusNotImplemented:
+		return ErrLockingNotSupported
+	case http.StatusConflict:
+		for _, sentinel := range []error{ErrAlreadyLocked, ErrNotLocked, ErrFileLocked} {
+			if msg == sentinel.Error() {
+				return sentinel
+			}
+		}
+		return fmt.Errorf("%s: %w", msg, ErrAlreadyLocked)
+	case http.StatusForbidden:
+		return fmt.Errorf("%s: %w", msg, ErrLockNotOwned)
+	}
+	return fmt.Errorf("lock coordinator returned %s: %s", resp.Status, msg)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestCluster serves a lock coordinator and a member whose chain forwards
+// its locks to it, both on one main store. It returns the coordinator's
+// filesystem, the member's URL and the root of the main store.
+func newTestCluster(t *testing.T) (*LocalFS, string, string) {
+	t.Helper()
+
+	root := t.TempDir()
+	coordinator, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleMain,
+		Features: FileSystemFeatures{CanLock: true},
+		RootPath: root,
+		LockTTL:  defaultLockTTL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	coordinatorServer := httptest.NewServer(newFileServerMux(coordinator, ""))
+	t.Cleanup(coordinatorServer.Close)
+
+	main, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleMain,
+		Features: FileSystemFeatures{CanUpdate: true, CanDelete: true},
+		RootPath: root,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChainFS([]ServerFS{main}, NewRemoteLockService(coordinatorServer.URL, ""))
+	memberServer := httptest.NewServer(newFileServerMux(chain, ""))
+	t.Cleanup(memberServer.Close)
+
+	return coordinator, memberServer.URL, root
+}
+
+// post sends a request to the server at baseURL and returns the status code
+// and body of the response
+func post(t *testing.T, baseURL, endpoint string, query url.Values, body []byte) (int, string) {
+	t.Helper()
+
+	resp, err := http.Post(fmt.Sprintf("%s/%s?%s", baseURL, endpoint, query.Encode()), "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var response bytes.Buffer
+	response.ReadFrom(resp.Body)
+	return resp.StatusCode, response.String()
+}
+
+func TestMemberForwardsLocksAndRefusesStaleFences(t *testing.T) {
+	coordinator, member, root := newTestCluster(t)
+	if err := os.WriteFile(filepath.Join(root, "f"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	owner := url.Values{"path": {"/f"}, "client": {"c"}, "pid": {"1"}}
+	lock := func() uint64 {
+		t.Helper()
+		query := url.Values{"type": {fmt.Sprint(int(WriteLock))}}
+		for k, v := range owner {
+			query[k] = v
+		}
+		status, body := post(t, member, "lock", query, nil)
+		if status != http.StatusOK {
+			t.Fatalf("lock: %d %s", status, body)
+		}
+		var grant LockGrant
+		if err := json.Unmarshal([]byte(body), &grant); err != nil {
+			t.Fatalf("lock response %q: %v", body, err)
+		}
+		return grant.Token
+	}
+	writeAt := func(fence uint64, data string) (int, string) {
+		t.Helper()
+		query := url.Values{"offset": {"0"}, "fence": {fmt.Sprint(fence)}}
+		for k, v := range owner {
+			query[k] = v
+		}
+		return post(t, member, "writeat", query, []byte(data))
+	}
+
+	// The lock taken through the member is held on the coordinator
+	first := lock()
+	status, err := coordinator.IsLocked("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Locked || status.LockType != WriteLock {
+		t.Fatalf("coordinator sees %+v, want a write lock", status)
+	}
+	if code, body := writeAt(first, "DATA"); code != http.StatusOK {
+		t.Fatalf("write with the current fence: %d %s", code, body)
+	}
+
+	// Once the lock moved on, the old token is refused
+	if code, body := post(t, member, "unlock", owner, nil); code != http.StatusOK {
+		t.Fatalf("unlock: %d %s", code, body)
+	}
+	second := lock()
+	if second == first {
+		t.Fatalf("relocking returned the old token %d", first)
+	}
+	if code, body := writeAt(first, "OLD!"); code != http.StatusConflict {
+		t.Errorf("write with a stale fence: %d %s, want %d", code, body, http.StatusConflict)
+	}
+
+	content, err := os.ReadFile(filepath.Join(root, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "DATA" {
+		t.Errorf("content = %q, want %q", content, "DATA")
+	}
+}
+
+func TestMemberHoldsOffGrantsDuringFencedWrites(t *testing.T) {
+	coordinator, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleMain,
+		Features: FileSystemFeatures{CanLock: true},
+		RootPath: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(coordinator.root, "f"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newFileServerMux(coordinator, ""))
+	t.Cleanup(server.Close)
+	main, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleMain,
+		Features: FileSystemFeatures{CanUpdate: true},
+		RootPath: coordinator.root,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChainFS([]ServerFS{main}, NewRemoteLockService(server.URL, ""))
+
+	first := LockOwner{ClientID: "c", Pid: 1}
+	next := LockOwner{ClientID: "c", Pid: 2}
+	token, err := chain.Lock(context.Background(), "/f", WriteLock, first, LockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := chain.Fence("/f", first, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The coordinator hands the lock on, but the member does not pass the
+	// grant on while the fenced write runs
+	granted := make(chan error, 1)
+	go func() {
+		_, err := chain.Lock(context.Background(), "/f", WriteLock, next, LockOptions{Wait: true})
+		granted <- err
+	}()
+	for status, _ := coordinator.IsLocked("/f"); status.Waiters == 0; status, _ = coordinator.IsLocked("/f") {
+		time.Sleep(time.Millisecond)
+	}
+	if err := chain.Unlock("/f", first); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-granted:
+		t.Fatalf("lock was handed on during a fenced write: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	done()
+	if err := <-granted; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.Fence("/f", first, token); !errors.Is(err, ErrStaleFence) {
+		t.Errorf("Fence after the lock moved on = %v, want %v", err, ErrStaleFence)
+	}
+}
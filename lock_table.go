@@ -0,0 +1,757 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// LockStatus describes the lock held on a path
+type LockStatus struct {
+	Locked   bool
+	LockType LockType
+	Holders  int    // Number of owners sharing the lock
+	Waiters  int    // Number of owners queued for it
+	Path     string // Where the lock is held: the path itself or a directory locked recursively above it
+}
+
+// LockInfo describes one holder of a lock, for lock administration
+type LockInfo struct {
+	Path      string
+	LockType  LockType
+	Owner     LockOwner
+	Acquired  time.Time
+	Expires   time.Time // Zero for a lock that never expires
+	Waiters   int       // Requests queued for the lock
+	Token     uint64    // Fencing token of a whole-file lock
+	Recursive bool      // Directory lock covering everything below Path
+
+	// Byte-range (fcntl and flock) locks only
+	Range bool
+	Start int64
+	End   int64
+	Flock bool
+}
+
+// LockLease is one owner's hold on a lock. It lapses at Expires unless the
+// owner renews it; a zero Expires never lapses.
+type LockLease struct {
+	Acquired  time.Time
+	Expires   time.Time
+	Token     uint64   // Fencing token, larger for every new acquisition
+	Recursive bool     // The lock also covers everything below the path
+	LockType  LockType // The type this holder asked for; the lock has the strongest of them
+}
+
+func (l LockLease) expired(now time.Time) bool {
+	return !l.Expires.IsZero() && now.After(l.Expires)
+}
+
+// FileLock represents a lock on a file and every owner holding it. Only read
+// locks, and locks held through several handles of one process, have more
+// than one holder.
+type FileLock struct {
+	Path     string
+	LockType LockType
+	Holders  map[LockOwner]LockLease
+}
+
+// LockOptions controls how a lock request is handled
+type LockOptions struct {
+	Wait      bool // Queue behind conflicting holders instead of failing
+	Recursive bool // Lock a directory and everything below it
+}
+
+// lockWaiter is a queued request for a lock
+type lockWaiter struct {
+	path      string // Moves along when the path is renamed
+	lockType  LockType
+	owner     LockOwner
+	recursive bool
+	since     time.Time     // When the request started waiting
+	granted   chan struct{} // Closed once the lock has been granted
+	token     uint64        // Fencing token, set before granted is closed
+}
+
+// LockTable tracks the locks held on paths
+type LockTable struct {
+	mutex     sync.RWMutex
+	locks     map[string]*FileLock
+	waiters   map[string][]*lockWaiter       // FIFO queue of requests per path
+	intents   map[string]map[string]struct{} // Locked paths below each directory
+	stats     map[string]*LockContention     // Contention per path, see lock_debug.go
+	deadlocks uint64                         // Waits refused because they would have deadlocked
+	ttl       time.Duration                  // Lease length, 0 for locks that never expire
+	fence     uint64                         // Last fencing token handed out
+	journal   *lockJournal                   // Persists lock changes, nil if locks are not persisted
+	fences    pathLocks                      // Held shared by fenced writes, see Fence
+}
+
+// NewLockTable creates an empty lock table whose leases last ttl. With a
+// positive ttl a background reaper drops leases that were not renewed.
+func NewLockTable(ttl time.Duration) *LockTable {
+	t := &LockTable{
+		locks:   make(map[string]*FileLock),
+		waiters: make(map[string][]*lockWaiter),
+		intents: make(map[string]map[string]struct{}),
+		stats:   make(map[string]*LockContention),
+		ttl:     ttl,
+	}
+	if ttl > 0 {
+		go t.reap(max(ttl/2, time.Second))
+	}
+	return t
+}
+
+// newLease starts a lease at now with the next fencing token. The caller
+// must hold t.mutex.
+func (t *LockTable) newLease(now time.Time, lockType LockType, recursive bool) LockLease {
+	t.fence++
+	lease := LockLease{Acquired: now, Token: t.fence, LockType: lockType, Recursive: recursive}
+	if t.ttl > 0 {
+		lease.Expires = now.Add(t.ttl)
+	}
+	return lease
+}
+
+// Acquire grants owner a lock of lockType on path. Read locks are shared;
+// write and exclusive locks have a single holder. An owner that already holds
+// the lock can switch its type: upgrading to write or exclusive only succeeds
+// while no other process shares the lock, downgrading to read always does.
+//
+// Handles of one process never conflict with each other, so a process can open
+// a file it already has open: a lock held only by the owner's process is
+// shared with the new handle, which also skips the queue. Owners without a
+// pid are each a process of their own.
+//
+// A conflicting request fails with ErrAlreadyLocked unless opts.Wait is set,
+// in which case it joins a FIFO queue for path and blocks until the lock is
+// granted or ctx is done. New owners also queue behind earlier waiters, so a
+// stream of readers cannot starve a waiting writer.
+//
+// With opts.Recursive the lock covers path and everything below it: it
+// conflicts with locks other processes hold below path, and locks below path
+// conflict with it. Handles of the process holding a directory lock are not
+// kept out, so it can open the files it locked.
+//
+// A request that would wait for a process that in turn waits, directly or
+// through others, for the requesting process fails with ErrDeadlock instead.
+//
+// It returns the fencing token of owner's lease. Tokens only grow, so storage
+// can refuse writes carrying a token older than the current holder's.
+func (t *LockTable) Acquire(ctx context.Context, path string, lockType LockType, owner LockOwner, opts LockOptions) (uint64, error) {
+	token, err := t.acquire(ctx, lockPath(path), lockType, owner, opts)
+	if err == nil {
+		// Writes the previous holder's token let through finish before the
+		// new holder learns its own
+		t.fences.Lock(path)()
+	}
+	return token, err
+}
+
+func (t *LockTable) acquire(ctx context.Context, path string, lockType LockType, owner LockOwner, opts LockOptions) (uint64, error) {
+	t.mutex.Lock()
+
+	// Leases the reaper has not got to yet must not block new owners
+	now := time.Now()
+	t.expireLock(path, now)
+
+	_, holds := t.holds(path, owner)
+	if holds || t.heldByProcess(path, owner) || len(t.waiters[path]) == 0 {
+		token, err := t.grant(path, lockType, owner, opts.Recursive)
+		if err == nil {
+			t.unlock()
+			return token, nil
+		}
+		if !opts.Wait {
+			t.contention(path, now).Contended++
+			t.mutex.Unlock()
+			return 0, err
+		}
+	} else if !opts.Wait {
+		t.contention(path, now).Contended++
+		t.mutex.Unlock()
+		return 0, ErrAlreadyLocked
+	}
+
+	stats := t.contention(path, now)
+	stats.Contended++
+	if err := t.checkDeadlock(path, lockType, owner, opts.Recursive); err != nil {
+		stats.Deadlocks++
+		t.deadlocks++
+		t.mutex.Unlock()
+		return 0, err
+	}
+
+	w := &lockWaiter{path: path, lockType: lockType, owner: owner, recursive: opts.Recursive, since: now, granted: make(chan struct{})}
+	t.waiters[path] = append(t.waiters[path], w)
+	stats.MaxWaiters = max(stats.MaxWaiters, len(t.waiters[path]))
+	t.mutex.Unlock()
+
+	select {
+	case <-w.granted:
+		// The lock may have been handed over by a request still writing the journal
+		t.sync()
+		return w.token, nil
+	case <-ctx.Done():
+	}
+
+	t.mutex.Lock()
+	defer t.unlock()
+
+	select {
+	case <-w.granted:
+		// Granted just as the caller gave up. If nobody uses it the lease
+		// lapses like that of any other vanished owner.
+		return w.token, nil
+	default:
+	}
+
+	t.dequeue(w.path, w)
+	now = time.Now()
+	t.contention(w.path, now).Timeouts++
+	t.recordWait(w.path, w.since, now)
+	// Requests queued behind this one may be grantable now
+	t.wakeWaiters(w.path)
+
+	return 0, fmt.Errorf("%w: gave up waiting: %v", ErrAlreadyLocked, ctx.Err())
+}
+
+// Fence checks that owner holds the whole-file lock on path with the
+// fencing token. Until the returned function is called, Acquire does not
+// return a grant of the lock, so the write the token guards cannot overlap
+// those of the next holder.
+func (t *LockTable) Fence(path string, owner LockOwner, token uint64) (func(), error) {
+	path = lockPath(path)
+	unlock := t.fences.RLock(path)
+
+	t.mutex.RLock()
+	var lease LockLease
+	held := false
+	if lock, exists := t.locks[path]; exists {
+		lease, held = lock.Holders[owner]
+	}
+	t.mutex.RUnlock()
+
+	if !held || lease.Token != token || lease.expired(time.Now()) {
+		unlock()
+		return nil, fmt.Errorf("%s no longer holds the lock with token %d: %w", owner, token, ErrStaleFence)
+	}
+	return unlock, nil
+}
+
+// grant gives owner the lock if it does not conflict with the current
+// holders or with directory locks and returns the lease's fencing token. An
+// owner changing the type of a lock it holds keeps its token. The caller must
+// hold t.mutex.
+func (t *LockTable) grant(path string, lockType LockType, owner LockOwner, recursive bool) (uint64, error) {
+	now := time.Now()
+
+	if err := t.hierarchyConflict(path, lockType, owner, recursive, now); err != nil {
+		return 0, err
+	}
+
+	lock, exists := t.locks[path]
+	if !exists {
+		lease := t.newLease(now, lockType, recursive)
+		t.addLock(&FileLock{
+			Path:     path,
+			LockType: lockType,
+			Holders:  map[LockOwner]LockLease{owner: lease},
+		})
+		t.persist(path)
+		return lease.Token, nil
+	}
+
+	// Whether every other holder is a handle of owner's process
+	ownProcess := true
+	for holder := range lock.Holders {
+		ownProcess = ownProcess && holder.sameProcess(owner)
+	}
+
+	if lease, holds := lock.Holders[owner]; holds {
+		if lockType != ReadLock && !ownProcess {
+			return 0, fmt.Errorf("cannot upgrade a lock shared by %d owners: %w", len(lock.Holders), ErrAlreadyLocked)
+		}
+		lease.LockType = lockType
+		lease.Recursive = recursive
+		if t.ttl > 0 {
+			lease.Expires = now.Add(t.ttl)
+		}
+		lock.Holders[owner] = lease
+		lock.LockType = lock.strongest()
+		t.persist(path)
+		return lease.Token, nil
+	}
+
+	// Allow multiple read locks, and any lock for another handle of the
+	// process that holds the lock
+	if (lock.LockType == ReadLock && lockType == ReadLock) || ownProcess {
+		lock.Holders[owner] = t.newLease(now, lockType, recursive)
+		lock.LockType = lock.strongest()
+		t.persist(path)
+		return lock.Holders[owner].Token, nil
+	}
+	return 0, ErrAlreadyLocked
+}
+
+// strongest returns the strongest type of lock one of the holders asked for
+func (l *FileLock) strongest() LockType {
+	strongest := ReadLock
+	for _, lease := range l.Holders {
+		strongest = max(strongest, lease.LockType)
+	}
+	return strongest
+}
+
+// heldByProcess reports whether a handle of owner's process holds the lock
+// on path. The caller must hold t.mutex.
+func (t *LockTable) heldByProcess(path string, owner LockOwner) bool {
+	lock, exists := t.locks[path]
+	if !exists {
+		return false
+	}
+	for holder := range lock.Holders {
+		if holder.sameProcess(owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// hierarchyConflict checks a lock on path against the directory locks above
+// it and, for a recursive lock, against the locks below it. Only holders from
+// other processes conflict. The caller must hold t.mutex.
+func (t *LockTable) hierarchyConflict(path string, lockType LockType, owner LockOwner, recursive bool, now time.Time) error {
+	for _, dir := range ancestors(path) {
+		t.expireLock(dir, now)
+		lock, exists := t.locks[dir]
+		if !exists || compatible(lock.LockType, lockType) {
+			continue
+		}
+		for holder, lease := range lock.Holders {
+			if lease.Recursive && !holder.sameProcess(owner) {
+				return fmt.Errorf("directory %s is locked by %s: %w", dir, holder, ErrAlreadyLocked)
+			}
+		}
+	}
+
+	if !recursive {
+		return nil
+	}
+	for below := range t.intents[path] {
+		lock := t.locks[below]
+		if compatible(lock.LockType, lockType) {
+			continue
+		}
+		for holder, lease := range lock.Holders {
+			if !lease.expired(now) && !holder.sameProcess(owner) {
+				return fmt.Errorf("%s is locked by %s: %w", below, holder, ErrAlreadyLocked)
+			}
+		}
+	}
+	return nil
+}
+
+// addLock stores lock and records its intention on every directory above it.
+// The caller must hold t.mutex.
+func (t *LockTable) addLock(lock *FileLock) {
+	t.locks[lock.Path] = lock
+	for _, dir := range ancestors(lock.Path) {
+		if t.intents[dir] == nil {
+			t.intents[dir] = make(map[string]struct{})
+		}
+		t.intents[dir][lock.Path] = struct{}{}
+	}
+}
+
+// removeLock drops the lock on path and its intentions. The caller must hold
+// t.mutex.
+func (t *LockTable) removeLock(path string) {
+	delete(t.locks, path)
+	for _, dir := range ancestors(path) {
+		delete(t.intents[dir], path)
+		if len(t.intents[dir]) == 0 {
+			delete(t.intents, dir)
+		}
+	}
+}
+
+// Renew extends owner's lease on the lock of path by another ttl
+func (t *LockTable) Renew(path string, owner LockOwner) error {
+	path = lockPath(path)
+	t.mutex.Lock()
+	defer t.unlock()
+
+	lock, exists := t.locks[path]
+	if !exists {
+		return ErrNotLocked
+	}
+
+	lease, holds := lock.Holders[owner]
+	if !holds {
+		return ErrLockNotOwned
+	}
+
+	if t.ttl > 0 {
+		lease.Expires = time.Now().Add(t.ttl)
+	}
+	lock.Holders[owner] = lease
+	t.persist(path)
+	return nil
+}
+
+// grantWaiters hands the lock on path to queued requests in arrival order,
+// stopping at the first one that still conflicts. The caller must hold t.mutex.
+func (t *LockTable) grantWaiters(path string) {
+	queue := t.waiters[path]
+	for len(queue) > 0 {
+		token, err := t.grant(path, queue[0].lockType, queue[0].owner, queue[0].recursive)
+		if err != nil {
+			break
+		}
+		queue[0].token = token
+		t.recordWait(path, queue[0].since, time.Now())
+		close(queue[0].granted)
+		queue = queue[1:]
+	}
+
+	if len(queue) == 0 {
+		delete(t.waiters, path)
+	} else {
+		t.waiters[path] = queue
+	}
+}
+
+// wakeWaiters grants what it can to the requests queued on path and on the
+// directories above and paths below it, whose directory locks path may have
+// been holding up. The caller must hold t.mutex.
+func (t *LockTable) wakeWaiters(path string) {
+	var queued []string
+	for waiting := range t.waiters {
+		if hasPathPrefix(waiting, path) || hasPathPrefix(path, waiting) {
+			queued = append(queued, waiting)
+		}
+	}
+	for _, waiting := range queued {
+		t.grantWaiters(waiting)
+	}
+}
+
+// dequeue removes w from the queue of path. The caller must hold t.mutex.
+func (t *LockTable) dequeue(path string, w *lockWaiter) {
+	queue := t.waiters[path]
+	for i, queued := range queue {
+		if queued == w {
+			t.waiters[path] = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(t.waiters[path]) == 0 {
+		delete(t.waiters, path)
+	}
+}
+
+// Release drops owner from the lock on path. The lock is removed once its
+// last holder has released it, and queued requests are granted in order.
+func (t *LockTable) Release(path string, owner LockOwner) error {
+	path = lockPath(path)
+	t.mutex.Lock()
+	defer t.unlock()
+
+	if err := t.release(path, owner); err != nil {
+		return err
+	}
+	t.wakeWaiters(path)
+	return nil
+}
+
+// release is Release without waking waiters. The caller must hold t.mutex.
+func (t *LockTable) release(path string, owner LockOwner) error {
+	lock, exists := t.locks[path]
+	if !exists {
+		return ErrNotLocked
+	}
+
+	if _, holds := lock.Holders[owner]; !holds {
+		return ErrLockNotOwned
+	}
+
+	delete(lock.Holders, owner)
+	if len(lock.Holders) == 0 {
+		t.removeLock(path)
+	} else {
+		lock.LockType = lock.strongest()
+	}
+	t.persist(path)
+	return nil
+}
+
+// Status reports the lock held on path, or else the nearest directory lock
+// that covers it
+func (t *LockTable) Status(path string) LockStatus {
+	path = lockPath(path)
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	status := LockStatus{Waiters: len(t.waiters[path]), Path: path}
+	if lock, exists := t.locks[path]; exists {
+		status.Locked = true
+		status.LockType = lock.LockType
+		status.Holders = len(lock.Holders)
+		return status
+	}
+
+	for _, dir := range ancestors(path) {
+		lock, exists := t.locks[dir]
+		if !exists {
+			continue
+		}
+		for _, lease := range lock.Holders {
+			if lease.Recursive {
+				status.Holders++
+			}
+		}
+		if status.Holders > 0 {
+			status.Locked = true
+			status.LockType = lock.LockType
+			status.Path = dir
+			return status
+		}
+	}
+	return status
+}
+
+// Holds reports whether owner holds the lock on path and of which type. A
+// directory lock above path held by owner's process counts as well.
+func (t *LockTable) Holds(path string, owner LockOwner) (LockType, bool) {
+	path = lockPath(path)
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if lockType, holds := t.holds(path, owner); holds {
+		return lockType, true
+	}
+	for _, dir := range ancestors(path) {
+		lock, exists := t.locks[dir]
+		if !exists {
+			continue
+		}
+		for holder, lease := range lock.Holders {
+			if lease.Recursive && holder.sameProcess(owner) {
+				return lock.LockType, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// holds reports whether owner itself holds the lock on path, and the type it
+// asked for. The caller must hold t.mutex.
+func (t *LockTable) holds(path string, owner LockOwner) (LockType, bool) {
+	lock, exists := t.locks[path]
+	if !exists {
+		return 0, false
+	}
+	lease, holds := lock.Holders[owner]
+	return lease.LockType, holds
+}
+
+// List returns one LockInfo per holder of every lock at or below prefix
+func (t *LockTable) List(prefix string) []LockInfo {
+	prefix = lockPath(prefix)
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	var infos []LockInfo
+	for path, lock := range t.locks {
+		if !hasPathPrefix(path, prefix) {
+			continue
+		}
+		for owner, lease := range lock.Holders {
+			infos = append(infos, LockInfo{
+				Path:      path,
+				LockType:  lock.LockType,
+				Owner:     owner,
+				Acquired:  lease.Acquired,
+				Expires:   lease.Expires,
+				Waiters:   len(t.waiters[path]),
+				Token:     lease.Token,
+				Recursive: lease.Recursive,
+			})
+		}
+	}
+	return infos
+}
+
+// Break drops every holder of the lock on path, whoever they are, and hands
+// the lock to the next waiters. It reports whether there was a lock to break.
+func (t *LockTable) Break(path string) bool {
+	path = lockPath(path)
+	t.mutex.Lock()
+	defer t.unlock()
+
+	_, exists := t.locks[path]
+	if exists {
+		t.removeLock(path)
+		t.persist(path)
+	}
+	t.wakeWaiters(path)
+	return exists
+}
+
+// Rename moves the locks on oldPath and everything below it to newPath
+func (t *LockTable) Rename(oldPath, newPath string) {
+	oldPath, newPath = lockPath(oldPath), lockPath(newPath)
+	t.mutex.Lock()
+	defer t.unlock()
+
+	var moving []*FileLock
+	for path, lock := range t.locks {
+		if _, ok := renamedPath(path, oldPath, newPath); ok {
+			moving = append(moving, lock)
+		}
+	}
+	for _, lock := range moving {
+		t.removeLock(lock.Path)
+		t.persist(lock.Path)
+	}
+	for _, lock := range moving {
+		lock.Path, _ = renamedPath(lock.Path, oldPath, newPath)
+		t.addLock(lock)
+		t.persist(lock.Path)
+	}
+	for path, queue := range t.waiters {
+		if moved, ok := renamedPath(path, oldPath, newPath); ok {
+			delete(t.waiters, path)
+			for _, w := range queue {
+				w.path = moved
+			}
+			t.waiters[moved] = queue
+		}
+	}
+}
+
+// reap periodically drops expired leases until the process exits
+func (t *LockTable) reap(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		t.mutex.Lock()
+		for path := range t.locks {
+			t.expireLock(path, now)
+			t.wakeWaiters(path)
+		}
+		t.unlock()
+	}
+}
+
+// expireLock drops the expired leases on path and the lock itself once no
+// holder is left. The caller must hold t.mutex.
+func (t *LockTable) expireLock(path string, now time.Time) {
+	lock, exists := t.locks[path]
+	if !exists {
+		return
+	}
+
+	expired := false
+	for owner, lease := range lock.Holders {
+		if lease.expired(now) {
+			delete(lock.Holders, owner)
+			expired = true
+			log.Printf("Lock lease on %s held by %s expired after %v without renewal",
+				path, owner, now.Sub(lease.Acquired).Round(time.Second))
+		}
+	}
+	if len(lock.Holders) == 0 {
+		t.removeLock(path)
+	} else if expired {
+		lock.LockType = lock.strongest()
+	}
+	if expired {
+		t.persist(path)
+	}
+}
+
+// restore loads the locks recorded in journal and persists later changes to
+// it. It must be called before the table is used.
+func (t *LockTable) restore(journal *lockJournal) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, record := range journal.records(journalFileLock) {
+		lock := &FileLock{
+			Path:     lockPath(record.Path),
+			LockType: record.LockType,
+			Holders:  make(map[LockOwner]LockLease, len(record.Holders)),
+		}
+		for _, h := range record.Holders {
+			// The journal keeps one type per lock, the strongest
+			lock.Holders[h.Owner] = LockLease{Acquired: h.Acquired, Expires: h.Expires, Token: h.Token, Recursive: h.Recursive, LockType: record.LockType}
+			// Tokens handed out after the restart must still be larger
+			t.fence = max(t.fence, h.Token)
+		}
+		t.addLock(lock)
+	}
+	t.journal = journal
+}
+
+// unlock releases t.mutex, then waits until the lock changes made while it
+// was held are in the journal, so no change is acknowledged before it is
+// durable. The disk is not waited for under t.mutex.
+func (t *LockTable) unlock() {
+	t.mutex.Unlock()
+	t.sync()
+}
+
+// sync waits until every lock change staged so far is in the journal
+func (t *LockTable) sync() {
+	if t.journal != nil {
+		t.journal.Sync()
+	}
+}
+
+// persist stages the current holders of the lock on path for the journal;
+// unlock writes them. The caller must hold t.mutex.
+func (t *LockTable) persist(path string) {
+	if t.journal == nil {
+		return
+	}
+
+	record := journalRecord{Kind: journalFileLock, Path: path}
+	if lock, exists := t.locks[path]; exists {
+		record.LockType = lock.LockType
+		for owner, lease := range lock.Holders {
+			record.Holders = append(record.Holders, journalHolder{Owner: owner, Acquired: lease.Acquired, Expires: lease.Expires, Token: lease.Token, Recursive: lease.Recursive})
+		}
+	}
+	t.journal.Stage(record)
+}
+
+// lockPath normalises path so that "a/b/", "/a/b" and "/a//b" share one lock
+func lockPath(path string) string {
+	return filepath.Clean("/" + path)
+}
+
+// ancestors returns the directories above path, nearest first, up to "/"
+func ancestors(path string) []string {
+	var dirs []string
+	for {
+		parent := filepath.Dir(path)
+		if parent == path {
+			return dirs
+		}
+		dirs = append(dirs, parent)
+		path = parent
+	}
+}
+
+// compatible reports whether different owners can hold locks of types a and b
+// at the same time
+func compatible(a, b LockType) bool {
+	return a == ReadLock && b == ReadLock
+}
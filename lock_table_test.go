@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandlesOfOneProcessShareALock(t *testing.T) {
+	table := NewLockTable(0)
+	first := LockOwner{ClientID: "c", Pid: 1, HandleID: 1}
+	second := LockOwner{ClientID: "c", Pid: 1, HandleID: 2}
+	other := LockOwner{ClientID: "c", Pid: 2, HandleID: 3}
+
+	if _, err := table.Acquire(context.Background(), "/f", ExclusiveLock, first, LockOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process queues for the file
+	queued := make(chan error, 1)
+	go func() {
+		_, err := table.Acquire(context.Background(), "/f", WriteLock, other, LockOptions{Wait: true})
+		queued <- err
+	}()
+	for table.Status("/f").Waiters == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The holder opening the file again must neither wait for itself nor
+	// queue behind the other process
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := table.Acquire(ctx, "/f", ReadLock, second, LockOptions{Wait: true}); err != nil {
+		t.Fatalf("second open of the holding process: %v", err)
+	}
+	if lockType, _ := table.Holds("/f", second); lockType != ReadLock {
+		t.Errorf("second handle holds a %v lock, want read", lockType)
+	}
+
+	if err := table.Release("/f", first); err != nil {
+		t.Fatal(err)
+	}
+	if status := table.Status("/f"); status.LockType != ReadLock || status.Holders != 1 {
+		t.Errorf("after the first handle closed the lock is %v with %d holders, want read with 1", status.LockType, status.Holders)
+	}
+	select {
+	case err := <-queued:
+		t.Fatalf("other process got the lock while a read handle is open: %v", err)
+	default:
+	}
+
+	if err := table.Release("/f", second); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-queued; err != nil {
+		t.Fatalf("other process: %v", err)
+	}
+}
+
+func TestOwnersWithoutPidDoNotShareALock(t *testing.T) {
+	table := NewLockTable(0)
+	first := LockOwner{ClientID: "c", HandleID: 1}
+	second := LockOwner{ClientID: "c", HandleID: 2}
+
+	if _, err := table.Acquire(context.Background(), "/f", WriteLock, first, LockOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Acquire(context.Background(), "/f", WriteLock, second, LockOptions{}); !errors.Is(err, ErrAlreadyLocked) {
+		t.Errorf("second owner without pid: %v, want ErrAlreadyLocked", err)
+	}
+}
+
+func TestAcquiredLocksAreInTheJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), lockJournalName)
+	journal, err := openLockJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := NewLockTable(0)
+	table.restore(journal)
+
+	owner := LockOwner{ClientID: "c", Pid: 1, HandleID: 1}
+	if _, err := table.Acquire(context.Background(), "/f", WriteLock, owner, LockOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying the file as a restarted server would must find the lock
+	// without the journal being closed first
+	replayed := &lockJournal{path: path, state: make(map[string]journalRecord)}
+	if err := replayed.replay(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	records := replayed.records(journalFileLock)
+	if len(records) != 1 || records[0].Path != "/f" || len(records[0].Holders) != 1 {
+		t.Fatalf("journal holds %+v, want the write lock on /f", records)
+	}
+	if records[0].Holders[0].Owner != owner {
+		t.Errorf("journal holder is %+v, want %+v", records[0].Holders[0].Owner, owner)
+	}
+}
+
+func TestFencedWritesFinishBeforeTheNextGrant(t *testing.T) {
+	table := NewLockTable(0)
+	first := LockOwner{ClientID: "c", Pid: 1, HandleID: 1}
+	next := LockOwner{ClientID: "c", Pid: 2, HandleID: 2}
+
+	token, err := table.Acquire(context.Background(), "/f", WriteLock, first, LockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Fence("/f", first, token+1); !errors.Is(err, ErrStaleFence) {
+		t.Errorf("Fence with a wrong token = %v, want %v", err, ErrStaleFence)
+	}
+
+	// A write checked its fence and is still running
+	done, err := table.Fence("/f", first, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	granted := make(chan error, 1)
+	go func() {
+		_, err := table.Acquire(context.Background(), "/f", WriteLock, next, LockOptions{Wait: true})
+		granted <- err
+	}()
+	for table.Status("/f").Waiters == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := table.Release("/f", first); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-granted:
+		t.Fatalf("lock was handed on during a fenced write: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	done()
+	if err := <-granted; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Fence("/f", first, token); !errors.Is(err, ErrStaleFence) {
+		t.Errorf("Fence after the lock moved on = %v, want %v", err, ErrStaleFence)
+	}
+}
+
+func TestSharedLocksCountHoldersAndUpgrade(t *testing.T) {
+	table := NewLockTable(0)
+	ctx := context.Background()
+	a := LockOwner{ClientID: "a", Pid: 1, HandleID: 1}
+	b := LockOwner{ClientID: "b", Pid: 2, HandleID: 2}
+
+	for _, owner := range []LockOwner{a, b} {
+		if _, err := table.Acquire(ctx, "/f", ReadLock, owner, LockOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status := table.Status("/f"); !status.Locked || status.LockType != ReadLock || status.Holders != 2 {
+		t.Fatalf("status %+v, want a read lock with 2 holders", status)
+	}
+
+	// Neither reader can upgrade while the other holds the lock
+	if _, err := table.Acquire(ctx, "/f", WriteLock, a, LockOptions{}); !errors.Is(err, ErrAlreadyLocked) {
+		t.Errorf("upgrade of a shared lock = %v, want %v", err, ErrAlreadyLocked)
+	}
+
+	// One reader leaving keeps the lock for the other
+	if err := table.Release("/f", b); err != nil {
+		t.Fatal(err)
+	}
+	if status := table.Status("/f"); !status.Locked || status.Holders != 1 {
+		t.Fatalf("status %+v after one reader left, want 1 holder", status)
+	}
+
+	// The last reader upgrades in place, keeping its token, and downgrades again
+	token, err := table.Acquire(ctx, "/f", ReadLock, a, LockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgraded, err := table.Acquire(ctx, "/f", ExclusiveLock, a, LockOptions{})
+	if err != nil {
+		t.Fatalf("upgrade of the only reader: %v", err)
+	}
+	if upgraded != token {
+		t.Errorf("upgrade changed the token from %d to %d", token, upgraded)
+	}
+	if status := table.Status("/f"); status.LockType != ExclusiveLock {
+		t.Errorf("lock is %v after the upgrade, want exclusive", status.LockType)
+	}
+	if _, err := table.Acquire(ctx, "/f", ReadLock, b, LockOptions{}); !errors.Is(err, ErrAlreadyLocked) {
+		t.Errorf("read lock next to an exclusive one = %v, want %v", err, ErrAlreadyLocked)
+	}
+	if _, err := table.Acquire(ctx, "/f", ReadLock, a, LockOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Acquire(ctx, "/f", ReadLock, b, LockOptions{}); err != nil {
+		t.Errorf("read lock after the downgrade: %v", err)
+	}
+
+	for _, owner := range []LockOwner{a, b} {
+		if err := table.Release("/f", owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status := table.Status("/f"); status.Locked {
+		t.Errorf("status %+v after every holder left, want unlocked", status)
+	}
+	if err := table.Release("/f", a); !errors.Is(err, ErrNotLocked) {
+		t.Errorf("second release = %v, want %v", err, ErrNotLocked)
+	}
+}
+
+func TestWaitersAreGrantedInArrivalOrder(t *testing.T) {
+	table := NewLockTable(0)
+	ctx := context.Background()
+	reader := LockOwner{ClientID: "r", Pid: 1, HandleID: 1}
+	writer := LockOwner{ClientID: "w", Pid: 2, HandleID: 2}
+	late := LockOwner{ClientID: "l", Pid: 3, HandleID: 3}
+
+	if _, err := table.Acquire(ctx, "/f", ReadLock, reader, LockOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// queue starts a waiting request and returns once it is in the queue
+	queue := func(owner LockOwner, lockType LockType) chan error {
+		granted := make(chan error, 1)
+		waiters := table.Status("/f").Waiters
+		go func() {
+			_, err := table.Acquire(ctx, "/f", lockType, owner, LockOptions{Wait: true})
+			granted <- err
+		}()
+		for table.Status("/f").Waiters == waiters {
+			time.Sleep(time.Millisecond)
+		}
+		return granted
+	}
+	writerGranted := queue(writer, WriteLock)
+	// A reader arriving after the writer waits behind it, although it
+	// could share the lock held now
+	lateGranted := queue(late, ReadLock)
+
+	if err := table.Release("/f", reader); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-writerGranted; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-lateGranted:
+		t.Fatalf("the later reader got the lock along with the writer: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if err := table.Release("/f", writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-lateGranted; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecursiveLocksConflictAboveAndBelow(t *testing.T) {
+	table := NewLockTable(0)
+	ctx := context.Background()
+	a := LockOwner{ClientID: "a", Pid: 1, HandleID: 1}
+	sibling := LockOwner{ClientID: "a", Pid: 1, HandleID: 2}
+	b := LockOwner{ClientID: "b", Pid: 2, HandleID: 3}
+	recursive := LockOptions{Recursive: true}
+
+	// A lock below the directory keeps it from being locked recursively
+	if _, err := table.Acquire(ctx, "/d/sub/f", WriteLock, b, LockOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, lockType := range []LockType{ReadLock, WriteLock} {
+		if _, err := table.Acquire(ctx, "/d", lockType, a, recursive); !errors.Is(err, ErrAlreadyLocked) {
+			t.Errorf("recursive %v lock over a locked file = %v, want %v", lockType, err, ErrAlreadyLocked)
+		}
+	}
+	// but a plain directory lock, or one on a directory beside it, is fine
+	if _, err := table.Acquire(ctx, "/d", WriteLock, a, LockOptions{}); err != nil {
+		t.Errorf("plain lock on the directory: %v", err)
+	}
+	if err := table.Release("/d", a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Acquire(ctx, "/dd", WriteLock, a, recursive); err != nil {
+		t.Errorf("recursive lock on a directory sharing the prefix: %v", err)
+	}
+
+	if err := table.Release("/d/sub/f", b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Acquire(ctx, "/d", WriteLock, a, recursive); err != nil {
+		t.Fatalf("recursive lock after the file was released: %v", err)
+	}
+
+	// The recursive lock keeps other processes out of everything below it,
+	// but not the process holding it
+	for _, path := range []string{"/d/f", "/d/sub", "/d/sub/f"} {
+		if _, err := table.Acquire(ctx, path, ReadLock, b, LockOptions{}); !errors.Is(err, ErrAlreadyLocked) {
+			t.Errorf("lock on %s below a recursive lock = %v, want %v", path, err, ErrAlreadyLocked)
+		}
+	}
+	if _, err := table.Acquire(ctx, "/d/sub/f", WriteLock, sibling, LockOptions{}); err != nil {
+		t.Errorf("lock below a recursive lock of the same process: %v", err)
+	}
+	if _, err := table.Acquire(ctx, "/e/f", WriteLock, b, LockOptions{}); err != nil {
+		t.Errorf("lock outside the directory: %v", err)
+	}
+
+	// A waiter below the directory gets its lock once the directory is released
+	granted := make(chan error, 1)
+	go func() {
+		_, err := table.Acquire(ctx, "/d/f", WriteLock, b, LockOptions{Wait: true})
+		granted <- err
+	}()
+	for table.Status("/d/f").Waiters == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := table.Release("/d", a); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-granted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiter below was not woken when the directory was released")
+	}
+
+	// A shared recursive lock lets others read below it, but not write
+	if err := table.Release("/d/f", b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Acquire(ctx, "/d", ReadLock, a, recursive); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Acquire(ctx, "/d/f", ReadLock, b, LockOptions{}); err != nil {
+		t.Errorf("read lock below a recursive read lock: %v", err)
+	}
+	if _, err := table.Acquire(ctx, "/d/g", WriteLock, b, LockOptions{}); !errors.Is(err, ErrAlreadyLocked) {
+		t.Errorf("write lock below a recursive read lock = %v, want %v", err, ErrAlreadyLocked)
+	}
+}
+
+func TestLeasesExpireUnlessRenewed(t *testing.T) {
+	const ttl = 100 * time.Millisecond
+	table := NewLockTable(ttl)
+	ctx := context.Background()
+	a := LockOwner{ClientID: "a", Pid: 1, HandleID: 1}
+	b := LockOwner{ClientID: "b", Pid: 2, HandleID: 2}
+
+	if _, err := table.Acquire(ctx, "/f", WriteLock, a, LockOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Renewing keeps the lock well past its first lease
+	for range 10 {
+		time.Sleep(ttl / 4)
+		if err := table.Renew("/f", a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := table.Acquire(ctx, "/f", WriteLock, b, LockOptions{}); !errors.Is(err, ErrAlreadyLocked) {
+		t.Fatalf("lock on a renewed lease = %v, want %v", err, ErrAlreadyLocked)
+	}
+	if err := table.Renew("/f", b); !errors.Is(err, ErrLockNotOwned) {
+		t.Errorf("renewal by another owner = %v, want %v", err, ErrLockNotOwned)
+	}
+
+	// Without renewal the lease lapses and the lock goes to the next owner
+	time.Sleep(2 * ttl)
+	if _, err := table.Acquire(ctx, "/f", WriteLock, b, LockOptions{}); err != nil {
+		t.Fatalf("lock after the lease expired: %v", err)
+	}
+	if err := table.Renew("/f", a); !errors.Is(err, ErrLockNotOwned) {
+		t.Errorf("renewal of an expired lease = %v, want %v", err, ErrLockNotOwned)
+	}
+	if err := table.Release("/f", a); err == nil {
+		t.Error("the expired owner could release the new owner's lock")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// adminTokenEnv names the environment variable the admin token can be passed in
+const adminTokenEnv = "GO_SYNC_FS_ADMIN_TOKEN"
+
+// runLocksCommand implements the "locks" subcommand, which lists the locks a
+// running server holds or force-unlocks a file. It returns the exit code.
+func runLocksCommand(args []string) int {
+	flags := flag.NewFlagSet("locks", flag.ContinueOnError)
+	server := flags.String("server", "http://localhost:8080", "URL of the go-sync-fs server")
+	prefix := flags.String("prefix", "", "Only list locks at or below this path")
+	unlock := flags.String("unlock", "", "Force-unlock this path instead of listing locks")
+	token := flags.String("token", os.Getenv(adminTokenEnv), "Admin token, needed for -unlock (default $"+adminTokenEnv+")")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s locks [-server URL] [-prefix PATH] [-unlock PATH -token TOKEN]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	baseURL := strings.TrimSuffix(*server, "/")
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	var err error
+	if *unlock != "" {
+		err = forceUnlock(client, baseURL, *unlock, *token)
+	} else {
+		err = listLocks(client, baseURL, *prefix, os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// listLocks prints the lock holders at or below prefix as a table
+func listLocks(client *http.Client, baseURL, prefix string, out io.Writer) error {
+	resp, err := client.Get(fmt.Sprintf("%s/locks?prefix=%s", baseURL, url.QueryEscape(prefix)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	var locks []LockInfo
+	if err := json.NewDecoder(resp.Body).Decode(&locks); err != nil {
+		return fmt.Errorf("error decoding lock list: %v", err)
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tTYPE\tRANGE\tOWNER\tAGE\tEXPIRES IN\tWAITERS")
+	for _, lock := range locks {
+		lockRange := "file"
+		switch {
+		case lock.Range:
+			lockRange = formatRange(lock)
+		case lock.Recursive:
+			lockRange = "subtree"
+		}
+		expires := "never"
+		if !lock.Expires.IsZero() {
+			expires = lock.Expires.Sub(now).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n",
+			lock.Path, lock.LockType, lockRange, lock.Owner,
+			now.Sub(lock.Acquired).Round(time.Second), expires, lock.Waiters)
+	}
+	return w.Flush()
+}
+
+// formatRange describes the bytes a range lock covers
+func formatRange(lock LockInfo) string {
+	kind := "fcntl"
+	if lock.Flock {
+		kind = "flock"
+	}
+	if lock.End == rangeEOF {
+		return fmt.Sprintf("%s %d-EOF", kind, lock.Start)
+	}
+	return fmt.Sprintf("%s %d-%d", kind, lock.Start, lock.End)
+}
+
+// forceUnlock asks the server to break every lock on path
+func forceUnlock(client *http.Client, baseURL, path, token string) error {
+	if token == "" {
+		return fmt.Errorf("-unlock needs the admin token, pass -token or set %s", adminTokenEnv)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/forceunlock?path=%s", baseURL, url.QueryEscape(path)), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	fmt.Printf("Unlocked %s\n", path)
+	return nil
+}
+
+// responseError turns a failed response into an error carrying the server's message
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
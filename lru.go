@@ -0,0 +1,71 @@
+package main
+
+import "container/list"
+
+// lruMap is a map of at most limit entries. Adding one more drops the entry
+// used least recently, in constant time. It is not safe for concurrent use.
+type lruMap[K comparable, V any] struct {
+	limit   int
+	entries map[K]*list.Element
+	order   *list.List // Entries from the most to the least recently used
+}
+
+// lruEntry is an element of an lruMap's order
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func newLRUMap[K comparable, V any](limit int) *lruMap[K, V] {
+	return &lruMap[K, V]{
+		limit:   limit,
+		entries: make(map[K]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the value of key and marks it used
+func (m *lruMap[K, V]) get(key K) (V, bool) {
+	element, exists := m.entries[key]
+	if !exists {
+		var zero V
+		return zero, false
+	}
+	m.order.MoveToFront(element)
+	return element.Value.(*lruEntry[K, V]).value, true
+}
+
+// put sets the value of key and marks it used, making room for it when it
+// is new
+func (m *lruMap[K, V]) put(key K, value V) {
+	if element, exists := m.entries[key]; exists {
+		element.Value.(*lruEntry[K, V]).value = value
+		m.order.MoveToFront(element)
+		return
+	}
+
+	if m.order.Len() >= m.limit {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*lruEntry[K, V]).key)
+	}
+	m.entries[key] = m.order.PushFront(&lruEntry[K, V]{key: key, value: value})
+}
+
+// remove drops key
+func (m *lruMap[K, V]) remove(key K) {
+	if element, exists := m.entries[key]; exists {
+		m.order.Remove(element)
+		delete(m.entries, key)
+	}
+}
+
+// removeFunc drops every key drop returns true for
+func (m *lruMap[K, V]) removeFunc(drop func(K) bool) {
+	for key, element := range m.entries {
+		if drop(key) {
+			m.order.Remove(element)
+			delete(m.entries, key)
+		}
+	}
+}
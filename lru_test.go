@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestLRUMapDropsLeastRecentlyUsed(t *testing.T) {
+	m := newLRUMap[string, int](3)
+	m.put("a", 1)
+	m.put("b", 2)
+	m.put("c", 3)
+
+	// Reading a and rewriting b leave c as the entry used least recently
+	if _, ok := m.get("a"); !ok {
+		t.Fatal("a is missing")
+	}
+	m.put("b", 20)
+	m.put("d", 4)
+
+	if _, ok := m.get("c"); ok {
+		t.Error("c was kept, want it dropped")
+	}
+	for key, want := range map[string]int{"a": 1, "b": 20, "d": 4} {
+		if value, ok := m.get(key); !ok || value != want {
+			t.Errorf("get(%s) = %d, %v, want %d", key, value, ok, want)
+		}
+	}
+
+	m.remove("a")
+	m.removeFunc(func(key string) bool { return key == "b" })
+	if len(m.entries) != 1 || m.order.Len() != 1 {
+		t.Errorf("%d entries and %d in order after removing two, want 1", len(m.entries), m.order.Len())
+	}
+	m.put("e", 5)
+	m.put("f", 6)
+	if _, ok := m.get("d"); !ok {
+		t.Error("d was dropped while there was room")
+	}
+}
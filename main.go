@@ -2,15 +2,22 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -21,7 +28,8 @@ import (
 
 // Server components
 type FileServer struct {
-	fs ServerFS
+	fs         ServerFS
+	adminToken string // Required by admin endpoints, which are disabled when empty
 }
 
 func (s *FileServer) handleInfo(w http.ResponseWriter, r *http.Request) {
@@ -75,6 +83,42 @@ func (s *FileServer) handleRead(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(info)
 }
 
+// fsReaderAt adapts a single path on a ServerFS to io.ReaderAt
+type fsReaderAt struct {
+	fs    ServerFS
+	path  string
+	owner LockOwner
+}
+
+func (r *fsReaderAt) ReadAt(buf []byte, offset int64) (int, error) {
+	return r.fs.ReadAt(r.path, buf, offset, r.owner)
+}
+
+// handleReadAt streams raw file content and honours HTTP Range requests
+func (s *FileServer) handleReadAt(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+
+	owner, err := parseLockOwner(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := s.fs.Info(path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if info.IsDir {
+		http.Error(w, "Is a directory", http.StatusBadRequest)
+		return
+	}
+
+	content := io.NewSectionReader(&fsReaderAt{fs: s.fs, path: path, owner: owner}, 0, info.Size)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime, content)
+}
+
 func (s *FileServer) handleWrite(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -89,7 +133,20 @@ func (s *FileServer) handleWrite(w http.ResponseWriter, r *http.Request) {
 
 	path := r.URL.Query().Get("path")
 
-	if err := s.fs.Write(path, fileInfo.Content, fileInfo.Mode); err != nil {
+	owner, err := parseLockOwner(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	release, err := s.fence(r, path, owner)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer release()
+
+	if err := s.fs.Write(path, fileInfo.Content, fileInfo.Mode, owner); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -97,16 +154,781 @@ func (s *FileServer) handleWrite(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func startFileServer(fs ServerFS, serverAddr string) error {
-	server := &FileServer{fs: fs}
+// writeChunkSize bounds how much of a streamed request body is buffered per backend write
+const writeChunkSize = 1 << 20
+
+// handleWriteAt streams the request body into the file starting at the given offset
+func (s *FileServer) handleWriteAt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, fmt.Sprintf("invalid offset: %q", r.URL.Query().Get("offset")), http.StatusBadRequest)
+		return
+	}
 
-	http.HandleFunc("/info", server.handleInfo)
-	http.HandleFunc("/list", server.handleList)
-	http.HandleFunc("/read", server.handleRead)
-	http.HandleFunc("/write", server.handleWrite)
+	owner, err := parseLockOwner(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	release, err := s.fence(r, path, owner)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer release()
+
+	buf := make([]byte, writeChunkSize)
+	for {
+		n, readErr := io.ReadFull(r.Body, buf)
+		if n > 0 {
+			if _, err := s.fs.WriteAt(path, buf[:n], offset, owner); err != nil {
+				writeError(w, err)
+				return
+			}
+			offset += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			http.Error(w, readErr.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *FileServer) handleTruncate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, fmt.Sprintf("invalid size: %q", r.URL.Query().Get("size")), http.StatusBadRequest)
+		return
+	}
+
+	owner, err := parseLockOwner(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	release, err := s.fence(r, path, owner)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer release()
+
+	if err := s.fs.Truncate(path, size, owner); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *FileServer) handleMkdir(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	mode, err := strconv.ParseUint(r.URL.Query().Get("mode"), 8, 32)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid mode: %q", r.URL.Query().Get("mode")), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.fs.Mkdir(path, os.FileMode(mode)); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *FileServer) handleRmdir(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	if err := s.fs.Rmdir(path); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *FileServer) handleRename(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	oldPath := r.URL.Query().Get("old")
+	newPath := r.URL.Query().Get("new")
+	if oldPath == "" || newPath == "" {
+		http.Error(w, "old and new paths are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.fs.Rename(oldPath, newPath); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *FileServer) handleSymlink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.fs.Symlink(target, path); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleReadlink returns the link target as the plain response body
+func (s *FileServer) handleReadlink(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+
+	target, err := s.fs.Readlink(path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, target)
+}
+
+func (s *FileServer) handleLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	oldPath := r.URL.Query().Get("old")
+	newPath := r.URL.Query().Get("new")
+	if oldPath == "" || newPath == "" {
+		http.Error(w, "old and new paths are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.fs.Link(oldPath, newPath); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleGetXattr returns the raw attribute value as the response body
+func (s *FileServer) handleGetXattr(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	name := r.URL.Query().Get("name")
+
+	value, err := s.fs.GetXattr(path, name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(value)
+}
+
+// handleSetXattr sets an attribute to the raw request body
+func (s *FileServer) handleSetXattr(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	flags := 0
+	if f := r.URL.Query().Get("flags"); f != "" {
+		var err error
+		if flags, err = strconv.Atoi(f); err != nil {
+			http.Error(w, fmt.Sprintf("invalid flags: %q", f), http.StatusBadRequest)
+			return
+		}
+	}
+
+	value, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.fs.SetXattr(path, name, value, flags); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *FileServer) handleListXattr(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+
+	names, err := s.fs.ListXattr(path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(names)
+}
+
+func (s *FileServer) handleRemoveXattr(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	name := r.URL.Query().Get("name")
+
+	if err := s.fs.RemoveXattr(path, name); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleSetAttr applies the AttrUpdate in the request body
+func (s *FileServer) handleSetAttr(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var update AttrUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	if err := s.fs.SetAttr(path, update); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// errnoHeader carries the errno behind a failed request so clients can report it exactly
+const errnoHeader = "X-Errno"
+
+// writeError maps filesystem errors to HTTP status codes
+func writeError(w http.ResponseWriter, err error) {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		w.Header().Set(errnoHeader, strconv.Itoa(int(errno)))
+	}
+
+	switch {
+	case os.IsNotExist(err), errors.Is(err, syscall.ENODATA):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, ErrLockingNotSupported):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	case errors.Is(err, ErrAlreadyLocked), errors.Is(err, ErrFileLocked), errors.Is(err, ErrNotLocked), errors.Is(err, ErrStaleFence),
+		errors.Is(err, ErrDeadlock),
+		os.IsExist(err), errors.Is(err, syscall.ENOTEMPTY):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, syscall.EISDIR), errors.Is(err, syscall.ENOTDIR):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrLockNotOwned), os.IsPermission(err), errors.Is(err, syscall.EPERM):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// parseLockOwner reads the client, pid and handle query parameters that
+// identify a lock owner. Requests without a client ID are attributed to the
+// remote host; pid and handle are optional but must be valid when given.
+func parseLockOwner(r *http.Request) (LockOwner, error) {
+	query := r.URL.Query()
+
+	owner := LockOwner{ClientID: query.Get("client")}
+	if owner.ClientID == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		owner.ClientID = host
+	}
+
+	if pid := query.Get("pid"); pid != "" {
+		n, err := strconv.Atoi(pid)
+		if err != nil || n <= 0 {
+			return LockOwner{}, fmt.Errorf("invalid pid: %q", pid)
+		}
+		owner.Pid = n
+	}
+
+	if handle := query.Get("handle"); handle != "" {
+		n, err := strconv.ParseUint(handle, 10, 64)
+		if err != nil {
+			return LockOwner{}, fmt.Errorf("invalid handle: %q", handle)
+		}
+		owner.HandleID = n
+	}
+
+	return owner, nil
+}
+
+// fence rejects a write whose fence parameter is not the fencing token of
+// the lock owner currently holds on path, which happens once its lease
+// lapsed and the lock moved on. A write that passes has to call the
+// returned function once it is done; until then the lock is not handed on.
+// Writes without a fence are not checked.
+func (s *FileServer) fence(r *http.Request, path string, owner LockOwner) (func(), error) {
+	fence := r.URL.Query().Get("fence")
+	if fence == "" {
+		return func() {}, nil
+	}
+	token, err := strconv.ParseUint(fence, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fence: %q: %w", fence, ErrStaleFence)
+	}
+
+	return s.fs.Fence(path, owner, token)
+}
+
+func (s *FileServer) handleLock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	lockType, err := strconv.Atoi(r.URL.Query().Get("type"))
+	if err != nil || LockType(lockType) < ReadLock || LockType(lockType) > ExclusiveLock {
+		http.Error(w, fmt.Sprintf("invalid lock type: %q", r.URL.Query().Get("type")), http.StatusBadRequest)
+		return
+	}
+
+	owner, err := parseLockOwner(r)
+	if err == nil && owner.Pid == 0 {
+		err = errors.New("missing pid")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel, opts, err := parseWait(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+	opts.Recursive = r.URL.Query().Get("recursive") == "1"
+
+	token, err := s.fs.Lock(ctx, path, LockType(lockType), owner, opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(LockGrant{Token: token})
+}
+
+func (s *FileServer) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	owner, err := parseLockOwner(r)
+	if err == nil && owner.Pid == 0 {
+		err = errors.New("missing pid")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.fs.Unlock(path, owner); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleRenew extends the caller's lease on a file lock
+func (s *FileServer) handleRenew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	owner, err := parseLockOwner(r)
+	if err == nil && owner.Pid == 0 {
+		err = errors.New("missing pid")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.fs.Renew(path, owner); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseWait reads the wait query parameter, which turns a lock request into a
+// long poll that queues for the lock for up to that long or until the client
+// goes away
+func parseWait(r *http.Request) (context.Context, context.CancelFunc, LockOptions, error) {
+	wait := r.URL.Query().Get("wait")
+	if wait == "" {
+		return r.Context(), func() {}, LockOptions{}, nil
+	}
+
+	timeout, err := time.ParseDuration(wait)
+	if err != nil || timeout <= 0 {
+		return nil, nil, LockOptions{}, fmt.Errorf("invalid wait: %q", wait)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, LockOptions{Wait: true}, nil
+}
+
+// RangeLockStatus is the response body of the /queryrange endpoint
+type RangeLockStatus struct {
+	Locked bool
+	Lock   RangeLock // The conflicting lock when Locked is set
+}
+
+// parseRangeLock reads a byte-range lock from the start, end, type and flock
+// query parameters plus the owner parameters. The owner's pid is only kept
+// for reporting, since POSIX locks belong to the kernel's lock owner.
+func parseRangeLock(r *http.Request) (RangeLock, error) {
+	query := r.URL.Query()
+
+	start, err := strconv.ParseInt(query.Get("start"), 10, 64)
+	if err != nil || start < 0 {
+		return RangeLock{}, fmt.Errorf("invalid start: %q", query.Get("start"))
+	}
+	end, err := strconv.ParseInt(query.Get("end"), 10, 64)
+	if err != nil || end < start {
+		return RangeLock{}, fmt.Errorf("invalid end: %q", query.Get("end"))
+	}
+
+	lockType := ReadLock
+	if t := query.Get("type"); t != "" {
+		n, err := strconv.Atoi(t)
+		if err != nil || (LockType(n) != ReadLock && LockType(n) != WriteLock) {
+			return RangeLock{}, fmt.Errorf("invalid lock type: %q", t)
+		}
+		lockType = LockType(n)
+	}
+
+	owner, err := parseLockOwner(r)
+	if err != nil {
+		return RangeLock{}, err
+	}
+
+	return RangeLock{
+		Start: start,
+		End:   end,
+		Type:  lockType,
+		Flock: query.Get("flock") == "1",
+		Owner: LockOwner{ClientID: owner.ClientID, HandleID: owner.HandleID},
+		Pid:   owner.Pid,
+	}, nil
+}
+
+// handleLockRange takes a byte-range lock, long-polling for up to wait when given
+func (s *FileServer) handleLockRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	lock, err := parseRangeLock(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel, opts, err := parseWait(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+
+	if err := s.fs.LockRange(ctx, path, lock, opts); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleUnlockRange releases the owner's byte-range locks within a range
+func (s *FileServer) handleUnlockRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	lock, err := parseRangeLock(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.fs.UnlockRange(path, lock); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleQueryRange reports a byte-range lock that would block the given one
+func (s *FileServer) handleQueryRange(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+
+	lock, err := parseRangeLock(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conflict, found, err := s.fs.QueryRange(path, lock)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(RangeLockStatus{Locked: found, Lock: conflict})
+}
+
+// handleLocks lists the lock holders at or below the prefix parameter
+func (s *FileServer) handleLocks(w http.ResponseWriter, r *http.Request) {
+	locks, err := s.fs.ListLocks(r.URL.Query().Get("prefix"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	sort.Slice(locks, func(i, j int) bool {
+		if locks[i].Path != locks[j].Path {
+			return locks[i].Path < locks[j].Path
+		}
+		return locks[i].Acquired.Before(locks[j].Acquired)
+	})
+	json.NewEncoder(w).Encode(locks)
+}
+
+// handleDebugLocks reports lock contention per path and the current wait-for graph
+func (s *FileServer) handleDebugLocks(w http.ResponseWriter, r *http.Request) {
+	info, err := s.fs.LockDebug()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(info)
+}
+
+// handleDebugPromotion reports how many files reads have copied into the
+// earlier filesystems of the chain, and why the others were not
+func (s *FileServer) handleDebugPromotion(w http.ResponseWriter, r *http.Request) {
+	reporter, ok := s.fs.(PromotionReporter)
+	if !ok {
+		http.Error(w, "the filesystem does not promote files", http.StatusNotImplemented)
+		return
+	}
+
+	json.NewEncoder(w).Encode(reporter.PromotionStats())
+}
+
+// requireAdmin checks that the request carries the admin token
+func (s *FileServer) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if s.adminToken == "" {
+		http.Error(w, "admin API is disabled, set admin_token to enable it", http.StatusForbidden)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.adminToken)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// handleForceUnlock breaks every lock on a file, whoever holds it. Admin only.
+func (s *FileServer) handleForceUnlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireAdmin(w, r) {
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	if err := s.fs.ForceUnlock(path); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	log.Printf("Locks on %s force-unlocked by %s", path, r.RemoteAddr)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *FileServer) handleIsLocked(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+
+	status, err := s.fs.IsLocked(path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleInvalidate drops the cached copies of a file, or of everything below
+// a directory, so that the next read fetches them from the main store
+func (s *FileServer) handleInvalidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	if err := s.fs.Invalidate(path); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *FileServer) handleDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+
+	if err := s.fs.Delete(path); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func startFileServer(fs ServerFS, serverAddr string, adminToken string) error {
 	log.Printf("Starting server on %s", serverAddr)
-	return http.ListenAndServe(serverAddr, nil)
+	return http.ListenAndServe(serverAddr, newFileServerMux(fs, adminToken))
+}
+
+// newFileServerMux routes the file server API to the handlers serving fs
+func newFileServerMux(fs ServerFS, adminToken string) *http.ServeMux {
+	server := &FileServer{fs: fs, adminToken: adminToken}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/info", server.handleInfo)
+	mux.HandleFunc("/list", server.handleList)
+	mux.HandleFunc("/read", server.handleRead)
+	mux.HandleFunc("/readat", server.handleReadAt)
+	mux.HandleFunc("/write", server.handleWrite)
+	mux.HandleFunc("/writeat", server.handleWriteAt)
+	mux.HandleFunc("/truncate", server.handleTruncate)
+	mux.HandleFunc("/setattr", server.handleSetAttr)
+	mux.HandleFunc("/lock", server.handleLock)
+	mux.HandleFunc("/unlock", server.handleUnlock)
+	mux.HandleFunc("/renew", server.handleRenew)
+	mux.HandleFunc("/lockrange", server.handleLockRange)
+	mux.HandleFunc("/unlockrange", server.handleUnlockRange)
+	mux.HandleFunc("/queryrange", server.handleQueryRange)
+	mux.HandleFunc("/islocked", server.handleIsLocked)
+	mux.HandleFunc("/locks", server.handleLocks)
+	mux.HandleFunc("/forceunlock", server.handleForceUnlock)
+	mux.HandleFunc("/debug/locks", server.handleDebugLocks)
+	mux.HandleFunc("/debug/promotion", server.handleDebugPromotion)
+	mux.HandleFunc("/delete", server.handleDelete)
+	mux.HandleFunc("/invalidate", server.handleInvalidate)
+	mux.HandleFunc("/mkdir", server.handleMkdir)
+	mux.HandleFunc("/rmdir", server.handleRmdir)
+	mux.HandleFunc("/rename", server.handleRename)
+	mux.HandleFunc("/symlink", server.handleSymlink)
+	mux.HandleFunc("/readlink", server.handleReadlink)
+	mux.HandleFunc("/link", server.handleLink)
+	mux.HandleFunc("/getxattr", server.handleGetXattr)
+	mux.HandleFunc("/setxattr", server.handleSetXattr)
+	mux.HandleFunc("/listxattr", server.handleListXattr)
+	mux.HandleFunc("/removexattr", server.handleRemoveXattr)
+
+	return mux
 }
 
 // checkWritePermission performs a thorough write permission test
@@ -290,21 +1112,34 @@ func cleanup(mountpoint string) {
 	}
 }
 
-func startFUSE(mountpoint string, serverURL string, done chan struct{}) error {
+// MountConfig holds the settings of the FUSE client
+type MountConfig struct {
+	Ownership OwnershipConfig
+	ClientID  string        // Lock owner name of this mount
+	LockTTL   time.Duration // Lease length the server gives locks
+	Locking   bool          // Whether the server chain supports locking
+}
+
+func startFUSE(mountpoint string, serverURL string, mount MountConfig, done chan struct{}) error {
 	// Ensure proper permissions on mount point
 	if err := os.Chmod(mountpoint, 0755); err != nil {
 		return fmt.Errorf("failed to set mount point permissions: %v", err)
 	}
 
-	c, err := fuse.Mount(
-		mountpoint,
+	options := []fuse.MountOption{
 		fuse.FSName("remotefs"),
 		fuse.Subtype("remotefs"),
 		fuse.AllowOther(),
 		fuse.DefaultPermissions(),
 		fuse.WritebackCache(),
-		fuse.MaxReadahead(128*1024),
-	)
+		fuse.MaxReadahead(128 * 1024),
+	}
+	if mount.Locking {
+		// Forward flock and fcntl locks to the server so they hold across mounts
+		options = append(options, fuse.LockingFlock(), fuse.LockingPOSIX())
+	}
+
+	c, err := fuse.Mount(mountpoint, options...)
 	if err != nil {
 		return fmt.Errorf("mount failed: %v", err)
 	}
@@ -325,20 +1160,40 @@ func startFUSE(mountpoint string, serverURL string, done chan struct{}) error {
 		client: &http.Client{
 			Timeout: 30 * time.Second, // Increased timeout
 		},
-		baseURL: serverURL,
+		baseURL:   serverURL,
+		ownership: mount.Ownership,
+		clientID:  mount.ClientID,
 	}
 
+	// Renew lock leases well before the server lets them expire
+	go filesys.heartbeat(mount.LockTTL/3, done)
+
 	log.Printf("Mounting FUSE at %s, connecting to %s", mountpoint, serverURL)
 	return fs.Serve(c, filesys)
 }
 
+// debugLogging is set by -debug, or debug in the config file
+var debugLogging bool
+
+// debugf logs only in debug mode
+func debugf(format string, args ...any) {
+	if debugLogging {
+		log.Printf(format, args...)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "locks" {
+		os.Exit(runLocksCommand(os.Args[2:]))
+	}
+
 	var configPath string
 	var masterDir string
 	var serverAddr string
 	var mountpoint string
 	var role string
 	var maxCacheSize int64
+	var adminToken string
 
 	// Support both config file and command line arguments
 	flag.StringVar(&configPath, "config", "", "Path to YAML config file")
@@ -347,11 +1202,19 @@ func main() {
 	flag.StringVar(&mountpoint, "mount", "", "Directory to mount FUSE filesystem (legacy)")
 	flag.StringVar(&role, "role", "main", "Filesystem role (main or cache) (legacy)")
 	flag.Int64Var(&maxCacheSize, "cache-size", 1024*1024*1024, "Max cache size in bytes (default 1GB) (legacy)")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv(adminTokenEnv), "Token for the lock admin API (legacy)")
+	flag.BoolVar(&debugLogging, "debug", false, "Log the decisions of the filesystem chain")
 	flag.Parse()
 
 	var fs ServerFS
 	var err error
 	var cacheDir string
+	mount := MountConfig{
+		Ownership: OwnershipConfig{Mode: OwnershipMountUser},
+		ClientID:  defaultClientID(),
+		LockTTL:   defaultLockTTL,
+		Locking:   true, // The legacy single filesystem always locks
+	}
 
 	if configPath != "" {
 		// Use YAML config
@@ -371,6 +1234,15 @@ func main() {
 
 		mountpoint = config.Mount
 		serverAddr = config.ServerAddr
+		if config.AdminToken != "" {
+			adminToken = config.AdminToken
+		}
+		mount = MountConfig{
+			Ownership: config.Ownership,
+			ClientID:  config.ClientID,
+			LockTTL:   config.LockTTL,
+			Locking:   config.HasLocking,
+		}
 
 		// Check directory permissions (except mount point) before proceeding
 		if err := checkDirectoryPermissions(masterDir, cacheDir); err != nil {
@@ -387,7 +1259,22 @@ func main() {
 			log.Fatalf("Error creating filesystems: %v", err)
 		}
 
-		fs = NewChainFS(filesystems)
+		lockService := createLockService(config)
+		if lockService != nil {
+			log.Printf("Forwarding locks to cluster coordinator %s", config.Cluster.Coordinator)
+		}
+		chain := NewChainFS(filesystems, lockService)
+		if config.WriteMode == WriteBack {
+			if err := chain.EnableWriteback(config.WritebackJournal); err != nil {
+				log.Fatalf("Error enabling write-back mode: %v", err)
+			}
+			log.Printf("Write-back mode, journal at %s", config.WritebackJournal)
+		}
+		if err := chain.SetPromotionPolicy(config.Promotion.policy()); err != nil {
+			log.Fatalf("Error setting the promotion policy: %v", err)
+		}
+		debugLogging = debugLogging || config.Debug
+		fs = chain
 	} else {
 		// Legacy command line arguments
 		if masterDir == "" {
@@ -426,6 +1313,7 @@ func main() {
 				CanLock:   true, // Enable locking
 			},
 			RootPath: masterDir,
+			LockTTL:  mount.LockTTL,
 		})
 		if err != nil {
 			log.Fatal(err)
@@ -439,7 +1327,7 @@ func main() {
 
 	// Start the file server in a goroutine
 	go func() {
-		if err := startFileServer(fs, serverAddr); err != nil {
+		if err := startFileServer(fs, serverAddr, adminToken); err != nil {
 			log.Printf("File server error: %v", err)
 			close(done)
 		}
@@ -464,7 +1352,7 @@ func main() {
 	}()
 
 	// Start FUSE
-	if err := startFUSE(mountpoint, serverURL, done); err != nil {
+	if err := startFUSE(mountpoint, serverURL, mount, done); err != nil {
 		cleanup(mountpoint)
 		log.Fatal(err)
 	}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestLockOwnersReachTheLockChecks(t *testing.T) {
+	root := t.TempDir()
+	local, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleMain,
+		Features: FileSystemFeatures{CanUpdate: true, CanDelete: true, CanLock: true},
+		RootPath: root,
+		LockTTL:  defaultLockTTL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newFileServerMux(local, ""))
+	t.Cleanup(server.Close)
+	if err := os.WriteFile(filepath.Join(root, "f"), []byte("before"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(client, pid, handle string) url.Values {
+		q := url.Values{"path": {"/f"}, "type": {"1"}}
+		if client != "" {
+			q.Set("client", client)
+		}
+		if pid != "" {
+			q.Set("pid", pid)
+		}
+		if handle != "" {
+			q.Set("handle", handle)
+		}
+		return q
+	}
+	write := func(q url.Values, content string) int {
+		body, err := json.Marshal(FileInfo{Content: []byte(content), Mode: 0644})
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, _ := post(t, server.URL, "write", q, body)
+		return status
+	}
+	content := func() string {
+		data, err := os.ReadFile(filepath.Join(root, "f"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// Locks need a real process; negative pids are kept for the server's own work
+	for _, pid := range []string{"", "0", "-1", "x"} {
+		if status, body := post(t, server.URL, "lock", query("a", pid, "1"), nil); status != http.StatusBadRequest {
+			t.Errorf("lock with pid %q = %d %s, want %d", pid, status, body, http.StatusBadRequest)
+		}
+	}
+
+	holder := query("a", "1", "1")
+	if status, body := post(t, server.URL, "lock", holder, nil); status != http.StatusOK {
+		t.Fatalf("lock = %d %s", status, body)
+	}
+	if status := write(holder, "holder"); status != http.StatusOK {
+		t.Errorf("write by the holder = %d", status)
+	}
+	// Another handle of the same process can join the lock and write through it
+	sibling := query("a", "1", "2")
+	if status, body := post(t, server.URL, "lock", sibling, nil); status != http.StatusOK {
+		t.Fatalf("lock by another handle of the holding process = %d %s", status, body)
+	}
+	if status := write(sibling, "sibling"); status != http.StatusOK {
+		t.Errorf("write by another handle of the holding process = %d", status)
+	}
+	if status, body := post(t, server.URL, "unlock", sibling, nil); status != http.StatusOK {
+		t.Fatalf("unlock = %d %s", status, body)
+	}
+
+	// Other processes, the same pid on another client, and anonymous
+	// requests are all kept out
+	for _, q := range []url.Values{query("a", "2", "1"), query("b", "1", "1"), query("", "", "")} {
+		if status := write(q, "intruder"); status == http.StatusOK {
+			t.Errorf("write as %v got through the lock", q)
+		}
+	}
+	if got := content(); got != "sibling" {
+		t.Errorf("file holds %q, want %q", got, "sibling")
+	}
+
+	if status, _ := post(t, server.URL, "unlock", query("b", "1", "1"), nil); status != http.StatusForbidden {
+		t.Errorf("unlock by another owner = %d, want %d", status, http.StatusForbidden)
+	}
+	if status, body := post(t, server.URL, "unlock", holder, nil); status != http.StatusOK {
+		t.Fatalf("unlock = %d %s", status, body)
+	}
+	if status := write(query("b", "1", "1"), "after"); status != http.StatusOK {
+		t.Errorf("write after the unlock = %d", status)
+	}
+	if got := content(); got != "after" {
+		t.Errorf("file holds %q, want %q", got, "after")
+	}
+}
+
+func TestLockAndDeleteThroughTheChain(t *testing.T) {
+	root := t.TempDir()
+	local, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleMain,
+		Features: FileSystemFeatures{CanUpdate: true, CanDelete: true, CanLock: true},
+		RootPath: root,
+		LockTTL:  defaultLockTTL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChainFS([]ServerFS{local}, nil)
+	t.Cleanup(chain.background.Wait)
+	server := httptest.NewServer(newFileServerMux(chain, ""))
+	t.Cleanup(server.Close)
+	if err := os.WriteFile(filepath.Join(root, "f"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	owner := url.Values{"path": {"/f"}, "client": {"a"}, "pid": {"1"}}
+	withType := func(lockType string) url.Values {
+		q := url.Values{"type": {lockType}}
+		for key, values := range owner {
+			q[key] = values
+		}
+		return q
+	}
+	isLocked := func() LockStatus {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/islocked?path=/f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var status LockStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	for _, lockType := range []string{"", "-1", "3", "write"} {
+		if status, body := post(t, server.URL, "lock", withType(lockType), nil); status != http.StatusBadRequest {
+			t.Errorf("lock of type %q = %d %s, want %d", lockType, status, body, http.StatusBadRequest)
+		}
+	}
+	if resp, err := http.Get(server.URL + "/lock?" + withType("1").Encode()); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /lock = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	if status, body := post(t, server.URL, "lock", withType("1"), nil); status != http.StatusOK {
+		t.Fatalf("lock = %d %s", status, body)
+	}
+	if status := isLocked(); !status.Locked || status.LockType != WriteLock {
+		t.Errorf("islocked = %+v, want a write lock", status)
+	}
+	other := url.Values{"path": {"/f"}, "client": {"b"}, "pid": {"1"}, "type": {"0"}}
+	if status, _ := post(t, server.URL, "lock", other, nil); status != http.StatusConflict {
+		t.Errorf("conflicting lock = %d, want %d", status, http.StatusConflict)
+	}
+	if status, _ := post(t, server.URL, "delete", url.Values{"path": {"/f"}}, nil); status != http.StatusConflict {
+		t.Errorf("delete of a locked file = %d, want %d", status, http.StatusConflict)
+	}
+
+	if status, body := post(t, server.URL, "unlock", owner, nil); status != http.StatusOK {
+		t.Fatalf("unlock = %d %s", status, body)
+	}
+	if status, _ := post(t, server.URL, "unlock", owner, nil); status != http.StatusConflict {
+		t.Errorf("unlock of an unlocked file = %d, want %d", status, http.StatusConflict)
+	}
+	if status := isLocked(); status.Locked {
+		t.Errorf("islocked after the unlock = %+v", status)
+	}
+
+	if status, body := post(t, server.URL, "delete", url.Values{"path": {"/f"}}, nil); status != http.StatusOK {
+		t.Fatalf("delete = %d %s", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(root, "f")); !os.IsNotExist(err) {
+		t.Errorf("the file survived the delete: %v", err)
+	}
+	if status, _ := post(t, server.URL, "delete", url.Values{"path": {"/f"}}, nil); status != http.StatusNotFound {
+		t.Errorf("delete of a missing file = %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestWriteAtStreamsRangesIntoEveryLayer(t *testing.T) {
+	chain, cache := newTestChain(t)
+	server := httptest.NewServer(newFileServerMux(chain, ""))
+	t.Cleanup(server.Close)
+	writeAt := func(offset string, data []byte) int {
+		status, _ := post(t, server.URL, "writeat", url.Values{"path": {"/f"}, "offset": {offset}}, data)
+		return status
+	}
+
+	for _, offset := range []string{"", "-1", "x"} {
+		if status := writeAt(offset, []byte("a")); status != http.StatusBadRequest {
+			t.Errorf("writeat at offset %q = %d, want %d", offset, status, http.StatusBadRequest)
+		}
+	}
+
+	// The first write creates the file, later ones patch it and extend it
+	// past a hole
+	if status := writeAt("0", []byte("hello world")); status != http.StatusOK {
+		t.Fatalf("writeat = %d", status)
+	}
+	if status := writeAt("6", []byte("there")); status != http.StatusOK {
+		t.Fatalf("writeat = %d", status)
+	}
+	if status := writeAt("13", []byte("!")); status != http.StatusOK {
+		t.Fatalf("writeat = %d", status)
+	}
+	want := "hello there\x00\x00!"
+	for i, fs := range chain.filesystems {
+		if content, err := fs.Read("/f"); err != nil || string(content) != want {
+			t.Errorf("layer %d has %q, %v, want %q", i, content, err, want)
+		}
+	}
+
+	// Bodies larger than a chunk arrive whole
+	large := bytes.Repeat([]byte("0123456789"), writeChunkSize/4)
+	if status := writeAt("0", large); status != http.StatusOK {
+		t.Fatalf("writeat = %d", status)
+	}
+	if content, err := cache.Read("/f"); err != nil || !bytes.Equal(content, large) {
+		t.Errorf("cache has %d bytes, %v, want the %d written", len(content), err, len(large))
+	}
+}
+
+func TestAdminListsAndBreaksLocks(t *testing.T) {
+	root := t.TempDir()
+	local, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleMain,
+		Features: FileSystemFeatures{CanUpdate: true, CanDelete: true, CanLock: true},
+		RootPath: root,
+		LockTTL:  defaultLockTTL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"d/a", "d/b", "dd", "e"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := httptest.NewServer(newFileServerMux(local, "secret"))
+	t.Cleanup(server.Close)
+	disabled := httptest.NewServer(newFileServerMux(local, ""))
+	t.Cleanup(disabled.Close)
+
+	ctx := context.Background()
+	a := LockOwner{ClientID: "a", Pid: 1, HandleID: 1}
+	b := LockOwner{ClientID: "b", Pid: 2, HandleID: 2}
+	for _, lock := range []struct {
+		path     string
+		lockType LockType
+		owner    LockOwner
+	}{{"/d/a", ReadLock, a}, {"/d/b", WriteLock, b}, {"/dd", WriteLock, a}, {"/e", WriteLock, b}} {
+		if _, err := local.Lock(ctx, lock.path, lock.lockType, lock.owner, LockOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := local.LockRange(ctx, "/d/a", RangeLock{Start: 0, End: 9, Type: WriteLock, Owner: b}, LockOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Listing /d covers the file and range locks below it, but not /dd beside it
+	resp, err := http.Get(server.URL + "/locks?prefix=/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var locks []LockInfo
+	err = json.NewDecoder(resp.Body).Decode(&locks)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type listed struct {
+		path     string
+		lockType LockType
+		owner    LockOwner
+		rangeEnd int64
+	}
+	var got []listed
+	for _, lock := range locks {
+		if lock.Acquired.IsZero() || lock.Expires.IsZero() {
+			t.Errorf("lock on %s listed without its lease times", lock.Path)
+		}
+		got = append(got, listed{lock.Path, lock.LockType, lock.Owner, lock.End})
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].path+got[i].owner.ClientID < got[j].path+got[j].owner.ClientID })
+	want := []listed{{"/d/a", ReadLock, a, 0}, {"/d/a", WriteLock, b, 9}, {"/d/b", WriteLock, b, 0}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listed %+v, want %+v", got, want)
+	}
+
+	// Breaking locks takes the admin token
+	forceUnlock := func(baseURL, token string) int {
+		req, err := http.NewRequest(http.MethodPost, baseURL+"/forceunlock?path=/d/b", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := forceUnlock(disabled.URL, "secret"); status != http.StatusForbidden {
+		t.Errorf("force-unlock without an admin token configured = %d, want %d", status, http.StatusForbidden)
+	}
+	for _, token := range []string{"", "wrong"} {
+		if status := forceUnlock(server.URL, token); status != http.StatusUnauthorized {
+			t.Errorf("force-unlock with token %q = %d, want %d", token, status, http.StatusUnauthorized)
+		}
+	}
+
+	// A waiter gets the broken lock
+	granted := make(chan error, 1)
+	go func() {
+		_, err := local.Lock(ctx, "/d/b", WriteLock, a, LockOptions{Wait: true})
+		granted <- err
+	}()
+	for status, _ := local.IsLocked("/d/b"); status.Waiters == 0; status, _ = local.IsLocked("/d/b") {
+		time.Sleep(time.Millisecond)
+	}
+	if status := forceUnlock(server.URL, "secret"); status != http.StatusOK {
+		t.Fatalf("force-unlock = %d", status)
+	}
+	select {
+	case err := <-granted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiter was not woken by the force-unlock")
+	}
+	if err := local.Unlock("/d/b", b); err == nil {
+		t.Error("the old owner could still release the broken lock")
+	}
+}
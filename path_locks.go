@@ -0,0 +1,78 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// pathLockStripes is the number of mutexes paths are spread over. Paths that
+// share a stripe serialize, so it only needs to be large enough to make that
+// rare among the files in use at the same time.
+const pathLockStripes = 256
+
+// pathLocks serializes the operations of a ChainFS per path. Operations on
+// one path take its stripe, shared to read and exclusive to change it, so
+// reads and writes of different files run in parallel. Every operation also
+// holds the tree lock shared; an operation that changes whole subtrees, like a
+// directory rename, takes it exclusively and runs alone.
+type pathLocks struct {
+	tree    sync.RWMutex
+	stripes [pathLockStripes]sync.RWMutex
+}
+
+// stripeIndexes returns the stripes of paths in ascending order without
+// duplicates. Taking stripes in that order keeps two operations that lock the
+// same pair of paths from deadlocking.
+func (p *pathLocks) stripeIndexes(paths []string) []int {
+	seen := make(map[int]bool, len(paths))
+	var indexes []int
+	for _, path := range paths {
+		h := fnv.New32a()
+		h.Write([]byte(lockPath(path)))
+		i := int(h.Sum32() % pathLockStripes)
+		if !seen[i] {
+			seen[i] = true
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// RLock locks paths for reading and returns the function that unlocks them
+func (p *pathLocks) RLock(paths ...string) func() {
+	indexes := p.stripeIndexes(paths)
+	p.tree.RLock()
+	for _, i := range indexes {
+		p.stripes[i].RLock()
+	}
+	return func() {
+		for j := len(indexes) - 1; j >= 0; j-- {
+			p.stripes[indexes[j]].RUnlock()
+		}
+		p.tree.RUnlock()
+	}
+}
+
+// Lock locks paths for writing and returns the function that unlocks them
+func (p *pathLocks) Lock(paths ...string) func() {
+	indexes := p.stripeIndexes(paths)
+	p.tree.RLock()
+	for _, i := range indexes {
+		p.stripes[i].Lock()
+	}
+	return func() {
+		for j := len(indexes) - 1; j >= 0; j-- {
+			p.stripes[indexes[j]].Unlock()
+		}
+		p.tree.RUnlock()
+	}
+}
+
+// LockTree waits for every running operation to finish and keeps new ones out
+// until the returned function is called
+func (p *pathLocks) LockTree() func() {
+	p.tree.Lock()
+	return p.tree.Unlock
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PromotionPolicy decides which files a read copies from the layer that has
+// them into the earlier, writable layers of the chain. The zero policy
+// promotes every regular file on its first read.
+type PromotionPolicy struct {
+	MinAccesses int      // Reads of a file before it is promoted, 0 and 1 promote on the first read
+	MaxSize     int64    // Larger files are not promoted, 0 for no limit
+	Include     []string // Only matching files are promoted, when set
+	Exclude     []string // Matching files are never promoted
+	SkipScans   bool     // Don't promote files read once by a scan of their directory
+	ScanFiles   int      // Different files read once from one directory that make a scan
+}
+
+// promoteOwner is the lock owner promotions read and write as. Filesystems
+// let it past their locks, so that the locks of the clients reading a file
+// do not keep it out of the cache.
+var promoteOwner = LockOwner{ClientID: "promotion", Pid: -1}
+
+// promotionCopyPrefix starts the names of the hidden copies background
+// promotions make next to the file before moving them into place
+const promotionCopyPrefix = ".go-sync-fs-promote."
+
+// promotionCopyPath returns the name of the n-th hidden copy of path
+func promotionCopyPath(path string, n uint64) string {
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf("%s%d", promotionCopyPrefix, n))
+}
+
+// isPromotionCopy reports whether path names a hidden copy of a promotion.
+// Like whiteouts, they are never listed and cannot be created by clients.
+func isPromotionCopy(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), promotionCopyPrefix)
+}
+
+// defaultScanFiles is the number of files read once from a directory after
+// which its reads are taken for a scan, when the policy does not say
+const defaultScanFiles = 32
+
+// scanWindow is how long a directory has to go without a new file being read
+// before a scan of it is over
+const scanWindow = 30 * time.Second
+
+// maxPromotionCandidates bounds the number of files and directories whose
+// reads are counted; the one read least recently is forgotten
+const maxPromotionCandidates = 65536
+
+// validate checks the globs of the policy and fills in its defaults
+func (p *PromotionPolicy) validate() error {
+	if p.MinAccesses < 0 || p.MaxSize < 0 || p.ScanFiles < 0 {
+		return fmt.Errorf("promotion limits must not be negative")
+	}
+	for _, pattern := range append(append([]string(nil), p.Include...), p.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid promotion pattern %q: %v", pattern, err)
+		}
+	}
+	if p.ScanFiles == 0 {
+		p.ScanFiles = defaultScanFiles
+	}
+	return nil
+}
+
+// matches reports whether a glob matches path or a directory above it. Globs
+// with a slash are matched against the whole path from the root of the
+// chain, the others against a single name.
+func matches(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		for p := lockPath(path); p != "/"; p = filepath.Dir(p) {
+			name := filepath.Base(p)
+			if strings.Contains(pattern, "/") {
+				name = p
+			}
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PromotionStats counts the promotion decisions of a chain. It is the
+// response body of the /debug/promotion endpoint.
+type PromotionStats struct {
+	Promoted        uint64 // Files copied into an earlier layer
+	PromotedBytes   uint64
+	Failed          uint64 // Copies that could not be written
+	SkippedAccesses uint64 // Reads of files not read often enough yet
+	SkippedSize     uint64 // Reads of files over the size limit
+	SkippedPattern  uint64 // Reads of files left out by the globs
+	SkippedScan     uint64 // Reads by a directory scan
+}
+
+// PromotionReporter is implemented by filesystems that count promotions
+type PromotionReporter interface {
+	PromotionStats() PromotionStats
+}
+
+// readCount is how often a file or directory has been read recently
+type readCount struct {
+	reads int
+	last  time.Time
+}
+
+// promoter applies a chain's promotion policy and keeps its statistics
+type promoter struct {
+	mutex  sync.Mutex
+	policy PromotionPolicy
+	files  *lruMap[string, *readCount] // Reads of files not promoted yet
+	dirs   *lruMap[string, *readCount] // Files read once per directory, while a scan may be going on
+	stats  PromotionStats
+}
+
+// SetPromotionPolicy replaces the rules by which reads fill the earlier
+// layers of the chain
+func (c *ChainFS) SetPromotionPolicy(policy PromotionPolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+
+	c.promotion.mutex.Lock()
+	defer c.promotion.mutex.Unlock()
+
+	c.promotion.policy = policy
+	c.promotion.files = nil
+	c.promotion.dirs = nil
+	return nil
+}
+
+// PromotionStats returns the promotion decisions made so far
+func (c *ChainFS) PromotionStats() PromotionStats {
+	c.promotion.mutex.Lock()
+	defer c.promotion.mutex.Unlock()
+
+	return c.promotion.stats
+}
+
+// count records a read of path and returns how often it has been read, and
+// how many different files of its directory have been read once lately
+func (p *promoter) count(path string, now time.Time) (reads, dirReads int) {
+	if p.files == nil {
+		p.files = newLRUMap[string, *readCount](maxPromotionCandidates)
+		p.dirs = newLRUMap[string, *readCount](maxPromotionCandidates)
+	}
+
+	file := touch(p.files, lockPath(path), now)
+	file.reads++
+	dir := touch(p.dirs, filepath.Dir(lockPath(path)), now)
+	if file.reads == 1 {
+		if now.Sub(dir.last) > scanWindow {
+			dir.reads = 0
+		}
+		dir.reads++
+		dir.last = now
+	}
+	file.last = now
+	return file.reads, dir.reads
+}
+
+// touch returns the count of key, making room for it when it is new
+func touch(counts *lruMap[string, *readCount], key string, now time.Time) *readCount {
+	if count, exists := counts.get(key); exists {
+		return count
+	}
+
+	count := &readCount{last: now}
+	counts.put(key, count)
+	return count
+}
+
+// decide counts a read of a file of the given size and reports whether the
+// file should be promoted now
+func (p *promoter) decide(path string, size int64) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	policy := p.policy
+	reads, dirReads := p.count(path, time.Now())
+
+	var reason string
+	switch {
+	case policy.MaxSize > 0 && size > policy.MaxSize:
+		p.stats.SkippedSize++
+		reason = fmt.Sprintf("%d bytes is over the limit of %d", size, policy.MaxSize)
+	case len(policy.Include) > 0 && !matches(policy.Include, path):
+		p.stats.SkippedPattern++
+		reason = "not included"
+	case matches(policy.Exclude, path):
+		p.stats.SkippedPattern++
+		reason = "excluded"
+	case policy.SkipScans && reads == 1 && dirReads > policy.ScanFiles:
+		p.stats.SkippedScan++
+		reason = fmt.Sprintf("%s is being scanned", filepath.Dir(lockPath(path)))
+	case reads < policy.MinAccesses:
+		p.stats.SkippedAccesses++
+		reason = fmt.Sprintf("read %d of %d times", reads, policy.MinAccesses)
+	}
+	if reason != "" {
+		debugf("Not promoting %s: %s", path, reason)
+		return false
+	}
+
+	p.files.remove(lockPath(path))
+	return true
+}
+
+// promoted records the outcome of copying a file into one earlier layer
+func (p *promoter) promoted(path string, size int64, layer int, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err != nil {
+		p.stats.Failed++
+		log.Printf("Error promoting %s to layer %d: %v", path, layer, err)
+		return
+	}
+	p.stats.Promoted++
+	p.stats.PromotedBytes += uint64(size)
+	debugf("Promoted %s (%d bytes) to layer %d", path, size, layer)
+}
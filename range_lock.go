@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// rangeEOF is the End of a range lock that extends to the end of the file
+const rangeEOF = math.MaxInt64
+
+// RangeLock is an advisory lock on the bytes Start through End (inclusive) of
+// a file, as taken by fcntl(F_SETLK) or, covering the whole file, flock()
+type RangeLock struct {
+	Start    int64
+	End      int64    // Inclusive, rangeEOF for a lock up to the end of the file
+	Type     LockType // ReadLock or WriteLock
+	Flock    bool     // flock() locks only conflict with other flock() locks
+	Owner    LockOwner
+	Pid      int // Process that took the lock, for reporting only
+	Acquired time.Time
+	Expires  time.Time // Zero for a lock that never expires
+}
+
+func (l RangeLock) overlaps(o RangeLock) bool {
+	return l.Flock == o.Flock && l.Start <= o.End && o.Start <= l.End
+}
+
+// conflicts reports whether l and o cannot both be held
+func (l RangeLock) conflicts(o RangeLock) bool {
+	return l.Owner != o.Owner && l.overlaps(o) && (l.Type == WriteLock || o.Type == WriteLock)
+}
+
+// RangeLockTable tracks the byte-range locks held on paths
+type RangeLockTable struct {
+	mutex   sync.Mutex
+	locks   map[string][]RangeLock
+	changed chan struct{} // Closed and replaced whenever locks are removed
+	ttl     time.Duration // Lease length, 0 for locks that never expire
+	journal *lockJournal  // Persists lock changes, nil if locks are not persisted
+}
+
+// NewRangeLockTable creates an empty range lock table whose leases last ttl
+func NewRangeLockTable(ttl time.Duration) *RangeLockTable {
+	return &RangeLockTable{
+		locks:   make(map[string][]RangeLock),
+		changed: make(chan struct{}),
+		ttl:     ttl,
+	}
+}
+
+// Lock takes lock on path, replacing whatever the owner already held in that
+// range, the way POSIX locks merge and split. A conflicting request fails with
+// ErrAlreadyLocked unless opts.Wait is set, in which case it blocks until the
+// conflict is gone or ctx is done.
+func (t *RangeLockTable) Lock(ctx context.Context, path string, lock RangeLock, opts LockOptions) error {
+	path = lockPath(path)
+	for {
+		t.mutex.Lock()
+		now := time.Now()
+		t.expire(path, now)
+
+		conflict, found := t.conflict(path, lock)
+		if !found {
+			t.remove(path, lock.Owner, lock.Flock, lock.Start, lock.End)
+			lock.Acquired = now
+			if t.ttl > 0 {
+				lock.Expires = now.Add(t.ttl)
+			}
+			t.locks[path] = append(t.locks[path], lock)
+			t.persist(path)
+			t.unlock()
+			return nil
+		}
+		changed := t.changed
+		t.mutex.Unlock()
+
+		if !opts.Wait {
+			return fmt.Errorf("bytes %d-%d are locked by %s: %w", conflict.Start, conflict.End, conflict.Owner, ErrAlreadyLocked)
+		}
+
+		// Wake up when a lock is released, or when the conflicting lease lapses
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !conflict.Expires.IsZero() {
+			timer = time.NewTimer(time.Until(conflict.Expires))
+			expired = timer.C
+		}
+
+		select {
+		case <-changed:
+		case <-expired:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: gave up waiting: %v", ErrAlreadyLocked, ctx.Err())
+		}
+	}
+}
+
+// Unlock releases the owner's locks of the same kind within lock's range
+func (t *RangeLockTable) Unlock(path string, lock RangeLock) {
+	path = lockPath(path)
+	t.mutex.Lock()
+	defer t.unlock()
+
+	t.remove(path, lock.Owner, lock.Flock, lock.Start, lock.End)
+}
+
+// Query returns a lock that conflicts with lock, if there is one
+func (t *RangeLockTable) Query(path string, lock RangeLock) (RangeLock, bool) {
+	path = lockPath(path)
+	t.mutex.Lock()
+	defer t.unlock()
+
+	t.expire(path, time.Now())
+	return t.conflict(path, lock)
+}
+
+// Renew extends the leases of every range lock clientID holds on path
+func (t *RangeLockTable) Renew(path string, clientID string) {
+	if t.ttl <= 0 {
+		return
+	}
+
+	path = lockPath(path)
+	t.mutex.Lock()
+	defer t.unlock()
+
+	expires := time.Now().Add(t.ttl)
+	renewed := false
+	for i := range t.locks[path] {
+		if t.locks[path][i].Owner.ClientID == clientID {
+			t.locks[path][i].Expires = expires
+			renewed = true
+		}
+	}
+	if renewed {
+		t.persist(path)
+	}
+}
+
+// List returns a LockInfo for every range lock at or below prefix
+func (t *RangeLockTable) List(prefix string) []LockInfo {
+	prefix = lockPath(prefix)
+	t.mutex.Lock()
+	defer t.unlock()
+
+	var infos []LockInfo
+	for path, locks := range t.locks {
+		if !hasPathPrefix(path, prefix) {
+			continue
+		}
+		for _, held := range locks {
+			infos = append(infos, LockInfo{
+				Path:     path,
+				LockType: held.Type,
+				Owner:    held.Owner,
+				Acquired: held.Acquired,
+				Expires:  held.Expires,
+				Range:    true,
+				Start:    held.Start,
+				End:      held.End,
+				Flock:    held.Flock,
+			})
+		}
+	}
+	return infos
+}
+
+// Break drops every range lock on path. It reports whether there were any.
+func (t *RangeLockTable) Break(path string) bool {
+	path = lockPath(path)
+	t.mutex.Lock()
+	defer t.unlock()
+
+	if _, exists := t.locks[path]; !exists {
+		return false
+	}
+	delete(t.locks, path)
+	t.persist(path)
+	t.notify()
+	return true
+}
+
+// Rename moves the locks on oldPath and everything below it to newPath
+func (t *RangeLockTable) Rename(oldPath, newPath string) {
+	oldPath, newPath = lockPath(oldPath), lockPath(newPath)
+	t.mutex.Lock()
+	defer t.unlock()
+
+	for path, locks := range t.locks {
+		if moved, ok := renamedPath(path, oldPath, newPath); ok {
+			delete(t.locks, path)
+			t.locks[moved] = locks
+			t.persist(path)
+			t.persist(moved)
+		}
+	}
+}
+
+// conflict returns the first lock on path that conflicts with lock. The
+// caller must hold t.mutex.
+func (t *RangeLockTable) conflict(path string, lock RangeLock) (RangeLock, bool) {
+	for _, held := range t.locks[path] {
+		if held.conflicts(lock) {
+			return held, true
+		}
+	}
+	return RangeLock{}, false
+}
+
+// remove cuts start through end out of owner's locks on path, splitting
+// locks that extend past either side. The caller must hold t.mutex.
+func (t *RangeLockTable) remove(path string, owner LockOwner, flock bool, start, end int64) {
+	var kept []RangeLock
+	removed := false
+	for _, held := range t.locks[path] {
+		if held.Owner != owner || held.Flock != flock || held.End < start || held.Start > end {
+			kept = append(kept, held)
+			continue
+		}
+		removed = true
+
+		if held.Start < start {
+			left := held
+			left.End = start - 1
+			kept = append(kept, left)
+		}
+		if held.End > end {
+			right := held
+			right.Start = end + 1
+			kept = append(kept, right)
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(t.locks, path)
+	} else {
+		t.locks[path] = kept
+	}
+	if removed {
+		t.persist(path)
+		t.notify()
+	}
+}
+
+// expire drops the locks on path whose lease has lapsed. The caller must
+// hold t.mutex.
+func (t *RangeLockTable) expire(path string, now time.Time) {
+	var kept []RangeLock
+	for _, held := range t.locks[path] {
+		if held.Expires.IsZero() || !now.After(held.Expires) {
+			kept = append(kept, held)
+			continue
+		}
+		log.Printf("Range lock on bytes %d-%d of %s held by %s expired without renewal",
+			held.Start, held.End, path, held.Owner)
+	}
+
+	if len(kept) == len(t.locks[path]) {
+		return
+	}
+	if len(kept) == 0 {
+		delete(t.locks, path)
+	} else {
+		t.locks[path] = kept
+	}
+	t.persist(path)
+	t.notify()
+}
+
+// restore loads the range locks recorded in journal and persists later
+// changes to it. It must be called before the table is used.
+func (t *RangeLockTable) restore(journal *lockJournal) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, record := range journal.records(journalRangeLock) {
+		t.locks[lockPath(record.Path)] = record.Ranges
+	}
+	t.journal = journal
+}
+
+// unlock releases t.mutex, then waits until the lock changes made while it
+// was held are in the journal
+func (t *RangeLockTable) unlock() {
+	t.mutex.Unlock()
+	if t.journal != nil {
+		t.journal.Sync()
+	}
+}
+
+// persist stages the current range locks on path for the journal. The caller
+// must hold t.mutex.
+func (t *RangeLockTable) persist(path string) {
+	if t.journal == nil {
+		return
+	}
+	t.journal.Stage(journalRecord{Kind: journalRangeLock, Path: path, Ranges: t.locks[path]})
+}
+
+// notify wakes every waiter so it can check for its lock again. The caller
+// must hold t.mutex.
+func (t *RangeLockTable) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// heldRanges returns the ranges owner holds on path, in order
+func heldRanges(table *RangeLockTable, path string, owner LockOwner) [][3]int64 {
+	var ranges [][3]int64
+	for _, info := range table.List(path) {
+		if info.Owner == owner {
+			ranges = append(ranges, [3]int64{info.Start, info.End, int64(info.LockType)})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	return ranges
+}
+
+func TestRangeLocksSplitAndMerge(t *testing.T) {
+	table := NewRangeLockTable(0)
+	ctx := context.Background()
+	a := LockOwner{ClientID: "a", Pid: 1, HandleID: 1}
+	b := LockOwner{ClientID: "b", Pid: 2, HandleID: 2}
+	lock := func(owner LockOwner, start, end int64, lockType LockType) error {
+		return table.Lock(ctx, "/f", RangeLock{Start: start, End: end, Type: lockType, Owner: owner}, LockOptions{})
+	}
+
+	if err := lock(a, 0, 99, WriteLock); err != nil {
+		t.Fatal(err)
+	}
+	// A read lock over the end of the write lock replaces that part of it
+	if err := lock(a, 50, 149, ReadLock); err != nil {
+		t.Fatal(err)
+	}
+	want := [][3]int64{{0, 49, int64(WriteLock)}, {50, 149, int64(ReadLock)}}
+	if got := heldRanges(table, "/f", a); !reflect.DeepEqual(got, want) {
+		t.Fatalf("a holds %v, want %v", got, want)
+	}
+
+	// Other owners can share the read part but not the write part
+	if err := lock(b, 60, 70, ReadLock); err != nil {
+		t.Errorf("read lock on a's read range: %v", err)
+	}
+	if err := lock(b, 10, 20, WriteLock); !errors.Is(err, ErrAlreadyLocked) {
+		t.Errorf("write lock on a's write range = %v, want %v", err, ErrAlreadyLocked)
+	}
+	if held, found := table.Query("/f", RangeLock{Start: 10, End: 20, Type: ReadLock, Owner: b}); !found || held.Owner != a || held.End != 49 {
+		t.Errorf("Query = %+v, %v, want a's write lock", held, found)
+	}
+
+	// Unlocking the middle of a range splits it in two
+	table.Unlock("/f", RangeLock{Start: 20, End: 29, Owner: a})
+	want = [][3]int64{{0, 19, int64(WriteLock)}, {30, 49, int64(WriteLock)}, {50, 149, int64(ReadLock)}}
+	if got := heldRanges(table, "/f", a); !reflect.DeepEqual(got, want) {
+		t.Fatalf("a holds %v after the unlock, want %v", got, want)
+	}
+	if err := lock(b, 20, 29, WriteLock); err != nil {
+		t.Errorf("write lock on the unlocked gap: %v", err)
+	}
+
+	// flock() locks live apart from fcntl() ones
+	if err := table.Lock(ctx, "/f", RangeLock{Start: 0, End: rangeEOF, Type: WriteLock, Flock: true, Owner: b}, LockOptions{}); err != nil {
+		t.Errorf("flock next to fcntl locks: %v", err)
+	}
+
+	// Unlocking everything drops only a's fcntl locks
+	table.Unlock("/f", RangeLock{Start: 0, End: rangeEOF, Owner: a})
+	if got := heldRanges(table, "/f", a); got != nil {
+		t.Errorf("a still holds %v", got)
+	}
+	if got := heldRanges(table, "/f", b); len(got) != 3 {
+		t.Errorf("b holds %v, want its 3 locks", got)
+	}
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 // FileSystemFeatures represents the capabilities of a filesystem
@@ -34,20 +40,77 @@ const (
 	ExclusiveLock
 )
 
-// FileLock represents a lock on a file
-type FileLock struct {
-	Path      string
-	LockType  LockType
-	CreatedAt time.Time
-	ProcessID int
+func (t LockType) String() string {
+	switch t {
+	case ReadLock:
+		return "read"
+	case WriteLock:
+		return "write"
+	case ExclusiveLock:
+		return "exclusive"
+	}
+	return fmt.Sprintf("LockType(%d)", int(t))
+}
+
+// LockOwner identifies who holds a lock: the client (node) that sent the
+// request, the process on that client and the file handle it opened
+type LockOwner struct {
+	ClientID string
+	Pid      int
+	HandleID uint64
+}
+
+func (o LockOwner) String() string {
+	return fmt.Sprintf("%s/pid %d/handle %d", o.ClientID, o.Pid, o.HandleID)
+}
+
+// sameProcess reports whether o and other are handles of one process, which
+// locks do not keep apart. Owners without a pid are only the same as
+// themselves.
+func (o LockOwner) sameProcess(other LockOwner) bool {
+	return o.process() == other.process()
 }
 
+// internal reports whether o is one of the server's own owners, flushOwner
+// or promoteOwner, which filesystems let past their locks. Clients cannot
+// pose as them, since parseLockOwner only takes positive pids.
+func (o LockOwner) internal() bool {
+	return o.Pid < 0
+}
+
+// Errors returned by lock-aware operations
+var (
+	ErrLockingNotSupported = errors.New("filesystem does not support locking")
+	ErrAlreadyLocked       = errors.New("file is already locked")
+	ErrNotLocked           = errors.New("file is not locked")
+	ErrLockNotOwned        = errors.New("lock belongs to a different owner")
+	ErrFileLocked          = errors.New("file is locked")
+	ErrStaleFence          = errors.New("fencing token is stale")
+)
+
+// ErrDeadlock is returned instead of waiting for a lock when the wait could
+// never end. It is an errno so that it reaches the process as EDEADLK.
+var ErrDeadlock error = syscall.EDEADLK
+
+// LinkPolicy controls how symlinks pointing outside a filesystem's root are handled
+type LinkPolicy string
+
+const (
+	LinkPolicyAllow LinkPolicy = "allow" // Create and report such links verbatim
+	LinkPolicyDeny  LinkPolicy = "deny"  // Refuse to create or resolve them
+	LinkPolicyHide  LinkPolicy = "hide"  // Refuse to create them and leave them out of listings
+)
+
 // FileSystemConfig holds the configuration for a filesystem
 type FileSystemConfig struct {
-	Role     FileSystemRole
-	MaxSize  int64 // bytes, only used for cache role
-	Features FileSystemFeatures
-	RootPath string
+	Role         FileSystemRole
+	MaxSize      int64 // bytes, only used for cache role
+	Features     FileSystemFeatures
+	RootPath     string
+	LinkPolicy   LinkPolicy      // defaults to LinkPolicyAllow
+	LockTTL      time.Duration   // lock lease length, 0 for locks that never expire
+	PersistLocks bool            // keep locks in a journal under RootPath across restarts
+	Coherency    CoherencyPolicy // how a cache checks its copies, defaults to CoherencyNotify
 }
 
 // ServerFS defines the interface that all filesystem implementations must satisfy
@@ -56,13 +119,37 @@ type ServerFS interface {
 	Info(path string) (FileInfo, error)
 	List(path string) ([]FileInfo, error)
 	Read(path string) ([]byte, error)
-	Write(path string, content []byte, mode os.FileMode) error
+	ReadAt(path string, buf []byte, offset int64, owner LockOwner) (int, error)
+	Write(path string, content []byte, mode os.FileMode, owner LockOwner) error
+	WriteAt(path string, data []byte, offset int64, owner LockOwner) (int, error)
+	Truncate(path string, size int64, owner LockOwner) error
+	SetAttr(path string, update AttrUpdate) error
 	Delete(path string) error
-
-	// Lock operations
-	Lock(path string, lockType LockType, processID int) error
-	Unlock(path string, processID int) error
-	IsLocked(path string) (bool, LockType, error)
+	Mkdir(path string, mode os.FileMode) error
+	Rmdir(path string) error
+	Rename(oldPath, newPath string) error
+
+	// Link operations
+	Symlink(target, path string) error
+	Readlink(path string) (string, error)
+	Link(oldPath, newPath string) error
+
+	// Extended attributes
+	GetXattr(path, name string) ([]byte, error)
+	SetXattr(path, name string, value []byte, flags int) error
+	ListXattr(path string) ([]string, error)
+	RemoveXattr(path, name string) error
+
+	// Whole-file and byte-range locks, and their administration
+	LockService
+	// Fence checks that owner holds the lock on path with the fencing token
+	// and keeps the lock from being handed on until the returned function
+	// is called, once the write the token guards is done
+	Fence(path string, owner LockOwner, token uint64) (func(), error)
+
+	// Cache coherency
+	Invalidate(path string) error
+	GetCoherency() CoherencyPolicy
 
 	// Metadata
 	GetFeatures() FileSystemFeatures
@@ -82,9 +169,10 @@ type LocalFS struct {
 	config    FileSystemConfig
 	root      string
 	mutex     sync.RWMutex
-	cacheList []CacheEntry // Only used when role is RoleCache
-	locks     map[string]FileLock
-	lockMutex sync.RWMutex
+	cacheList []CacheEntry    // Only used when role is RoleCache
+	pinned    map[string]bool // Cached files that must not be evicted
+	locks     *LockTable
+	ranges    *RangeLockTable
 }
 
 // NewLocalFS creates a new LocalFS instance
@@ -93,6 +181,29 @@ func NewLocalFS(config FileSystemConfig) (*LocalFS, error) {
 		return nil, errors.New("cache filesystem requires positive MaxSize")
 	}
 
+	switch config.LinkPolicy {
+	case "":
+		config.LinkPolicy = LinkPolicyAllow
+	case LinkPolicyAllow, LinkPolicyDeny, LinkPolicyHide:
+	default:
+		return nil, fmt.Errorf("invalid link policy: %s", config.LinkPolicy)
+	}
+
+	switch config.Coherency.Mode {
+	case "":
+		config.Coherency.Mode = CoherencyNotify
+	case CoherencyNotify, CoherencyMtime, CoherencyHash:
+	case CoherencyTTL:
+		if config.Coherency.TTL <= 0 {
+			return nil, errors.New("coherency mode ttl requires a positive coherency TTL")
+		}
+	default:
+		return nil, fmt.Errorf("invalid coherency mode: %s", config.Coherency.Mode)
+	}
+	if config.Coherency.TTL < 0 {
+		return nil, errors.New("coherency TTL must not be negative")
+	}
+
 	absRoot, err := filepath.Abs(config.RootPath)
 	if err != nil {
 		return nil, err
@@ -103,105 +214,187 @@ func NewLocalFS(config FileSystemConfig) (*LocalFS, error) {
 		return nil, err
 	}
 
-	return &LocalFS{
+	fs := &LocalFS{
 		config:    config,
 		root:      absRoot,
 		cacheList: make([]CacheEntry, 0),
-		locks:     make(map[string]FileLock),
-	}, nil
+		locks:     NewLockTable(config.LockTTL),
+		ranges:    NewRangeLockTable(config.LockTTL),
+	}
+
+	if config.PersistLocks && config.Features.CanLock {
+		journal, err := openLockJournal(filepath.Join(absRoot, lockJournalName))
+		if err != nil {
+			return nil, fmt.Errorf("error opening lock journal: %v", err)
+		}
+		fs.locks.restore(journal)
+		fs.ranges.restore(journal)
+	}
+
+	return fs, nil
 }
 
-// Lock implements file locking
-func (l *LocalFS) Lock(path string, lockType LockType, processID int) error {
+// Lock implements file locking, optionally waiting until the lock is free or
+// ctx is done. It returns the fencing token of owner's lease.
+func (l *LocalFS) Lock(ctx context.Context, path string, lockType LockType, owner LockOwner, opts LockOptions) (uint64, error) {
 	if !l.config.Features.CanLock {
-		return errors.New("filesystem does not support locking")
+		return 0, ErrLockingNotSupported
 	}
 
-	l.lockMutex.Lock()
-	defer l.lockMutex.Unlock()
+	if err := l.checkLockable(path); err != nil {
+		return 0, err
+	}
 
-	// Check if file exists
-	fullPath := filepath.Join(l.root, path)
-	if _, err := os.Stat(fullPath); err != nil {
+	return l.locks.Acquire(ctx, path, lockType, owner, opts)
+}
+
+// Fence checks a fencing token against the lock table
+func (l *LocalFS) Fence(path string, owner LockOwner, token uint64) (func(), error) {
+	if !l.config.Features.CanLock {
+		return nil, ErrLockingNotSupported
+	}
+
+	return l.locks.Fence(path, owner, token)
+}
+
+// checkLockable verifies that path exists. A cache need not hold every file
+// it locks, so there the chain checks instead.
+func (l *LocalFS) checkLockable(path string) error {
+	if l.config.Role == RoleCache {
+		return nil
+	}
+
+	fullPath, err := l.realPath("stat", path)
+	if err != nil {
 		return err
 	}
+	_, err = os.Stat(fullPath)
+	return err
+}
 
-	// Check existing lock
-	if existingLock, exists := l.locks[path]; exists {
-		// Allow multiple read locks
-		if existingLock.LockType == ReadLock && lockType == ReadLock {
-			return nil
-		}
-		return errors.New("file is already locked")
+// Unlock releases owner's hold on the lock of a file
+func (l *LocalFS) Unlock(path string, owner LockOwner) error {
+	if !l.config.Features.CanLock {
+		return ErrLockingNotSupported
 	}
 
-	// Create new lock
-	l.locks[path] = FileLock{
-		Path:      path,
-		LockType:  lockType,
-		CreatedAt: time.Now(),
-		ProcessID: processID,
+	return l.locks.Release(path, owner)
+}
+
+// Renew extends owner's lease on the lock of a file, along with the leases of
+// the byte-range locks its client holds on the file
+func (l *LocalFS) Renew(path string, owner LockOwner) error {
+	if !l.config.Features.CanLock {
+		return ErrLockingNotSupported
 	}
 
-	return nil
+	l.ranges.Renew(path, owner.ClientID)
+	return l.locks.Renew(path, owner)
 }
 
-// Unlock removes a lock on a file
-func (l *LocalFS) Unlock(path string, processID int) error {
+// IsLocked reports the lock on a file and how many owners hold it
+func (l *LocalFS) IsLocked(path string) (LockStatus, error) {
 	if !l.config.Features.CanLock {
-		return errors.New("filesystem does not support locking")
+		return LockStatus{}, ErrLockingNotSupported
 	}
 
-	l.lockMutex.Lock()
-	defer l.lockMutex.Unlock()
+	return l.locks.Status(path), nil
+}
 
-	lock, exists := l.locks[path]
-	if !exists {
-		return errors.New("file is not locked")
+// LockRange takes a byte-range lock on a file, optionally waiting for
+// conflicting locks to go away
+func (l *LocalFS) LockRange(ctx context.Context, path string, lock RangeLock, opts LockOptions) error {
+	if !l.config.Features.CanLock {
+		return ErrLockingNotSupported
 	}
 
-	if lock.ProcessID != processID {
-		return errors.New("lock belongs to different process")
+	if err := l.checkLockable(path); err != nil {
+		return err
 	}
 
-	delete(l.locks, path)
+	return l.ranges.Lock(ctx, path, lock, opts)
+}
+
+// UnlockRange releases the owner's byte-range locks within lock's range
+func (l *LocalFS) UnlockRange(path string, lock RangeLock) error {
+	if !l.config.Features.CanLock {
+		return ErrLockingNotSupported
+	}
+
+	l.ranges.Unlock(path, lock)
 	return nil
 }
 
-// IsLocked checks if a file is locked
-func (l *LocalFS) IsLocked(path string) (bool, LockType, error) {
+// QueryRange returns a byte-range lock that would block lock, if any
+func (l *LocalFS) QueryRange(path string, lock RangeLock) (RangeLock, bool, error) {
 	if !l.config.Features.CanLock {
-		return false, 0, errors.New("filesystem does not support locking")
+		return RangeLock{}, false, ErrLockingNotSupported
 	}
 
-	l.lockMutex.RLock()
-	defer l.lockMutex.RUnlock()
+	conflict, found := l.ranges.Query(path, lock)
+	return conflict, found, nil
+}
 
-	if lock, exists := l.locks[path]; exists {
-		return true, lock.LockType, nil
+// ListLocks returns every whole-file and byte-range lock holder at or below prefix
+func (l *LocalFS) ListLocks(prefix string) ([]LockInfo, error) {
+	if !l.config.Features.CanLock {
+		return nil, ErrLockingNotSupported
 	}
 
-	return false, 0, nil
+	return append(l.locks.List(prefix), l.ranges.List(prefix)...), nil
+}
+
+// ForceUnlock breaks every lock on a file regardless of who holds it
+func (l *LocalFS) ForceUnlock(path string) error {
+	if !l.config.Features.CanLock {
+		return ErrLockingNotSupported
+	}
+
+	brokeFile := l.locks.Break(path)
+	brokeRanges := l.ranges.Break(path)
+	if !brokeFile && !brokeRanges {
+		return ErrNotLocked
+	}
+	return nil
+}
+
+// LockDebug reports lock contention and the waits currently queued
+func (l *LocalFS) LockDebug() (LockDebugInfo, error) {
+	if !l.config.Features.CanLock {
+		return LockDebugInfo{}, ErrLockingNotSupported
+	}
+
+	return l.locks.Debug(), nil
 }
 
 func (l *LocalFS) Info(path string) (FileInfo, error) {
-	fullPath := filepath.Join(l.root, path)
-	info, err := os.Stat(fullPath)
+	fullPath, err := l.entryPath("lstat", path)
 	if err != nil {
 		return FileInfo{}, err
 	}
 
-	return FileInfo{
-		Name:    info.Name(),
-		Size:    info.Size(),
-		Mode:    info.Mode(),
-		ModTime: info.ModTime(),
-		IsDir:   info.IsDir(),
-	}, nil
+	// Symlinks are reported as links; the root itself is always followed
+	stat := os.Lstat
+	if fullPath == l.root {
+		stat = os.Stat
+	}
+	info, err := stat(fullPath)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	fileInfo, hidden := l.fileInfo(path, info)
+	if hidden {
+		return FileInfo{}, &os.PathError{Op: "lstat", Path: path, Err: syscall.ENOENT}
+	}
+	return fileInfo, nil
 }
 
 func (l *LocalFS) List(path string) ([]FileInfo, error) {
-	fullPath := filepath.Join(l.root, path)
+	fullPath, err := l.realPath("open", path)
+	if err != nil {
+		return nil, err
+	}
 
 	entries, err := os.ReadDir(fullPath)
 	if err != nil {
@@ -215,28 +408,82 @@ func (l *LocalFS) List(path string) ([]FileInfo, error) {
 			continue
 		}
 
-		files = append(files, FileInfo{
-			Name:    info.Name(),
-			Size:    info.Size(),
-			Mode:    info.Mode(),
-			ModTime: info.ModTime(),
-			IsDir:   info.IsDir(),
-		})
+		fileInfo, hidden := l.fileInfo(filepath.Join(path, entry.Name()), info)
+		if hidden {
+			continue
+		}
+		files = append(files, fileInfo)
 	}
 
 	return files, nil
 }
 
+// fileInfo converts an lstat result to FileInfo. It reports whether the
+// entry is hidden: the lock journal, or a link that the link policy hides.
+func (l *LocalFS) fileInfo(path string, info os.FileInfo) (FileInfo, bool) {
+	if l.isJournal(path) {
+		return FileInfo{}, true
+	}
+
+	fileInfo := FileInfo{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		fileInfo.Uid = stat.Uid
+		fileInfo.Gid = stat.Gid
+		fileInfo.Inode = stat.Ino
+		fileInfo.Nlink = uint32(stat.Nlink)
+		fileInfo.Atime = time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+		fileInfo.Ctime = time.Unix(stat.Ctim.Sec, stat.Ctim.Nsec)
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(filepath.Join(l.root, path))
+		if err == nil {
+			if l.linkEscapes(path, target) {
+				if l.config.LinkPolicy == LinkPolicyHide {
+					return FileInfo{}, true
+				}
+				if l.config.LinkPolicy == LinkPolicyDeny {
+					target = ""
+				}
+			}
+			fileInfo.LinkTarget = target
+		}
+	}
+
+	return fileInfo, false
+}
+
+// isJournal reports whether path is the lock or write-back journal or one
+// of their temporary files
+func (l *LocalFS) isJournal(path string) bool {
+	fullPath := filepath.Join(l.root, path)
+	if filepath.Dir(fullPath) != l.root {
+		return false
+	}
+	name := filepath.Base(fullPath)
+	return strings.HasPrefix(name, lockJournalName) || strings.HasPrefix(name, writebackJournalName)
+}
+
 func (l *LocalFS) Read(path string) ([]byte, error) {
 	// Check read lock
 	if l.config.Features.CanLock {
-		locked, lockType, _ := l.IsLocked(path)
-		if locked && (lockType == WriteLock || lockType == ExclusiveLock) {
+		status := l.locks.Status(path)
+		if status.Locked && (status.LockType == WriteLock || status.LockType == ExclusiveLock) {
 			return nil, errors.New("file is locked for writing")
 		}
 	}
 
-	fullPath := filepath.Join(l.root, path)
+	fullPath, err := l.realPath("open", path)
+	if err != nil {
+		return nil, err
+	}
 	content, err := os.ReadFile(fullPath)
 	if err != nil {
 		return nil, err
@@ -249,26 +496,55 @@ func (l *LocalFS) Read(path string) ([]byte, error) {
 	return content, nil
 }
 
-func (l *LocalFS) Write(path string, content []byte, mode os.FileMode) error {
+// ReadAt reads len(buf) bytes at offset, following io.ReaderAt semantics.
+// The owner of a write lock may read the file it is writing.
+func (l *LocalFS) ReadAt(path string, buf []byte, offset int64, owner LockOwner) (int, error) {
+	// Check read lock
+	if l.config.Features.CanLock && !owner.internal() {
+		status := l.locks.Status(path)
+		_, holds := l.locks.Holds(path, owner)
+		if status.Locked && !holds && (status.LockType == WriteLock || status.LockType == ExclusiveLock) {
+			return 0, errors.New("file is locked for writing")
+		}
+	}
+
+	fullPath, err := l.realPath("open", path)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+
+	if l.config.Role == RoleCache {
+		if info, statErr := f.Stat(); statErr == nil {
+			l.updateCacheEntry(path, info.Size())
+		}
+	}
+
+	return n, err
+}
+
+func (l *LocalFS) Write(path string, content []byte, mode os.FileMode, owner LockOwner) error {
 	if !l.config.Features.CanUpdate {
 		return errors.New("filesystem does not support updates")
 	}
 
-	// Check write lock
-	if l.config.Features.CanLock {
-		if lock, exists := l.locks[path]; exists {
-			// Allow write if the process has a write or exclusive lock
-			if lock.ProcessID == os.Getpid() && (lock.LockType == WriteLock || lock.LockType == ExclusiveLock) {
-				// Process has appropriate lock, allow write
-			} else if lock.LockType == ReadLock {
-				return errors.New("file is locked for reading")
-			} else {
-				return errors.New("file is locked by another process")
-			}
-		}
+	if err := l.checkWriteLock(path, owner); err != nil {
+		return err
 	}
 
-	fullPath := filepath.Join(l.root, path)
+	fullPath, err := l.realPath("open", path)
+	if err != nil {
+		return err
+	}
 
 	// Ensure parent directory exists with proper permissions
 	if err := os.MkdirAll(filepath.Dir(fullPath), 0775); err != nil {
@@ -306,20 +582,191 @@ func (l *LocalFS) Write(path string, content []byte, mode os.FileMode) error {
 	return nil
 }
 
+// WriteAt writes data at offset, creating the file if it does not exist
+func (l *LocalFS) WriteAt(path string, data []byte, offset int64, owner LockOwner) (int, error) {
+	if !l.config.Features.CanUpdate {
+		return 0, errors.New("filesystem does not support updates")
+	}
+
+	if err := l.checkWriteLock(path, owner); err != nil {
+		return 0, err
+	}
+
+	fullPath, err := l.realPath("open", path)
+	if err != nil {
+		return 0, err
+	}
+
+	// Ensure parent directory exists with proper permissions
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0775); err != nil {
+		return 0, fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	if l.config.Role == RoleCache {
+		var size int64
+		if info, err := os.Stat(fullPath); err == nil {
+			size = info.Size()
+		}
+		// Mark the file as recently used so making space does not evict it
+		l.updateCacheEntry(path, size)
+		if growth := offset + int64(len(data)) - size; growth > 0 {
+			if err := l.ensureCacheSpace(growth); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	f, err := os.OpenFile(fullPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file for writing: %v", err)
+	}
+	defer f.Close()
+
+	n, err := f.WriteAt(data, offset)
+	if err != nil {
+		return n, fmt.Errorf("failed to write content: %v", err)
+	}
+
+	if l.config.Role == RoleCache {
+		if info, err := f.Stat(); err == nil {
+			l.updateCacheEntry(path, info.Size())
+		}
+	}
+
+	return n, nil
+}
+
+// Truncate shrinks or extends a file to size, keeping its existing content.
+// Extending leaves a sparse hole where the underlying filesystem supports it.
+func (l *LocalFS) Truncate(path string, size int64, owner LockOwner) error {
+	if !l.config.Features.CanUpdate {
+		return errors.New("filesystem does not support updates")
+	}
+
+	if err := l.checkWriteLock(path, owner); err != nil {
+		return err
+	}
+
+	fullPath, err := l.realPath("truncate", path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+
+	if l.config.Role == RoleCache {
+		// Mark the file as recently used so making space does not evict it
+		l.updateCacheEntry(path, info.Size())
+		if growth := size - info.Size(); growth > 0 {
+			if err := l.ensureCacheSpace(growth); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := os.Truncate(fullPath, size); err != nil {
+		return err
+	}
+
+	if l.config.Role == RoleCache {
+		l.updateCacheEntry(path, size)
+	}
+
+	return nil
+}
+
+// SetAttr changes the mode, owner and timestamps of path
+func (l *LocalFS) SetAttr(path string, update AttrUpdate) error {
+	if !l.config.Features.CanUpdate {
+		return errors.New("filesystem does not support updates")
+	}
+
+	fullPath, err := l.realPath("setattr", path)
+	if err != nil {
+		return err
+	}
+
+	if update.Mode != nil {
+		mode := *update.Mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if err := os.Chmod(fullPath, mode); err != nil {
+			return err
+		}
+	}
+
+	if update.Uid != nil || update.Gid != nil {
+		uid, gid := -1, -1
+		if update.Uid != nil {
+			uid = int(*update.Uid)
+		}
+		if update.Gid != nil {
+			gid = int(*update.Gid)
+		}
+		if err := os.Lchown(fullPath, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	if update.Atime != nil || update.Mtime != nil {
+		// Zero times are left unchanged by os.Chtimes
+		var atime, mtime time.Time
+		if update.Atime != nil {
+			atime = *update.Atime
+		}
+		if update.Mtime != nil {
+			mtime = *update.Mtime
+		}
+		if err := os.Chtimes(fullPath, atime, mtime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkWriteLock verifies that an existing lock on path allows owner to write
+func (l *LocalFS) checkWriteLock(path string, owner LockOwner) error {
+	if !l.config.Features.CanLock || owner.internal() {
+		return nil
+	}
+
+	if status := l.locks.Status(path); status.Locked {
+		// Allow write if the owner has a write or exclusive lock
+		if lockType, holds := l.locks.Holds(path, owner); holds && (lockType == WriteLock || lockType == ExclusiveLock) {
+			// Owner has appropriate lock, allow write
+		} else if status.LockType == ReadLock {
+			return errors.New("file is locked for reading")
+		} else {
+			return errors.New("file is locked by another owner")
+		}
+	}
+
+	return nil
+}
+
 func (l *LocalFS) Delete(path string) error {
 	if !l.config.Features.CanDelete {
 		return errors.New("filesystem does not support deletion")
 	}
 
 	// Check exclusive lock
-	if l.config.Features.CanLock {
-		locked, _, _ := l.IsLocked(path)
-		if locked {
-			return errors.New("file is locked")
-		}
+	if l.config.Features.CanLock && l.locks.Status(path).Locked {
+		return ErrFileLocked
+	}
+
+	fullPath, err := l.entryPath("unlink", path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &os.PathError{Op: "unlink", Path: path, Err: syscall.EISDIR}
 	}
 
-	fullPath := filepath.Join(l.root, path)
 	if err := os.Remove(fullPath); err != nil {
 		return err
 	}
@@ -331,6 +778,365 @@ func (l *LocalFS) Delete(path string) error {
 	return nil
 }
 
+// Mkdir creates a directory, along with any missing parents
+func (l *LocalFS) Mkdir(path string, mode os.FileMode) error {
+	if !l.config.Features.CanUpdate {
+		return errors.New("filesystem does not support updates")
+	}
+
+	fullPath, err := l.entryPath("mkdir", path)
+	if err != nil {
+		return err
+	}
+
+	// Ensure parent directory exists with proper permissions
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0775); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	return os.Mkdir(fullPath, mode.Perm())
+}
+
+// Rmdir removes an empty directory
+func (l *LocalFS) Rmdir(path string) error {
+	if !l.config.Features.CanDelete {
+		return errors.New("filesystem does not support deletion")
+	}
+
+	fullPath, err := l.entryPath("rmdir", path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &os.PathError{Op: "rmdir", Path: path, Err: syscall.ENOTDIR}
+	}
+
+	// os.Remove reports ENOTEMPTY for directories that still have entries
+	return os.Remove(fullPath)
+}
+
+// Rename atomically moves oldPath to newPath, replacing newPath if it exists.
+// Cache entries and locks below oldPath move along with it.
+func (l *LocalFS) Rename(oldPath, newPath string) error {
+	if !l.config.Features.CanUpdate {
+		return errors.New("filesystem does not support updates")
+	}
+
+	oldFull, err := l.entryPath("rename", oldPath)
+	if err != nil {
+		return err
+	}
+	newFull, err := l.entryPath("rename", newPath)
+	if err != nil {
+		return err
+	}
+
+	// Refuse to replace a file someone holds a lock on. A lock on a name
+	// that has no file here, as a cache may hold for a file it has no copy
+	// of, is kept for whatever is renamed to it.
+	if l.config.Features.CanLock && l.locks.Status(newPath).Locked {
+		if _, err := os.Lstat(newFull); err == nil {
+			return ErrFileLocked
+		}
+	}
+
+	// Ensure parent directory exists with proper permissions
+	if err := os.MkdirAll(filepath.Dir(newFull), 0775); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	// syscall.Rename keeps POSIX semantics; os.Rename refuses to replace directories
+	if err := syscall.Rename(oldFull, newFull); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: err}
+	}
+
+	if l.config.Role == RoleCache {
+		l.renameCacheEntries(oldPath, newPath)
+	}
+
+	if l.config.Features.CanLock {
+		l.locks.Rename(oldPath, newPath)
+		l.ranges.Rename(oldPath, newPath)
+	}
+
+	return nil
+}
+
+// Symlink creates a symbolic link at path pointing to target
+func (l *LocalFS) Symlink(target, path string) error {
+	if !l.config.Features.CanUpdate {
+		return errors.New("filesystem does not support updates")
+	}
+
+	if l.config.LinkPolicy != LinkPolicyAllow && l.linkEscapes(path, target) {
+		return &os.LinkError{Op: "symlink", Old: target, New: path, Err: syscall.EPERM}
+	}
+
+	fullPath, err := l.entryPath("symlink", path)
+	if err != nil {
+		return err
+	}
+
+	// Ensure parent directory exists with proper permissions
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0775); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	return os.Symlink(target, fullPath)
+}
+
+// Readlink returns the target of the symbolic link at path
+func (l *LocalFS) Readlink(path string) (string, error) {
+	fullPath, err := l.entryPath("readlink", path)
+	if err != nil {
+		return "", err
+	}
+	target, err := os.Readlink(fullPath)
+	if err != nil {
+		return "", err
+	}
+
+	if l.linkEscapes(path, target) {
+		switch l.config.LinkPolicy {
+		case LinkPolicyDeny:
+			return "", &os.PathError{Op: "readlink", Path: path, Err: syscall.EPERM}
+		case LinkPolicyHide:
+			return "", &os.PathError{Op: "readlink", Path: path, Err: syscall.ENOENT}
+		}
+	}
+
+	return target, nil
+}
+
+// Link creates newPath as a hard link to oldPath
+func (l *LocalFS) Link(oldPath, newPath string) error {
+	if !l.config.Features.CanUpdate {
+		return errors.New("filesystem does not support updates")
+	}
+
+	oldFull, err := l.entryPath("link", oldPath)
+	if err != nil {
+		return err
+	}
+	newFull, err := l.entryPath("link", newPath)
+	if err != nil {
+		return err
+	}
+
+	// Ensure parent directory exists with proper permissions
+	if err := os.MkdirAll(filepath.Dir(newFull), 0775); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	if err := os.Link(oldFull, newFull); err != nil {
+		return err
+	}
+
+	if l.config.Role == RoleCache {
+		if info, err := os.Stat(newFull); err == nil {
+			l.updateCacheEntry(newPath, info.Size())
+		}
+	}
+
+	return nil
+}
+
+// GetXattr returns the value of an extended attribute, without following symlinks
+func (l *LocalFS) GetXattr(path, name string) ([]byte, error) {
+	fullPath, err := l.entryPath("getxattr", path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		size, err := unix.Lgetxattr(fullPath, name, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+
+		value := make([]byte, size)
+		n, err := unix.Lgetxattr(fullPath, name, value)
+		if err == unix.ERANGE {
+			// The value grew between the two calls, try again
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		return value[:n], nil
+	}
+}
+
+// SetXattr sets an extended attribute; flags takes unix.XATTR_CREATE or unix.XATTR_REPLACE
+func (l *LocalFS) SetXattr(path, name string, value []byte, flags int) error {
+	if !l.config.Features.CanUpdate {
+		return errors.New("filesystem does not support updates")
+	}
+
+	fullPath, err := l.entryPath("setxattr", path)
+	if err != nil {
+		return err
+	}
+	if err := unix.Lsetxattr(fullPath, name, value, flags); err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+	return nil
+}
+
+// ListXattr returns the names of all extended attributes of path
+func (l *LocalFS) ListXattr(path string) ([]string, error) {
+	fullPath, err := l.entryPath("listxattr", path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		size, err := unix.Llistxattr(fullPath, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+		}
+
+		buf := make([]byte, size)
+		n, err := unix.Llistxattr(fullPath, buf)
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+		}
+
+		// Names come back NUL terminated
+		var names []string
+		for _, name := range strings.Split(string(buf[:n]), "\x00") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+}
+
+// RemoveXattr removes an extended attribute
+func (l *LocalFS) RemoveXattr(path, name string) error {
+	if !l.config.Features.CanUpdate {
+		return errors.New("filesystem does not support updates")
+	}
+
+	fullPath, err := l.entryPath("removexattr", path)
+	if err != nil {
+		return err
+	}
+	if err := unix.Lremovexattr(fullPath, name); err != nil {
+		return &os.PathError{Op: "removexattr", Path: path, Err: err}
+	}
+	return nil
+}
+
+// linkEscapes reports whether a symlink at path with the given target
+// resolves outside the filesystem root
+func (l *LocalFS) linkEscapes(path, target string) bool {
+	resolved := target
+	if !filepath.IsAbs(target) {
+		resolved = filepath.Join(l.root, filepath.Dir(path), target)
+	}
+	resolved = filepath.Clean(resolved)
+	return resolved != l.root && !strings.HasPrefix(resolved, l.root+string(filepath.Separator))
+}
+
+// maxLinkDepth bounds the symlinks followed while resolving one path, like
+// the kernel's ELOOP limit
+const maxLinkDepth = 40
+
+// realPath returns where path is on disk, following symlinks like open(2).
+// Unless the link policy allows links out of the root, a path that leads out
+// of the root through a link is refused: with EPERM under deny, and as if it
+// did not exist under hide.
+func (l *LocalFS) realPath(op, path string) (string, error) {
+	if l.config.LinkPolicy == LinkPolicyAllow {
+		return filepath.Join(l.root, path), nil
+	}
+	return l.resolve(op, path, lockPath(path))
+}
+
+// entryPath is realPath for operations on the entry at path itself, such as
+// lstat, unlink or rename, which do not follow a link in the last component
+func (l *LocalFS) entryPath(op, path string) (string, error) {
+	if l.config.LinkPolicy == LinkPolicyAllow || lockPath(path) == "/" {
+		return filepath.Join(l.root, path), nil
+	}
+
+	dir, err := l.resolve(op, path, filepath.Dir(lockPath(path)))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(lockPath(path))), nil
+}
+
+// resolve follows the symlinks in rel, a cleaned path below the root, one
+// component at a time, and refuses links that lead out of the root
+func (l *LocalFS) resolve(op, path, rel string) (string, error) {
+	resolved := l.root
+	components := strings.Split(strings.TrimPrefix(rel, "/"), "/")
+	for links := 0; len(components) > 0; {
+		name := components[0]
+		components = components[1:]
+		if name == "" {
+			continue
+		}
+
+		next := filepath.Join(resolved, name)
+		info, err := os.Lstat(next)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			// Whatever does not exist yet is created below resolved
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxLinkDepth {
+			return "", &os.PathError{Op: op, Path: path, Err: syscall.ELOOP}
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(resolved, target)
+		}
+		target = filepath.Clean(target)
+		if target != l.root && !strings.HasPrefix(target, l.root+string(filepath.Separator)) {
+			if l.config.LinkPolicy == LinkPolicyHide {
+				return "", &os.PathError{Op: op, Path: path, Err: syscall.ENOENT}
+			}
+			return "", &os.PathError{Op: op, Path: path, Err: syscall.EPERM}
+		}
+
+		// Continue from the root with the target's components
+		rest, _ := filepath.Rel(l.root, target)
+		resolved = l.root
+		components = append(strings.Split(rest, string(filepath.Separator)), components...)
+	}
+	return resolved, nil
+}
+
+// renamedPath returns where path ends up when oldPath is renamed to newPath
+func renamedPath(path, oldPath, newPath string) (string, bool) {
+	if path == oldPath {
+		return newPath, true
+	}
+	if strings.HasPrefix(path, oldPath+"/") {
+		return newPath + strings.TrimPrefix(path, oldPath), true
+	}
+	return "", false
+}
+
+// hasPathPrefix reports whether path is prefix or lies below it
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
 func (l *LocalFS) GetFeatures() FileSystemFeatures {
 	return l.config.Features
 }
@@ -355,6 +1161,11 @@ func (l *LocalFS) GetUsage() (int64, error) {
 
 // Cache management methods
 func (l *LocalFS) updateCacheEntry(path string, size int64) {
+	// Evicting a whiteout would bring back the file it hides
+	if isWhiteout(path) {
+		return
+	}
+
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
@@ -386,6 +1197,67 @@ func (l *LocalFS) removeCacheEntry(path string) {
 	}
 }
 
+// Pin keeps path from being evicted until it is unpinned
+func (l *LocalFS) Pin(path string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.pinned == nil {
+		l.pinned = make(map[string]bool)
+	}
+	l.pinned[lockPath(path)] = true
+}
+
+// Unpin lets path be evicted again
+func (l *LocalFS) Unpin(path string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.pinned, lockPath(path))
+}
+
+// isPinned reports whether path must not be evicted
+func (l *LocalFS) isPinned(path string) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.pinned[lockPath(path)]
+}
+
+// removeCacheEntries drops the entries of path and of everything below it,
+// except for pinned files
+func (l *LocalFS) removeCacheEntries(path string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	path = lockPath(path)
+	entries := l.cacheList[:0]
+	for _, entry := range l.cacheList {
+		if entryPath := lockPath(entry.Path); !hasPathPrefix(entryPath, path) || l.pinned[entryPath] {
+			entries = append(entries, entry)
+		}
+	}
+	l.cacheList = entries
+}
+
+func (l *LocalFS) renameCacheEntries(oldPath, newPath string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entries := l.cacheList[:0]
+	for _, entry := range l.cacheList {
+		// The replaced target is gone, its entry would only skew the usage
+		if entry.Path == newPath {
+			continue
+		}
+		if moved, ok := renamedPath(entry.Path, oldPath, newPath); ok {
+			entry.Path = moved
+		}
+		entries = append(entries, entry)
+	}
+	l.cacheList = entries
+}
+
 func (l *LocalFS) ensureCacheSpace(needed int64) error {
 	if l.config.Role != RoleCache {
 		return nil
@@ -402,13 +1274,19 @@ func (l *LocalFS) ensureCacheSpace(needed int64) error {
 
 	// If we're over capacity, remove oldest entries until we have space
 	for currentSize+needed > l.config.MaxSize && len(l.cacheList) > 0 {
-		// Find oldest entry
-		oldestIdx := 0
+		// Find oldest entry that is not pinned
+		oldestIdx := -1
 		for i, entry := range l.cacheList {
-			if entry.LastUsed.Before(l.cacheList[oldestIdx].LastUsed) {
+			if l.pinned[lockPath(entry.Path)] {
+				continue
+			}
+			if oldestIdx < 0 || entry.LastUsed.Before(l.cacheList[oldestIdx].LastUsed) {
 				oldestIdx = i
 			}
 		}
+		if oldestIdx < 0 {
+			return fmt.Errorf("cache is full of files that are not flushed yet: %w", syscall.ENOSPC)
+		}
 
 		// Remove the file
 		oldestEntry := l.cacheList[oldestIdx]
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// newLinkTestFS returns a local filesystem with the given link policy whose
+// root holds links to a file outside it, to a directory outside it and to a
+// file inside it, along with the outside directory
+func newLinkTestFS(t *testing.T, policy LinkPolicy) (*LocalFS, string) {
+	t.Helper()
+
+	root, outside := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "inside"), []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{
+		"file":   filepath.Join(outside, "secret"),
+		"dir":    outside,
+		"local":  "inside",
+		"nested": "dir/secret",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs, err := NewLocalFS(FileSystemConfig{
+		Role:       RoleMain,
+		Features:   FileSystemFeatures{CanUpdate: true, CanDelete: true},
+		RootPath:   root,
+		LinkPolicy: policy,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs, outside
+}
+
+func TestLinkPolicyGuardsReadsAndWrites(t *testing.T) {
+	for policy, want := range map[LinkPolicy]error{
+		LinkPolicyDeny: syscall.EPERM,
+		LinkPolicyHide: syscall.ENOENT,
+	} {
+		t.Run(string(policy), func(t *testing.T) {
+			fs, outside := newLinkTestFS(t, policy)
+
+			for _, path := range []string{"file", "dir/secret", "nested"} {
+				if _, err := fs.Read(path); !errors.Is(err, want) {
+					t.Errorf("Read(%s) = %v, want %v", path, err, want)
+				}
+				if _, err := fs.ReadAt(path, make([]byte, 4), 0, LockOwner{}); !errors.Is(err, want) {
+					t.Errorf("ReadAt(%s) = %v, want %v", path, err, want)
+				}
+				if err := fs.Write(path, []byte("overwritten"), 0644, LockOwner{}); !errors.Is(err, want) {
+					t.Errorf("Write(%s) = %v, want %v", path, err, want)
+				}
+				if _, err := fs.WriteAt(path, []byte("x"), 0, LockOwner{}); !errors.Is(err, want) {
+					t.Errorf("WriteAt(%s) = %v, want %v", path, err, want)
+				}
+				if err := fs.Truncate(path, 0, LockOwner{}); !errors.Is(err, want) {
+					t.Errorf("Truncate(%s) = %v, want %v", path, err, want)
+				}
+			}
+			if err := fs.Write("dir/new", []byte("x"), 0644, LockOwner{}); !errors.Is(err, want) {
+				t.Errorf("Write(dir/new) = %v, want %v", err, want)
+			}
+			if err := fs.Delete("dir/secret"); !errors.Is(err, want) {
+				t.Errorf("Delete(dir/secret) = %v, want %v", err, want)
+			}
+
+			content, err := os.ReadFile(filepath.Join(outside, "secret"))
+			if err != nil || string(content) != "secret" {
+				t.Errorf("file outside the root is now %q (%v)", content, err)
+			}
+			if _, err := os.Stat(filepath.Join(outside, "new")); !os.IsNotExist(err) {
+				t.Errorf("a file was created outside the root: %v", err)
+			}
+
+			// Links that stay inside the root keep working
+			if content, err := fs.Read("local"); err != nil || string(content) != "inside" {
+				t.Errorf("Read(local) = %q, %v", content, err)
+			}
+		})
+	}
+}
+
+func TestLinkPolicyAllowFollowsLinks(t *testing.T) {
+	fs, _ := newLinkTestFS(t, LinkPolicyAllow)
+
+	content, err := fs.Read("dir/secret")
+	if err != nil || string(content) != "secret" {
+		t.Errorf("Read(dir/secret) = %q, %v", content, err)
+	}
+}
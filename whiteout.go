@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// whiteoutPrefix marks a whiteout: an empty file .wh.NAME in a layer of the
+// chain hides NAME, and everything below it, in the layers after it. The chain
+// leaves one behind when a file is deleted or a directory removed but a layer
+// that cannot delete still has it, as overlayfs does.
+const whiteoutPrefix = ".wh."
+
+// whiteoutPath returns the path of the whiteout that hides path
+func whiteoutPath(path string) string {
+	return filepath.Join(filepath.Dir(path), whiteoutPrefix+filepath.Base(path))
+}
+
+// isWhiteout reports whether path names a whiteout. Whiteouts are never
+// shown through the chain and such names cannot be created.
+func isWhiteout(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), whiteoutPrefix)
+}
+
+// checkName refuses to create path when its name is reserved for whiteouts
+// or the hidden copies of promotions
+func checkName(op, path string) error {
+	if isWhiteout(path) || isPromotionCopy(path) {
+		return &os.PathError{Op: op, Path: path, Err: syscall.EINVAL}
+	}
+	return nil
+}
+
+// hidden reports whether a layer before the given one has a whiteout for
+// path or for one of the directories above it
+func (c *ChainFS) hidden(path string, layer int) bool {
+	for _, fs := range c.filesystems[:layer] {
+		for p := lockPath(path); p != "/"; p = filepath.Dir(p) {
+			if _, err := fs.Info(whiteoutPath(p)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// layerInfo returns the info of path in the given layer, as long as no
+// earlier layer hides it
+func (c *ChainFS) layerInfo(layer int, path string) (FileInfo, error) {
+	if isWhiteout(path) {
+		return FileInfo{}, &os.PathError{Op: "lstat", Path: path, Err: syscall.ENOENT}
+	}
+
+	info, err := c.filesystems[layer].Info(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if c.hidden(path, layer) {
+		return FileInfo{}, &os.PathError{Op: "lstat", Path: path, Err: syscall.ENOENT}
+	}
+	return info, nil
+}
+
+// hideRemains writes a whiteout for path once it has been deleted from every
+// layer that could delete it, so that copies left in the others stay hidden.
+// The whiteout goes to the first layer that can both write and later remove
+// it; that layer has to come before the copy it hides.
+func (c *ChainFS) hideRemains(op, path string) error {
+	for i := range c.filesystems {
+		if _, err := c.layerInfo(i, path); err != nil {
+			continue
+		}
+
+		for _, fs := range c.filesystems[:i] {
+			if features := fs.GetFeatures(); features.CanUpdate && features.CanDelete {
+				return fs.Write(whiteoutPath(path), nil, 0644, LockOwner{})
+			}
+		}
+		return &os.PathError{Op: op, Path: path, Err: syscall.EROFS}
+	}
+	return nil
+}
+
+// clearWhiteouts removes the whiteouts that would hide path after a rename
+// or link created it only in layers after them
+func (c *ChainFS) clearWhiteouts(path string) {
+	for _, fs := range c.filesystems {
+		if _, err := fs.Info(path); err == nil {
+			return
+		}
+		if _, err := fs.Info(whiteoutPath(path)); err == nil && fs.GetFeatures().CanDelete {
+			_ = fs.Delete(whiteoutPath(path))
+		}
+	}
+}
+
+// removeWhiteouts deletes the whiteouts in directory path of one layer, so
+// that the directory itself can be removed there
+func removeWhiteouts(fs ServerFS, path string) {
+	entries, err := fs.List(path)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name, whiteoutPrefix) {
+			_ = fs.Delete(filepath.Join(path, entry.Name))
+		}
+	}
+}
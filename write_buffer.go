@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+)
+
+// spoolThreshold is the amount of dirty data kept in memory before a
+// WriteBuffer moves its contents to a local spool file
+const spoolThreshold = 8 << 20 // 8MB
+
+// dirtyExtent is a contiguous range of data that has not been flushed yet
+type dirtyExtent struct {
+	offset int64
+	length int64
+	data   []byte // nil once the buffer has been spooled to disk
+}
+
+func (e dirtyExtent) end() int64 {
+	return e.offset + e.length
+}
+
+// WriteBuffer collects writes to an open file until they are flushed to the server
+type WriteBuffer struct {
+	mutex    sync.Mutex
+	extents  []dirtyExtent // sorted by offset, never overlapping or adjacent
+	spool    *os.File
+	buffered int64
+}
+
+// NewWriteBuffer creates an empty write buffer
+func NewWriteBuffer() *WriteBuffer {
+	return &WriteBuffer{}
+}
+
+// Write records data at offset, merging it with any overlapping dirty ranges
+func (b *WriteBuffer) Write(data []byte, offset int64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	merged := dirtyExtent{offset: offset, length: int64(len(data))}
+
+	// Find the extents that overlap or touch the new range
+	first, last := len(b.extents), -1
+	for i, e := range b.extents {
+		if e.end() >= offset && e.offset <= merged.end() {
+			if i < first {
+				first = i
+			}
+			last = i
+		}
+	}
+	if last >= 0 {
+		start := min(b.extents[first].offset, merged.offset)
+		end := max(b.extents[last].end(), merged.end())
+		merged = dirtyExtent{offset: start, length: end - start}
+	}
+
+	if b.spool != nil {
+		if _, err := b.spool.WriteAt(data, offset); err != nil {
+			return err
+		}
+	} else {
+		// Lay the old extents down first so the new data wins where they overlap
+		merged.data = make([]byte, merged.length)
+		for i := first; i <= last; i++ {
+			e := b.extents[i]
+			copy(merged.data[e.offset-merged.offset:], e.data)
+		}
+		copy(merged.data[offset-merged.offset:], data)
+	}
+
+	for i := first; i <= last; i++ {
+		b.buffered -= b.extents[i].length
+	}
+	b.buffered += merged.length
+
+	if last >= 0 {
+		b.extents = append(b.extents[:first], append([]dirtyExtent{merged}, b.extents[last+1:]...)...)
+	} else {
+		// Insert in offset order
+		idx := 0
+		for idx < len(b.extents) && b.extents[idx].offset < merged.offset {
+			idx++
+		}
+		b.extents = append(b.extents[:idx], append([]dirtyExtent{merged}, b.extents[idx:]...)...)
+	}
+
+	if b.spool == nil && b.buffered > spoolThreshold {
+		return b.spill()
+	}
+	return nil
+}
+
+// spill moves all in-memory extents to a temporary spool file
+func (b *WriteBuffer) spill() error {
+	spool, err := os.CreateTemp("", "go-sync-fs-spool-*")
+	if err != nil {
+		return err
+	}
+
+	for _, e := range b.extents {
+		if _, err := spool.WriteAt(e.data, e.offset); err != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+			return err
+		}
+	}
+
+	for i := range b.extents {
+		b.extents[i].data = nil
+	}
+	b.spool = spool
+	return nil
+}
+
+// Overlay copies dirty data that falls inside [offset, offset+len(buf)) into buf.
+// It returns the number of leading bytes of buf that are covered by the end of
+// the last dirty range, or 0 if no dirty data intersects the request.
+func (b *WriteBuffer) Overlay(buf []byte, offset int64) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	end := offset + int64(len(buf))
+	covered := 0
+	for _, e := range b.extents {
+		if e.end() <= offset || e.offset >= end {
+			continue
+		}
+
+		from := max(e.offset, offset)
+		to := min(e.end(), end)
+		if b.spool != nil {
+			if _, err := b.spool.ReadAt(buf[from-offset:to-offset], from); err != nil {
+				return 0, err
+			}
+		} else {
+			copy(buf[from-offset:to-offset], e.data[from-e.offset:to-e.offset])
+		}
+		covered = int(to - offset)
+	}
+	return covered, nil
+}
+
+// Size returns the end offset of the last dirty range
+func (b *WriteBuffer) Size() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.extents) == 0 {
+		return 0
+	}
+	return b.extents[len(b.extents)-1].end()
+}
+
+// Dirty reports whether the buffer holds unflushed data
+func (b *WriteBuffer) Dirty() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return len(b.extents) > 0
+}
+
+// Flush hands every dirty range to send in offset order. Ranges are dropped
+// from the buffer once they are sent; on error the remaining ranges are kept
+// so a later flush can retry them.
+func (b *WriteBuffer) Flush(send func(offset int64, r io.Reader) error) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for len(b.extents) > 0 {
+		e := b.extents[0]
+
+		var r io.Reader
+		if b.spool != nil {
+			r = io.NewSectionReader(b.spool, e.offset, e.length)
+		} else {
+			r = bytes.NewReader(e.data)
+		}
+		if err := send(e.offset, r); err != nil {
+			return err
+		}
+
+		b.extents = b.extents[1:]
+		b.buffered -= e.length
+	}
+
+	return b.resetSpool()
+}
+
+// Close discards any unflushed data and removes the spool file
+func (b *WriteBuffer) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.extents = nil
+	b.buffered = 0
+	return b.resetSpool()
+}
+
+func (b *WriteBuffer) resetSpool() error {
+	if b.spool == nil {
+		return nil
+	}
+
+	name := b.spool.Name()
+	err := b.spool.Close()
+	b.spool = nil
+	if removeErr := os.Remove(name); err == nil {
+		err = removeErr
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// sentRange is one range a WriteBuffer flushed
+type sentRange struct {
+	offset int64
+	data   string
+}
+
+// collect returns a send function for Flush that records what it is given
+func collect(sent *[]sentRange) func(int64, io.Reader) error {
+	return func(offset int64, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		*sent = append(*sent, sentRange{offset, string(data)})
+		return err
+	}
+}
+
+func TestWriteBufferMergesRanges(t *testing.T) {
+	b := NewWriteBuffer()
+	defer b.Close()
+
+	for _, w := range []sentRange{{0, "aaaa"}, {10, "bbbb"}, {4, "cc"}, {2, "XX"}} {
+		if err := b.Write([]byte(w.data), w.offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size := b.Size(); size != 14 {
+		t.Errorf("Size = %d, want 14", size)
+	}
+
+	// Reads see the dirty ranges over what the server has
+	buf := []byte("................")
+	covered, err := b.Overlay(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if covered != 14 || string(buf) != "aaXXcc....bbbb.." {
+		t.Errorf("Overlay = %d, %q, want 14, %q", covered, buf, "aaXXcc....bbbb..")
+	}
+
+	// Touching ranges were merged, the gap keeps the others apart
+	var sent []sentRange
+	if err := b.Flush(collect(&sent)); err != nil {
+		t.Fatal(err)
+	}
+	want := []sentRange{{0, "aaXXcc"}, {10, "bbbb"}}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("flushed %v, want %v", sent, want)
+	}
+	if b.Dirty() {
+		t.Error("buffer still dirty after the flush")
+	}
+}
+
+func TestWriteBufferKeepsRangesAFlushFailedToSend(t *testing.T) {
+	b := NewWriteBuffer()
+	defer b.Close()
+	b.Write([]byte("first"), 0)
+	b.Write([]byte("second"), 100)
+
+	failure := errors.New("server gone")
+	var sent []sentRange
+	err := b.Flush(func(offset int64, r io.Reader) error {
+		if offset == 100 {
+			return failure
+		}
+		return collect(&sent)(offset, r)
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("Flush = %v, want %v", err, failure)
+	}
+	if !b.Dirty() {
+		t.Fatal("the range that failed was dropped")
+	}
+
+	// The retry only sends what did not make it
+	sent = nil
+	if err := b.Flush(collect(&sent)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []sentRange{{100, "second"}}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("retry flushed %v, want %v", sent, want)
+	}
+}
+
+func TestWriteBufferSpoolsLargeWrites(t *testing.T) {
+	b := NewWriteBuffer()
+	defer b.Close()
+
+	chunk := bytes.Repeat([]byte("x"), spoolThreshold/2+1)
+	if err := b.Write(chunk, 0); err != nil {
+		t.Fatal(err)
+	}
+	if b.spool != nil {
+		t.Fatal("spooled before reaching the threshold")
+	}
+	if err := b.Write(chunk, int64(len(chunk))); err != nil {
+		t.Fatal(err)
+	}
+	if b.spool == nil {
+		t.Fatal("not spooled past the threshold")
+	}
+	spool := b.spool.Name()
+
+	// Writes after spooling still overlay the earlier data
+	if err := b.Write([]byte("patch"), 10); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 20)
+	if _, err := b.Overlay(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "xxxxxxxxxxpatchxxxxx" {
+		t.Errorf("Overlay = %q", buf)
+	}
+
+	var sent []sentRange
+	if err := b.Flush(collect(&sent)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || sent[0].offset != 0 || len(sent[0].data) != 2*len(chunk) || sent[0].data[10:15] != "patch" {
+		t.Errorf("flushed %d ranges, want one of %d bytes with the patch", len(sent), 2*len(chunk))
+	}
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Errorf("spool file left behind after the flush: %v", err)
+	}
+}
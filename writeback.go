@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WriteMode selects when a chain's writes reach the filesystems after the first
+type WriteMode string
+
+const (
+	WriteThrough WriteMode = "writethrough" // Every write waits for all filesystems
+	WriteBack    WriteMode = "writeback"    // Writes land in the first filesystem and are flushed in the background
+)
+
+// writebackJournalName is the file under the first filesystem's root that
+// records which files still have to be flushed. It is hidden from listings.
+const writebackJournalName = ".go-sync-fs-writeback.journal"
+
+// Retry delays of a flush that failed, doubling from the first to the last
+const (
+	flushRetryMin = time.Second
+	flushRetryMax = time.Minute
+)
+
+// CachePinner is implemented by caches that can keep files from being
+// evicted, such as files whose changes have not been flushed yet
+type CachePinner interface {
+	Pin(path string)
+	Unpin(path string)
+}
+
+// writebackRecord is one line of the write-back journal: path changed in
+// change Seq, or, with Flushed set, every change up to Seq was flushed
+type writebackRecord struct {
+	Path    string
+	Seq     uint64
+	Flushed bool `json:",omitempty"`
+}
+
+// dirtyEntry is a file whose changes have not reached the other filesystems
+type dirtyEntry struct {
+	path    string
+	first   uint64 // First unflushed change; files are flushed in this order
+	seq     uint64 // Latest change
+	retries int
+	retryAt time.Time
+	// Flushes in a row whose copy was overtaken by a new change
+	overtaken int
+}
+
+// flushOwner is the lock owner flushes read and write as. Filesystems let it
+// past their locks, as the changes it copies were checked when they were
+// made.
+var flushOwner = LockOwner{ClientID: "writeback", Pid: -1}
+
+// writeback queues the files a chain in write-back mode still has to flush
+// and flushes them from a background goroutine. The queue is kept in a
+// journal so that a crash does not lose track of unflushed files.
+type writeback struct {
+	chain   *ChainFS
+	mutex   sync.Mutex
+	dirty   map[string]*dirtyEntry
+	seq     uint64
+	wake    chan struct{}
+	path    string
+	file    *os.File
+	appends int        // Records appended since the last compaction
+	copying string     // File the flusher is copying without holding its lock
+	copied  *sync.Cond // Signalled on w.mutex when that copy ends
+}
+
+// EnableWriteback switches the chain to write-back mode. Unflushed files
+// listed in the journal at journalPath are queued again.
+func (c *ChainFS) EnableWriteback(journalPath string) error {
+	if len(c.filesystems) < 2 {
+		return errors.New("write-back mode needs more than one filesystem")
+	}
+	if !c.filesystems[0].GetFeatures().CanUpdate {
+		return errors.New("write-back mode needs a first filesystem with can_update")
+	}
+
+	w := &writeback{
+		chain: c,
+		dirty: make(map[string]*dirtyEntry),
+		wake:  make(chan struct{}, 1),
+		path:  journalPath,
+	}
+	w.copied = sync.NewCond(&w.mutex)
+	if err := w.replay(); err != nil {
+		return fmt.Errorf("error reading write-back journal: %v", err)
+	}
+	if err := w.compact(); err != nil {
+		return fmt.Errorf("error compacting write-back journal: %v", err)
+	}
+
+	for path := range w.dirty {
+		w.pin(path)
+	}
+	if len(w.dirty) > 0 {
+		log.Printf("Flushing %d files left unflushed by the last run", len(w.dirty))
+	}
+
+	c.writeback = w
+	go w.run()
+	return nil
+}
+
+// replay loads the unflushed files from the journal
+func (w *writeback) replay() error {
+	file, err := os.Open(w.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var record writebackRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A crash can leave a torn last line; everything before it is still good
+			log.Printf("Skipping unreadable write-back journal record %s:%d: %v", w.path, line, err)
+			continue
+		}
+
+		w.seq = max(w.seq, record.Seq)
+		entry := w.dirty[record.Path]
+		switch {
+		case record.Flushed:
+			if entry != nil && entry.seq <= record.Seq {
+				delete(w.dirty, record.Path)
+			}
+		case entry == nil:
+			w.dirty[record.Path] = &dirtyEntry{path: record.Path, first: record.Seq, seq: record.Seq}
+		default:
+			entry.seq = record.Seq
+		}
+	}
+	return scanner.Err()
+}
+
+// compact atomically rewrites the journal to list only the unflushed files
+// and reopens it for appending. The caller must hold w.mutex or be the only
+// user of w.
+func (w *writeback) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), writebackJournalName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	bw := bufio.NewWriter(tmp)
+	for _, entry := range w.queue() {
+		data, err := json.Marshal(writebackRecord{Path: entry.path, Seq: entry.seq})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		bw.Write(append(data, '\n'))
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), w.path); err != nil {
+		return fmt.Errorf("error replacing write-back journal: %v", err)
+	}
+
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file = file
+	w.appends = 0
+	return nil
+}
+
+// append logs a record, syncing it to disk when sync is set. The caller
+// must hold w.mutex.
+func (w *writeback) append(record writebackRecord, sync bool) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := w.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if sync {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	w.appends++
+	if w.appends >= journalCompactAfter {
+		if err := w.compact(); err != nil {
+			log.Printf("Error compacting write-back journal %s: %v", w.path, err)
+		}
+	}
+	return nil
+}
+
+// queue returns the unflushed files in the order they are flushed. The
+// caller must hold w.mutex.
+func (w *writeback) queue() []*dirtyEntry {
+	entries := make([]*dirtyEntry, 0, len(w.dirty))
+	for _, entry := range w.dirty {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].first < entries[j].first
+	})
+	return entries
+}
+
+// pin keeps the first filesystem from evicting an unflushed file
+func (w *writeback) pin(path string) {
+	if pinner, ok := w.chain.filesystems[0].(CachePinner); ok {
+		pinner.Pin(path)
+	}
+}
+
+func (w *writeback) unpin(path string) {
+	if pinner, ok := w.chain.filesystems[0].(CachePinner); ok {
+		pinner.Unpin(path)
+	}
+}
+
+// markDirty queues path before it is changed in the first filesystem. A file
+// that is not queued yet is pinned there and in the journal on disk before
+// markDirty returns, so neither eviction nor a crash can lose the change.
+// The returned function takes the file off the queue again when the change
+// could not be made.
+func (w *writeback) markDirty(path string) (func(), error) {
+	path = lockPath(path)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.seq++
+	if entry, exists := w.dirty[path]; exists {
+		// Earlier changes still have to be flushed either way
+		entry.seq = w.seq
+		return func() {}, nil
+	}
+
+	entry := &dirtyEntry{path: path, first: w.seq, seq: w.seq}
+	w.dirty[path] = entry
+	w.pin(path)
+	if err := w.append(writebackRecord{Path: path, Seq: w.seq}, true); err != nil {
+		delete(w.dirty, path)
+		w.unpin(path)
+		return nil, fmt.Errorf("error journaling write-back of %s: %v", path, err)
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return func() { w.cancel(entry) }, nil
+}
+
+// cancel takes entry off the queue after the change it was queued for
+// failed
+func (w *writeback) cancel(entry *dirtyEntry) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.dirty[entry.path] == entry {
+		w.forgetEntry(entry)
+	}
+}
+
+// isDirty reports whether path has changes that were not flushed yet
+func (w *writeback) isDirty(path string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	_, exists := w.dirty[lockPath(path)]
+	return exists
+}
+
+// pending returns the latest unflushed change of path
+func (w *writeback) pending(path string) (uint64, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	entry, exists := w.dirty[lockPath(path)]
+	if !exists {
+		return 0, false
+	}
+	return entry.seq, true
+}
+
+// finish records the outcome of flushing the changes of path up to seq. A
+// failed flush is retried later, waiting longer after every failure.
+func (w *writeback) finish(path string, seq uint64, err error) {
+	path = lockPath(path)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	entry, exists := w.dirty[path]
+	if !exists {
+		return
+	}
+
+	if err != nil {
+		delay := flushRetryMin << min(entry.retries, 6)
+		entry.retries++
+		entry.retryAt = time.Now().Add(min(delay, flushRetryMax))
+		log.Printf("Error flushing %s, retrying in %v: %v", path, min(delay, flushRetryMax), err)
+		return
+	}
+	if entry.seq != seq {
+		// Changed again while flushing, the next flush picks that up
+		return
+	}
+
+	w.forgetEntry(entry)
+}
+
+// forget drops path from the queue, as it no longer exists to be flushed
+func (w *writeback) forget(path string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if entry, exists := w.dirty[lockPath(path)]; exists {
+		w.forgetEntry(entry)
+	}
+}
+
+// forgetEntry removes entry from the queue and journals that it is done.
+// The caller must hold w.mutex.
+func (w *writeback) forgetEntry(entry *dirtyEntry) {
+	delete(w.dirty, entry.path)
+	w.unpin(entry.path)
+	if err := w.append(writebackRecord{Path: entry.path, Seq: entry.seq, Flushed: true}, false); err != nil {
+		log.Printf("Error writing write-back journal %s: %v", w.path, err)
+	}
+}
+
+// rename moves the queued files at and below oldPath along with a rename
+func (w *writeback) rename(oldPath, newPath string) error {
+	oldPath, newPath = lockPath(oldPath), lockPath(newPath)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	var lastErr error
+	for _, entry := range w.queue() {
+		moved, ok := renamedPath(entry.path, oldPath, newPath)
+		if !ok {
+			continue
+		}
+
+		w.forgetEntry(entry)
+		w.seq++
+		w.dirty[moved] = &dirtyEntry{path: moved, first: entry.first, seq: w.seq}
+		w.pin(moved)
+		if err := w.append(writebackRecord{Path: moved, Seq: w.seq}, true); err != nil {
+			lastErr = fmt.Errorf("error journaling write-back of %s: %v", moved, err)
+		}
+	}
+	return lastErr
+}
+
+// next returns the file to flush now, or how long to wait before asking again
+func (w *writeback) next() (*dirtyEntry, time.Duration) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	now := time.Now()
+	wait := time.Hour
+	for _, entry := range w.queue() {
+		if !entry.retryAt.After(now) {
+			flush := *entry
+			return &flush, 0
+		}
+		wait = min(wait, entry.retryAt.Sub(now))
+	}
+	return nil, wait
+}
+
+// maxOvertaken is how many flushes of a file in a row may be overtaken by new
+// changes before the next one holds the file's lock while it copies, so that
+// a file written all the time is flushed too
+const maxOvertaken = 3
+
+// run flushes queued files, oldest change first, for as long as the server runs
+func (w *writeback) run() {
+	for {
+		entry, wait := w.next()
+		if entry == nil {
+			select {
+			case <-w.wake:
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		w.flushEntry(entry)
+	}
+}
+
+// flushEntry flushes a queued file. The file is only locked to note its
+// latest change, which is complete then, and after the copy to check that no
+// change overtook it; reads and writes go on while it is copied. A copy that
+// was overtaken is thrown away and the file flushed again.
+func (w *writeback) flushEntry(entry *dirtyEntry) {
+	unlock := w.chain.paths.RLock(entry.path)
+	seq, dirty := w.pending(entry.path)
+	unlock()
+	if !dirty {
+		return
+	}
+
+	if entry.overtaken >= maxOvertaken {
+		unlock := w.chain.paths.Lock(entry.path)
+		err := w.chain.flush(entry.path)
+		unlock()
+		w.finish(entry.path, seq, err)
+		return
+	}
+
+	w.startCopy(entry.path)
+	err := w.chain.copyDown(entry.path)
+	w.endCopy()
+
+	unlock = w.chain.paths.Lock(entry.path)
+	defer unlock()
+	current, dirty := w.pending(entry.path)
+	if !dirty {
+		// Deleted, renamed or flushed by someone else since
+		return
+	}
+	if current != seq {
+		w.overtake(entry.path)
+		return
+	}
+	if err == nil {
+		w.chain.recordVersions(entry.path)
+	}
+	w.finish(entry.path, seq, err)
+}
+
+// startCopy notes that the flusher copies path without holding its lock
+func (w *writeback) startCopy(path string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.copying = path
+}
+
+func (w *writeback) endCopy() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.copying = ""
+	w.copied.Broadcast()
+}
+
+// waitCopy waits until the flusher no longer copies path or a file below
+// it. Operations that change path in every filesystem call it with path
+// locked, so that a copy still under way does not bring back a file they
+// deleted or renamed, or undo what they changed.
+func (w *writeback) waitCopy(path string) {
+	path = lockPath(path)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for w.copying != "" && hasPathPrefix(w.copying, path) {
+		w.copied.Wait()
+	}
+}
+
+// overtake counts a flush of path whose copy a new change overtook
+func (w *writeback) overtake(path string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if entry, exists := w.dirty[lockPath(path)]; exists {
+		entry.overtaken++
+	}
+}
+
+// flush copies path from the first filesystem to every other filesystem
+// that supports updates. The caller must lock path.
+func (c *ChainFS) flush(path string) error {
+	if err := c.copyDown(path); err != nil {
+		return err
+	}
+	c.recordVersions(path)
+	return nil
+}
+
+// copyDown copies path from the first filesystem to every other filesystem
+// that supports updates, as flushOwner
+func (c *ChainFS) copyDown(path string) error {
+	first := c.filesystems[0]
+	info, err := first.Info(path)
+	if os.IsNotExist(err) {
+		// Deleted or renamed since, which already reached every filesystem
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode.IsRegular() {
+		return nil
+	}
+
+	var lastErr error
+	for _, fs := range c.filesystems[1:] {
+		if !fs.GetFeatures().CanUpdate {
+			continue
+		}
+		if err := copyContent(path, first, fs, info.Size, info.Mode.Perm(), flushOwner); err != nil {
+			lastErr = err
+			continue
+		}
+		c.copyXattrs(path, first, fs)
+	}
+	return lastErr
+}
+
+// flushPending flushes path right away if it has unflushed changes, so that
+// an operation that is applied to every filesystem finds them there. The
+// caller must lock path.
+func (c *ChainFS) flushPending(path string) error {
+	if c.writeback == nil {
+		return nil
+	}
+
+	c.writeback.waitCopy(path)
+	seq, dirty := c.writeback.pending(path)
+	if !dirty {
+		return nil
+	}
+	err := c.flush(path)
+	c.writeback.finish(path, seq, err)
+	return err
+}
+
+// copyUp gives the first filesystem the whole of path before a write-back
+// write changes only part of it. The caller must lock path.
+func (c *ChainFS) copyUp(path string, owner LockOwner) error {
+	first := c.filesystems[0]
+	if _, err := c.layerInfo(0, path); err == nil {
+		return nil
+	}
+
+	for i, fs := range c.filesystems[1:] {
+		info, err := c.layerInfo(i+1, path)
+		if err != nil {
+			continue
+		}
+		if !info.Mode.IsRegular() {
+			return nil
+		}
+
+		if err := copyContent(path, fs, first, info.Size, info.Mode.Perm(), owner); err != nil {
+			return err
+		}
+		c.copyXattrs(path, fs, first)
+		return nil
+	}
+	return nil
+}
+
+// writeBack queues the file to be flushed and then applies a write to the
+// first filesystem only. The caller must lock path.
+func (c *ChainFS) writeBack(path string, write func(fs ServerFS) error) error {
+	cancel, err := c.writeback.markDirty(path)
+	if err != nil {
+		return err
+	}
+	if err := write(c.filesystems[0]); err != nil {
+		cancel()
+		return err
+	}
+	return nil
+}
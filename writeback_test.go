@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newWritebackChain returns a chain of a cache in front of a main store that
+// takes locks, along with both, without write-back enabled yet
+func newWritebackChain(t *testing.T) (*ChainFS, *LocalFS, *LocalFS) {
+	t.Helper()
+
+	cache, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleCache,
+		MaxSize:  1 << 30,
+		Features: FileSystemFeatures{CanUpdate: true, CanDelete: true},
+		RootPath: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	main, err := NewLocalFS(FileSystemConfig{
+		Role:     RoleMain,
+		Features: FileSystemFeatures{CanUpdate: true, CanDelete: true, CanLock: true},
+		RootPath: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewChainFS([]ServerFS{cache, main}, nil)
+	t.Cleanup(chain.background.Wait)
+	return chain, cache, main
+}
+
+func TestWriteBackJournalsBeforeWriting(t *testing.T) {
+	chain, cache, _ := newWritebackChain(t)
+	journal := filepath.Join(t.TempDir(), writebackJournalName)
+	if err := chain.EnableWriteback(journal); err != nil {
+		t.Fatal(err)
+	}
+
+	// replayed returns the unflushed files a restarted server would find
+	replayed := func() map[string]*dirtyEntry {
+		w := &writeback{dirty: make(map[string]*dirtyEntry), path: journal}
+		if err := w.replay(); err != nil {
+			t.Fatal(err)
+		}
+		return w.dirty
+	}
+
+	unlock := chain.paths.Lock("/f")
+	failed := errors.New("write failed")
+	err := chain.writeBack("/f", func(fs ServerFS) error {
+		if !cache.isPinned("/f") {
+			t.Error("file is not pinned while it is written")
+		}
+		if _, ok := replayed()["/f"]; !ok {
+			t.Error("file is not in the journal while it is written")
+		}
+		return failed
+	})
+	unlock()
+	if !errors.Is(err, failed) {
+		t.Fatalf("writeBack = %v, want the write's error", err)
+	}
+
+	// A failed write leaves nothing to flush
+	if chain.writeback.isDirty("/f") {
+		t.Error("file is queued after its write failed")
+	}
+	if cache.isPinned("/f") {
+		t.Error("file is pinned after its write failed")
+	}
+	if _, ok := replayed()["/f"]; ok {
+		t.Error("journal still lists the file after its write failed")
+	}
+}
+
+func TestFlushStreamsPastOtherOwnersLocks(t *testing.T) {
+	chain, cache, main := newWritebackChain(t)
+
+	content := make([]byte, 2*copyChunkSize+777)
+	for i := range content {
+		content[i] = byte(i % 253)
+	}
+	if err := main.Write("/f", []byte("old"), 0644, LockOwner{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Write("/f", content, 0600, LockOwner{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone other than the writer opened the file since
+	other := LockOwner{ClientID: "other", Pid: 2, HandleID: 1}
+	if _, err := chain.Lock(context.Background(), "/f", WriteLock, other, LockOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock := chain.paths.Lock("/f")
+	err := chain.flush("/f")
+	unlock()
+	if err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if err := chain.Unlock("/f", other); err != nil {
+		t.Fatal(err)
+	}
+	flushed, err := main.Read("/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(flushed, content) {
+		t.Errorf("main store has %d bytes that differ from the %d written", len(flushed), len(content))
+	}
+	if info, err := main.Info("/f"); err != nil || info.Mode.Perm() != 0600 {
+		t.Errorf("flushed file has mode %v (%v), want 0600", info.Mode.Perm(), err)
+	}
+}
+
+func TestRenameOfUnflushedFile(t *testing.T) {
+	chain, cache, main := newWritebackChain(t)
+	if err := chain.EnableWriteback(filepath.Join(t.TempDir(), writebackJournalName)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.WriteAt("/f", []byte("dirty"), 0, LockOwner{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.Mkdir("/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.Write("/d/x", []byte("x"), 0644, LockOwner{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := main.Write("/e", []byte("old target"), 0644, LockOwner{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rename the cache refuses fails as a whole and keeps the file
+	if err := chain.Rename("/f", "/d"); err == nil {
+		t.Fatal("renaming a file over a directory that is not empty succeeded")
+	}
+	if content, err := chain.Read("/f"); err != nil || string(content) != "dirty" {
+		t.Fatalf("Read(/f) = %q, %v after the failed rename", content, err)
+	}
+
+	if err := chain.Rename("/f", "/e"); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := chain.Read("/e"); err != nil || string(content) != "dirty" {
+		t.Errorf("Read(/e) = %q, %v, want the unflushed content", content, err)
+	}
+	if _, err := cache.Info("/f"); err == nil {
+		t.Error("cache still holds the old name")
+	}
+
+	unlock := chain.paths.Lock("/e")
+	err := chain.flush("/e")
+	unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := main.Read("/e"); err != nil || string(content) != "dirty" {
+		t.Errorf("main store has %q, %v after the flush, want the renamed file", content, err)
+	}
+}
+
+// blockingFS is a local filesystem whose whole-file writes wait until
+// release is closed, reporting on entered when one starts waiting
+type blockingFS struct {
+	*LocalFS
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingFS) Write(path string, content []byte, mode os.FileMode, owner LockOwner) error {
+	select {
+	case b.entered <- struct{}{}:
+	default:
+	}
+	<-b.release
+	return b.LocalFS.Write(path, content, mode, owner)
+}
+
+func TestFlushDoesNotHoldUpTheFile(t *testing.T) {
+	chain, cache, main := newWritebackChain(t)
+	slow := &blockingFS{LocalFS: main, entered: make(chan struct{}, 1), release: make(chan struct{})}
+	chain.filesystems[1] = slow
+	if err := chain.EnableWriteback(filepath.Join(t.TempDir(), writebackJournalName)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := chain.WriteAt("/f", []byte("one"), 0, LockOwner{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-slow.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush did not start")
+	}
+
+	// The file can be written and read while it is being flushed
+	done := make(chan error)
+	go func() {
+		if _, err := chain.WriteAt("/f", []byte("two"), 0, LockOwner{}); err != nil {
+			done <- err
+			return
+		}
+		buf := make([]byte, 3)
+		if _, err := chain.ReadAt("/f", buf, 0, LockOwner{}); err != nil && err != io.EOF {
+			done <- err
+			return
+		}
+		if string(buf) != "two" {
+			done <- fmt.Errorf("read %q, want %q", buf, "two")
+			return
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		close(slow.release)
+		t.Fatal("write and read waited for the flush")
+	}
+	close(slow.release)
+
+	// The overtaken copy is flushed again with the new content
+	deadline := time.Now().Add(5 * time.Second)
+	for chain.writeback.isDirty("/f") {
+		if time.Now().After(deadline) {
+			t.Fatal("file was not flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if content, err := main.Read("/f"); err != nil || string(content) != "two" {
+		t.Errorf("main store has %q, %v, want %q", content, err, "two")
+	}
+	if cache.isPinned("/f") {
+		t.Error("file is pinned after it was flushed")
+	}
+}